@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// usernamePlaceholder is replaced in ACL filters with the connecting user's name.
+const usernamePlaceholder = "{username}"
+
+// aclRule grants a user publish and subscribe access to a set of topic filters.
+// A username of "*" applies the rule to every user without a rule of their own.
+type aclRule struct {
+	Username  string   `yaml:"username"`
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+}
+
+// aclFile is the layout of the YAML file named by MQTT_ACL_FILE.
+type aclFile struct {
+	ACL []aclRule `yaml:"acl"`
+}
+
+// defaultACLRules lets devices publish only to their own data topic and the
+// ingestion service subscribe only to device data. Users without a role, such
+// as devices identified by certificate, get the device rule.
+func defaultACLRules(users []userConfig) []aclRule {
+	var rules []aclRule
+	for _, user := range users {
+		switch user.Role {
+		case roleDevice:
+			rules = append(rules, aclRule{Username: user.Username, Publish: []string{"devices/{username}/data"}})
+		case roleService:
+			rules = append(rules, aclRule{Username: user.Username, Subscribe: []string{"devices/+/data"}})
+		}
+	}
+	return append(rules, aclRule{Username: "*", Publish: []string{"devices/{username}/data"}})
+}
+
+// loadACLRules reads ACL rules from a YAML file. ${VAR} references in usernames
+// are expanded from the environment so rules can refer to CLIENT_USER and SERVICE_USER.
+func loadACLRules(path string) ([]aclRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACL file: %w", err)
+	}
+
+	var file aclFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse ACL file %s: %w", path, err)
+	}
+
+	for i := range file.ACL {
+		file.ACL[i].Username = os.ExpandEnv(file.ACL[i].Username)
+		if file.ACL[i].Username == "" {
+			return nil, fmt.Errorf("ACL rule %d in %s has no username", i, path)
+		}
+	}
+	return file.ACL, nil
+}
+
+// filters expands the rule into ledger filters for a username. Anything not
+// explicitly granted is denied, so a user's rule never falls through to a more
+// permissive one further down the ledger.
+func (r aclRule) filters(username string) auth.Filters {
+	filters := auth.Filters{"#": auth.Deny}
+	for _, filter := range r.Publish {
+		key := auth.RString(strings.ReplaceAll(filter, usernamePlaceholder, username))
+		filters[key] = grant(filters[key], auth.WriteOnly)
+	}
+	for _, filter := range r.Subscribe {
+		key := auth.RString(strings.ReplaceAll(filter, usernamePlaceholder, username))
+		filters[key] = grant(filters[key], auth.ReadOnly)
+	}
+	return filters
+}
+
+// isTemplate reports whether the rule must be expanded per connecting user.
+func (r aclRule) isTemplate() bool {
+	if r.Username != "*" {
+		return false
+	}
+	for _, filters := range [][]string{r.Publish, r.Subscribe} {
+		for _, filter := range filters {
+			if strings.Contains(filter, usernamePlaceholder) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// grant combines an existing access level with a new one.
+func grant(current, access auth.Access) auth.Access {
+	if current == auth.Deny || current == access {
+		return access
+	}
+	return auth.ReadWrite
+}
+
+// buildACL converts the declarative rules into ledger rules. Wildcard rules that
+// use {username} depend on who is connecting, so they are returned separately
+// for the aclHook to evaluate. The ledger always ends with a rule that
+// denies everything to users no other rule matched.
+func buildACL(rules []aclRule) (auth.ACLRules, []aclRule) {
+	var ledgerRules auth.ACLRules
+	var wildcardRules auth.ACLRules
+	var templates []aclRule
+
+	for _, rule := range rules {
+		switch {
+		case rule.isTemplate():
+			templates = append(templates, rule)
+		case rule.Username == "*":
+			wildcardRules = append(wildcardRules, auth.ACLRule{Username: "*", Filters: rule.filters("")})
+		default:
+			ledgerRules = append(ledgerRules, auth.ACLRule{
+				Username: auth.RString(rule.Username),
+				Filters:  rule.filters(rule.Username),
+			})
+		}
+	}
+
+	ledgerRules = append(ledgerRules, wildcardRules...)
+	ledgerRules = append(ledgerRules, auth.ACLRule{Username: "*", Filters: auth.Filters{"#": auth.Deny}})
+	return ledgerRules, templates
+}
+
+// authLedger holds the state shared with the server's auth hooks. Keeping hold
+// of it lets a config reload replace the credentials and rules without
+// restarting the server.
+type authLedger struct {
+	ledger *auth.Ledger
+	acl    *aclHook
+}
+
+// addLedgerHooks adds the ledger-backed hook that authenticates connections
+// and the hook that checks every publish and subscription against the ACL.
+func addLedgerHooks(server *mqtt.Server, authRules auth.AuthRules, aclRules []aclRule) (*authLedger, error) {
+	ledger := &auth.Ledger{Auth: authRules}
+	acl := new(aclHook)
+	acl.setRules(buildACL(aclRules))
+
+	if err := server.AddHook(new(credentialHook), &auth.Options{Ledger: ledger}); err != nil {
+		return nil, err
+	}
+	if err := server.AddHook(acl, nil); err != nil {
+		return nil, err
+	}
+	return &authLedger{ledger: ledger, acl: acl}, nil
+}
+
+// update swaps in new credentials and ACL rules. Connected clients keep their
+// sessions and are checked against the new rules from their next packet.
+func (a *authLedger) update(authRules auth.AuthRules, aclRules []aclRule) {
+	a.ledger.Update(&auth.Ledger{Auth: authRules})
+	a.acl.setRules(buildACL(aclRules))
+}
+
+// hasUser reports whether username is one of the ledger's allowed users.
+func (a *authLedger) hasUser(username string) bool {
+	a.ledger.Lock()
+	defer a.ledger.Unlock()
+	for _, rule := range a.ledger.Auth {
+		if rule.Allow && string(rule.Username) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialHook is the ledger's auth hook limited to authenticating
+// connections; the aclHook makes every ACL decision.
+type credentialHook struct {
+	auth.Hook
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *credentialHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate
+}
+
+// aclHook checks publishes and subscriptions against the ledger rules and, for
+// users without a rule of their own, the wildcard {username} templates, e.g.
+// for devices identified by their certificate CN. Templates are evaluated per
+// check rather than expanded into the ledger, and a reload swaps the rules and
+// templates together under the hook's lock.
+type aclHook struct {
+	mqtt.HookBase
+
+	mu        sync.RWMutex
+	rules     *auth.Ledger
+	templates []aclRule
+	named     map[string]struct{}
+}
+
+// ID returns the ID of the hook.
+func (h *aclHook) ID() string {
+	return "acl"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *aclHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+	}, []byte{b})
+}
+
+// setRules replaces the ledger rules and templates from buildACL.
+func (h *aclHook) setRules(rules auth.ACLRules, templates []aclRule) {
+	named := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		if rule.Username != "*" {
+			named[string(rule.Username)] = struct{}{}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = &auth.Ledger{ACL: rules}
+	h.templates = templates
+	h.named = named
+}
+
+// OnACLCheck allows the access if the ledger rules do or, for a user without a
+// rule of their own, any template expanded for their username does.
+func (h *aclHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if h.allowed(cl, topic, write) {
+		return true
+	}
+	h.Log.Debug("client failed allowed ACL check",
+		"client", cl.ID,
+		"username", string(cl.Properties.Username),
+		"topic", topic)
+	return false
+}
+
+// allowed evaluates the rules and templates under the read lock.
+func (h *aclHook) allowed(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, ok := h.rules.ACLOk(cl, topic, write); ok {
+		return true
+	}
+	username := string(cl.Properties.Username)
+	if _, ok := h.named[username]; ok || !templateUsername(username) {
+		return false
+	}
+	for _, template := range h.templates {
+		if template.allows(username, topic, write) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the rule, expanded for username, grants publish
+// (write) or subscribe access to topic.
+func (r aclRule) allows(username, topic string, write bool) bool {
+	filters := r.Subscribe
+	if write {
+		filters = r.Publish
+	}
+	for _, filter := range filters {
+		if auth.RString(strings.ReplaceAll(filter, usernamePlaceholder, username)).FilterMatches(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// templateUsername reports whether templates may be expanded for username. A
+// name containing topic separators or wildcards would widen the filters it is
+// substituted into.
+func templateUsername(username string) bool {
+	return username != "" && !strings.ContainsAny(username, "/+#")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestACLHookEnforcesDefaultRules checks the default rules through the ACL
+// hook exactly as the server evaluates them.
+func TestACLHookEnforcesDefaultRules(t *testing.T) {
+	// --- Arrange ---
+	hook := new(aclHook)
+	hook.SetOpts(slog.Default(), nil)
+	hook.setRules(buildACL(defaultACLRules(testUsers())))
+
+	clientFor := func(username string) *mqtt.Client {
+		return &mqtt.Client{ID: username + "-client", Properties: mqtt.ClientProperties{Username: []byte(username)}}
+	}
+
+	testCases := []struct {
+		name     string
+		username string
+		topic    string
+		write    bool
+		allowed  bool
+	}{
+		{"device publishes own topic", "device-user", "devices/device-user/data", true, true},
+		{"device publishes other device topic", "device-user", "devices/other/data", true, false},
+		{"device subscribes to device data", "device-user", "devices/+/data", false, false},
+		{"device subscribes to everything", "device-user", "#", false, false},
+		{"service subscribes to device data", "service-user", "devices/+/data", false, true},
+		{"service subscribes to everything", "service-user", "#", false, false},
+		{"service publishes device data", "service-user", "devices/device-user/data", true, false},
+		{"certificate device publishes own topic", "garden-monitor-001", "devices/garden-monitor-001/data", true, true},
+		{"certificate device publishes other topic", "garden-monitor-001", "devices/device-user/data", true, false},
+		{"unknown user publishes", "stranger", "devices/stranger/data", true, false},
+		{"wildcard username publishes other topic", "+", "devices/device-user/data", true, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			allowed := hook.OnACLCheck(clientFor(tc.username), tc.topic, tc.write)
+
+			// --- Assert ---
+			assert.Equal(t, tc.allowed, allowed)
+		})
+	}
+}
+
+// TestACLHookReloadReplacesRulesAndTemplates verifies a reload swaps the
+// rules and templates together, and that checks leave them unchanged.
+func TestACLHookReloadReplacesRulesAndTemplates(t *testing.T) {
+	// --- Arrange ---
+	hook := new(aclHook)
+	hook.SetOpts(slog.Default(), nil)
+	hook.setRules(buildACL(defaultACLRules(testUsers())))
+	device := &mqtt.Client{ID: "cert-client", Properties: mqtt.ClientProperties{Username: []byte("garden-monitor-001")}}
+	for i := 0; i < 100; i++ {
+		require.True(t, hook.OnACLCheck(device, "devices/garden-monitor-001/data", true))
+	}
+	rulesBefore := len(hook.rules.ACL)
+
+	// --- Act ---
+	hook.setRules(buildACL([]aclRule{
+		{Username: "garden-monitor-001", Publish: []string{"gardens/garden-monitor-001/data"}},
+		{Username: "*", Publish: []string{"sensors/{username}/data"}},
+	}))
+
+	// --- Assert ---
+	assert.Equal(t, 3, rulesBefore, "checks should not add rules")
+	assert.False(t, hook.OnACLCheck(device, "devices/garden-monitor-001/data", true), "old template should be gone")
+	assert.True(t, hook.OnACLCheck(device, "gardens/garden-monitor-001/data", true), "new named rule should apply")
+	assert.False(t, hook.OnACLCheck(device, "sensors/garden-monitor-001/data", true), "templates skip users with their own rule")
+	other := &mqtt.Client{ID: "other-client", Properties: mqtt.ClientProperties{Username: []byte("garden-monitor-002")}}
+	assert.True(t, hook.OnACLCheck(other, "sensors/garden-monitor-002/data", true), "new template should apply")
+}
+
+// TestBrokerDeniesUnauthorisedPublishAndSubscribe connects a device over TCP and
+// verifies the broker refuses its subscription and drops its foreign publish.
+func TestBrokerDeniesUnauthorisedPublishAndSubscribe(t *testing.T) {
+	// --- Arrange ---
+	port := freePort(t)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	authRules := auth.AuthRules{
+		{Username: "device-user", Password: "device-pass", Allow: true},
+		{Username: "service-user", Password: "service-pass", Allow: true},
+	}
+	_, err := addLedgerHooks(server, authRules, defaultACLRules(testUsers()))
+	require.NoError(t, err)
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	received := make(chan string, 10)
+	require.NoError(t, server.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk.TopicName
+	}))
+
+	conn := dialBroker(t, port)
+	connack := sendConnect(t, conn, "acl-test-device", "device-user", "device-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	subscribeCode := sendSubscribe(t, conn, 1, "devices/+/data")
+	sendPublish(t, conn, "devices/other/data", []byte(`{"denied":true}`))
+	sendPublish(t, conn, "devices/device-user/data", []byte(`{"denied":false}`))
+
+	// --- Assert ---
+	assert.GreaterOrEqual(t, subscribeCode, packets.ErrUnspecifiedError.Code, "subscription should be refused")
+	select {
+	case topic := <-received:
+		assert.Equal(t, "devices/device-user/data", topic, "only the device's own topic should be delivered")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the permitted publish")
+	}
+	assert.Never(t, func() bool { return len(received) > 0 }, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+// TestLoadACLRulesExpandsEnvironment verifies usernames in the ACL file can
+// refer to environment variables.
+func TestLoadACLRulesExpandsEnvironment(t *testing.T) {
+	// --- Arrange ---
+	t.Setenv("SERVICE_USER", "sreceiver")
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	content := `
+acl:
+  - username: ${SERVICE_USER}
+    subscribe: ["devices/+/data"]
+  - username: "*"
+    publish: ["devices/{username}/data"]
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	// --- Act ---
+	rules, err := loadACLRules(path)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "sreceiver", rules[0].Username)
+	assert.Equal(t, []string{"devices/+/data"}, rules[0].Subscribe)
+	assert.True(t, rules[1].isTemplate())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// adminConfig protects the HTTP endpoints that expose traffic or change broker
+// state: /tap and DELETE /clients/{id}. Both need a bearer token, and /tap is
+// only served when Tap is set. TokenFile is re-read on every reload.
+type adminConfig struct {
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Tap       bool   `yaml:"tap"`
+}
+
+// validate checks the tap is not enabled without a token to protect it.
+func (a adminConfig) validate() error {
+	if a.Tap && a.Token == "" && a.TokenFile == "" {
+		return fmt.Errorf("admin.tap needs an admin token (token/ADMIN_TOKEN or token_file/ADMIN_TOKEN_FILE)")
+	}
+	return nil
+}
+
+// resolveToken returns the admin token, reading TokenFile if it is set. An
+// empty token leaves the admin endpoints disabled.
+func (a adminConfig) resolveToken() (string, error) {
+	if a.TokenFile == "" {
+		return a.Token, nil
+	}
+	data, err := os.ReadFile(a.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// adminAuth checks the admin bearer token. The token can be replaced while the
+// server runs, e.g. when its file is rotated before a SIGHUP.
+type adminAuth struct {
+	mu    sync.RWMutex
+	token []byte
+}
+
+// newAdminAuth creates an adminAuth for token.
+func newAdminAuth(token string) *adminAuth {
+	return &adminAuth{token: []byte(token)}
+}
+
+// update replaces the accepted token.
+func (a *adminAuth) update(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = []byte(token)
+}
+
+// authorize writes a 403 when no token is configured, or a 401 when the
+// request does not carry it, and reports whether the request may go on.
+func (a *adminAuth) authorize(w http.ResponseWriter, r *http.Request) bool {
+	a.mu.RLock()
+	token := a.token
+	a.mu.RUnlock()
+
+	if len(token) == 0 {
+		http.Error(w, "Forbidden: admin endpoints are disabled until an admin token is configured", http.StatusForbidden)
+		return false
+	}
+	scheme, presented, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimSpace(presented)), token) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mochi-admin"`)
+		http.Error(w, "Unauthorized: a valid admin bearer token is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// require wraps next so only requests carrying the admin token reach it.
+func (a *adminAuth) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.authorize(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdminAuthRequire verifies admin endpoints are refused without a
+// configured token and otherwise need it as a bearer token.
+func TestAdminAuthRequire(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testCases := []struct {
+		name          string
+		token         string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "no token configured", authorization: "Bearer anything", wantStatus: http.StatusForbidden},
+		{name: "no header", token: "s3cret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", token: "s3cret", authorization: "Basic s3cret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "right token", token: "s3cret", authorization: "Bearer s3cret", wantStatus: http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			req := httptest.NewRequest(http.MethodGet, "/tap?filter=%23", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+
+			// --- Act ---
+			newAdminAuth(tc.token).require(next).ServeHTTP(rec, req)
+
+			// --- Assert ---
+			assert.Equal(t, tc.wantStatus, rec.Code)
+		})
+	}
+}
+
+// TestAdminAuthUpdateRotatesToken verifies a reload replaces the old token.
+func TestAdminAuthUpdateRotatesToken(t *testing.T) {
+	// --- Arrange ---
+	admin := newAdminAuth("old")
+	protected := admin.require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	statusFor := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/tap", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// --- Act ---
+	admin.update("new")
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusUnauthorized, statusFor("old"))
+	assert.Equal(t, http.StatusOK, statusFor("new"))
+}
+
+// TestLoadBrokerConfigAdmin verifies the tap must be enabled explicitly and
+// cannot be enabled without a token, which may come from a file.
+func TestLoadBrokerConfigAdmin(t *testing.T) {
+	// --- Arrange ---
+	clearBrokerEnv(t)
+	t.Setenv("CLIENT_USER", "device")
+	t.Setenv("CLIENT_PASS", "device-pass")
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0o600))
+
+	// --- Act ---
+	defaults, defaultsErr := loadBrokerConfig("")
+	t.Setenv("TAP_ENABLED", "true")
+	_, noTokenErr := loadBrokerConfig("")
+	t.Setenv("ADMIN_TOKEN_FILE", tokenFile)
+	enabled, enabledErr := loadBrokerConfig("")
+
+	// --- Assert ---
+	require.NoError(t, defaultsErr)
+	assert.False(t, defaults.Admin.Tap, "the tap should be off by default")
+	assert.ErrorContains(t, noTokenErr, "ADMIN_TOKEN")
+	require.NoError(t, enabledErr)
+	assert.True(t, enabled.Admin.Tap)
+	token, err := enabled.Admin.resolveToken()
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", token)
+}
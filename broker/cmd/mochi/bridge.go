@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// mqttTopicAttribute carries the original MQTT topic on each Pub/Sub message,
+// matching what the ingestion service's enricher expects.
+const mqttTopicAttribute = "mqtt_topic"
+
+// bridgeConfig configures the optional MQTT to Pub/Sub bridge. The bridge is
+// enabled when a topic is set.
+type bridgeConfig struct {
+	ProjectID    string        `yaml:"project_id"`
+	TopicID      string        `yaml:"topic_id"`
+	Filters      []string      `yaml:"filters"`
+	BatchSize    int           `yaml:"batch_size"`
+	BatchDelay   time.Duration `yaml:"batch_delay"`
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	QueueSize    int           `yaml:"queue_size"`
+}
+
+// enabled reports whether the bridge is configured.
+func (b bridgeConfig) enabled() bool {
+	return b.TopicID != ""
+}
+
+// validate checks an enabled bridge knows which project to publish to.
+func (b bridgeConfig) validate() error {
+	if !b.enabled() {
+		return nil
+	}
+	if b.ProjectID == "" {
+		return fmt.Errorf("the Pub/Sub bridge needs a project_id (or GCP_PROJECT_ID)")
+	}
+	return nil
+}
+
+// options converts the config into hook options, filling in defaults.
+func (b bridgeConfig) options(publisher bridgePublisher) *pubsubBridgeOptions {
+	opts := &pubsubBridgeOptions{
+		Publisher:    publisher,
+		Filters:      b.Filters,
+		BatchSize:    b.BatchSize,
+		BatchDelay:   b.BatchDelay,
+		MaxRetries:   b.MaxRetries,
+		RetryBackoff: b.RetryBackoff,
+		QueueSize:    b.QueueSize,
+	}
+	if len(opts.Filters) == 0 {
+		opts.Filters = []string{"devices/+/data"}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.BatchDelay <= 0 {
+		opts.BatchDelay = 50 * time.Millisecond
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	return opts
+}
+
+// bridgeMessage is an MQTT publish queued for forwarding.
+type bridgeMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// bridgePublisher delivers a batch of messages and returns those that failed,
+// so only they are retried.
+type bridgePublisher interface {
+	PublishBatch(ctx context.Context, batch []bridgeMessage) ([]bridgeMessage, error)
+	Close() error
+}
+
+// pubsubBridgeOptions contains the configuration for the bridge hook.
+type pubsubBridgeOptions struct {
+	Publisher    bridgePublisher
+	Filters      []string
+	BatchSize    int
+	BatchDelay   time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	QueueSize    int
+}
+
+// bridgeStats counts what the bridge has done with matching messages.
+type bridgeStats struct {
+	Forwarded int64
+	Dropped   int64
+	Failed    int64
+}
+
+// pubsubBridgeHook forwards publishes matching the configured filters to
+// Pub/Sub. Messages are queued so a slow Pub/Sub never blocks the broker; when
+// the queue is full new messages are dropped and counted.
+type pubsubBridgeHook struct {
+	mqtt.HookBase
+	config *pubsubBridgeOptions
+	queue  chan bridgeMessage
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+
+	// ctx is cancelled by Stop to end publishes and retry waits in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	forwarded atomic.Int64
+	dropped   atomic.Int64
+	failed    atomic.Int64
+}
+
+// ID returns the ID of the hook.
+func (h *pubsubBridgeHook) ID() string {
+	return "pubsub-bridge"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *pubsubBridgeHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init validates the options and starts the batching worker.
+func (h *pubsubBridgeHook) Init(config any) error {
+	if _, ok := config.(*pubsubBridgeOptions); !ok || config == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+	h.config = config.(*pubsubBridgeOptions)
+	if h.config.Publisher == nil {
+		return errors.New("pubsub bridge needs a publisher")
+	}
+
+	h.queue = make(chan bridgeMessage, h.config.QueueSize)
+	h.done = make(chan struct{})
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	go h.run()
+	return nil
+}
+
+// Stop ends any publish or retry in progress, counting its messages as
+// failed, makes one last attempt at whatever is still queued and closes the
+// publisher.
+func (h *pubsubBridgeHook) Stop() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.queue)
+	h.mu.Unlock()
+
+	h.cancel()
+	<-h.done
+	return h.config.Publisher.Close()
+}
+
+// OnPublished queues a copy of any publish matching one of the filters.
+func (h *pubsubBridgeHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if !h.matches(pk.TopicName) {
+		return
+	}
+
+	msg := bridgeMessage{Topic: pk.TopicName, Payload: append([]byte(nil), pk.Payload...)}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.queue <- msg:
+	default:
+		h.dropped.Add(1)
+		h.Log.Warn("pubsub bridge queue full, dropping message", "topic", pk.TopicName)
+	}
+}
+
+// stats returns a snapshot of the bridge counters.
+func (h *pubsubBridgeHook) stats() bridgeStats {
+	return bridgeStats{
+		Forwarded: h.forwarded.Load(),
+		Dropped:   h.dropped.Load(),
+		Failed:    h.failed.Load(),
+	}
+}
+
+// writeMetrics adds the bridge counters to /metrics.
+func (h *pubsubBridgeHook) writeMetrics(w io.Writer) {
+	stats := h.stats()
+	_, _ = fmt.Fprintln(w, "# HELP mochi_bridge_messages_total Publishes matched by the Pub/Sub bridge, by outcome.")
+	_, _ = fmt.Fprintln(w, "# TYPE mochi_bridge_messages_total counter")
+	_, _ = fmt.Fprintf(w, "mochi_bridge_messages_total{outcome=%q} %d\n", "dropped", stats.Dropped)
+	_, _ = fmt.Fprintf(w, "mochi_bridge_messages_total{outcome=%q} %d\n", "failed", stats.Failed)
+	_, _ = fmt.Fprintf(w, "mochi_bridge_messages_total{outcome=%q} %d\n", "forwarded", stats.Forwarded)
+}
+
+// matches reports whether the topic matches any configured filter.
+func (h *pubsubBridgeHook) matches(topic string) bool {
+	for _, filter := range h.config.Filters {
+		if _, ok := auth.MatchTopic(filter, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run collects queued messages into batches, sending a batch when it is full
+// or when BatchDelay has passed since its first message.
+func (h *pubsubBridgeHook) run() {
+	defer close(h.done)
+
+	batch := make([]bridgeMessage, 0, h.config.BatchSize)
+	timer := time.NewTimer(h.config.BatchDelay)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		h.publishWithRetry(batch)
+		batch = make([]bridgeMessage, 0, h.config.BatchSize)
+	}
+
+	for {
+		select {
+		case msg, ok := <-h.queue:
+			if !ok {
+				timer.Stop()
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(h.config.BatchDelay)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= h.config.BatchSize {
+				timer.Stop()
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// publishWithRetry sends a batch, retrying the failed messages with
+// exponential backoff. Messages still failing after MaxRetries, or when Stop
+// cuts the retries short, are counted and dropped. Once stopping, batches get
+// a single attempt that Stop does not cancel.
+func (h *pubsubBridgeHook) publishWithRetry(batch []bridgeMessage) {
+	ctx, maxRetries := h.ctx, h.config.MaxRetries
+	if ctx.Err() != nil {
+		ctx, maxRetries = context.WithoutCancel(ctx), 0
+	}
+	pending := batch
+	backoff := h.config.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		failed, err := h.config.Publisher.PublishBatch(ctx, pending)
+		h.forwarded.Add(int64(len(pending) - len(failed)))
+		if err == nil || len(failed) == 0 {
+			return
+		}
+
+		if attempt >= maxRetries {
+			h.failed.Add(int64(len(failed)))
+			h.Log.Error("pubsub bridge giving up on messages", "count", len(failed), "attempts", attempt+1, "error", err)
+			return
+		}
+
+		h.Log.Warn("pubsub bridge publish failed, retrying", "count", len(failed), "attempt", attempt+1, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			h.failed.Add(int64(len(failed)))
+			h.Log.Error("pubsub bridge stopped while retrying, dropping messages", "count", len(failed), "attempts", attempt+1, "error", err)
+			return
+		}
+		backoff *= 2
+		pending = failed
+	}
+}
+
+// pubsubPublisher publishes bridge batches to a Pub/Sub topic.
+type pubsubPublisher struct {
+	client    *pubsub.Client
+	publisher *pubsub.Publisher
+	ownClient bool
+}
+
+// newPubSubPublisher creates a Pub/Sub client for the project and a publisher for the topic.
+func newPubSubPublisher(ctx context.Context, projectID, topicID string) (*pubsubPublisher, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	p := newPubSubPublisherFromClient(client, topicID)
+	p.ownClient = true
+	return p, nil
+}
+
+// newPubSubPublisherFromClient publishes to topicID with an existing client,
+// which the caller remains responsible for closing.
+func newPubSubPublisherFromClient(client *pubsub.Client, topicID string) *pubsubPublisher {
+	return &pubsubPublisher{
+		client:    client,
+		publisher: client.Publisher(topicID),
+	}
+}
+
+// PublishBatch publishes every message, then waits for all the results.
+func (p *pubsubPublisher) PublishBatch(ctx context.Context, batch []bridgeMessage) ([]bridgeMessage, error) {
+	results := make([]*pubsub.PublishResult, len(batch))
+	for i, msg := range batch {
+		results[i] = p.publisher.Publish(ctx, &pubsub.Message{
+			Data:       msg.Payload,
+			Attributes: map[string]string{mqttTopicAttribute: msg.Topic},
+		})
+	}
+
+	var failed []bridgeMessage
+	var errs []error
+	for i, result := range results {
+		if _, err := result.Get(ctx); err != nil {
+			failed = append(failed, batch[i])
+			errs = append(errs, err)
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// Close flushes the publisher and, if it created it, closes the client.
+func (p *pubsubPublisher) Close() error {
+	p.publisher.Stop()
+	if p.ownClient {
+		return p.client.Close()
+	}
+	return nil
+}
+
+// addBridgeHook adds the MQTT to Pub/Sub bridge.
+func addBridgeHook(ctx context.Context, server *mqtt.Server, settings bridgeConfig) *pubsubBridgeHook {
+	log.Printf("MQTT Broker will bridge %v to Pub/Sub topic %s in project %s",
+		settings.options(nil).Filters, settings.TopicID, settings.ProjectID)
+
+	publisher, err := newPubSubPublisher(ctx, settings.ProjectID, settings.TopicID)
+	if err != nil {
+		log.Fatalf("Failed to create Pub/Sub bridge publisher: %v", err)
+	}
+	hook := new(pubsubBridgeHook)
+	if err := server.AddHook(hook, settings.options(publisher)); err != nil {
+		log.Fatalf("Failed to add Pub/Sub bridge hook: %v", err)
+	}
+	return hook
+}
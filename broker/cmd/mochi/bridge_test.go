@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeBridgePublisher records batches in memory and fails the first failures calls.
+type fakeBridgePublisher struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	batches  [][]bridgeMessage
+	closed   bool
+}
+
+func (f *fakeBridgePublisher) PublishBatch(_ context.Context, batch []bridgeMessage) ([]bridgeMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return batch, errors.New("unavailable")
+	}
+	f.batches = append(f.batches, batch)
+	return nil, nil
+}
+
+func (f *fakeBridgePublisher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// delivered returns every message published so far, in order.
+func (f *fakeBridgePublisher) delivered() []bridgeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var all []bridgeMessage
+	for _, batch := range f.batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+// newTestBridgeHook initialises a bridge hook around the given publisher.
+func newTestBridgeHook(t *testing.T, publisher bridgePublisher, opts bridgeConfig) *pubsubBridgeHook {
+	t.Helper()
+	hook := new(pubsubBridgeHook)
+	hook.SetOpts(slog.Default(), nil)
+	require.NoError(t, hook.Init(opts.options(publisher)))
+	return hook
+}
+
+// TestBridgeHookBatchesMatchingPublishes verifies only matching topics are
+// forwarded and that they are grouped into batches of BatchSize.
+func TestBridgeHookBatchesMatchingPublishes(t *testing.T) {
+	// --- Arrange ---
+	publisher := &fakeBridgePublisher{}
+	hook := newTestBridgeHook(t, publisher, bridgeConfig{BatchSize: 2, BatchDelay: time.Hour})
+
+	// --- Act ---
+	hook.OnPublished(nil, packets.Packet{TopicName: "devices/dev-1/data", Payload: []byte("1")})
+	hook.OnPublished(nil, packets.Packet{TopicName: "status/dev-1", Payload: []byte("ignored")})
+	hook.OnPublished(nil, packets.Packet{TopicName: "devices/dev-2/data", Payload: []byte("2")})
+	hook.OnPublished(nil, packets.Packet{TopicName: "devices/dev-3/data", Payload: []byte("3")})
+	require.NoError(t, hook.Stop())
+
+	// --- Assert ---
+	require.Len(t, publisher.batches, 2, "a full batch plus the remainder flushed on stop")
+	assert.Len(t, publisher.batches[0], 2)
+	assert.Equal(t, []bridgeMessage{
+		{Topic: "devices/dev-1/data", Payload: []byte("1")},
+		{Topic: "devices/dev-2/data", Payload: []byte("2")},
+		{Topic: "devices/dev-3/data", Payload: []byte("3")},
+	}, publisher.delivered())
+	assert.True(t, publisher.closed)
+	assert.Equal(t, bridgeStats{Forwarded: 3}, hook.stats())
+}
+
+// TestBridgeHookRetriesFailedBatches verifies a failing publisher is retried
+// until it succeeds, and that messages are counted as failed once retries run out.
+func TestBridgeHookRetriesFailedBatches(t *testing.T) {
+	testCases := []struct {
+		name      string
+		failures  int
+		delivered int
+		stats     bridgeStats
+	}{
+		{"recovers within retries", 2, 1, bridgeStats{Forwarded: 1}},
+		{"gives up after max retries", 10, 0, bridgeStats{Failed: 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			publisher := &fakeBridgePublisher{failures: tc.failures}
+			hook := newTestBridgeHook(t, publisher, bridgeConfig{
+				BatchSize:    1,
+				MaxRetries:   3,
+				RetryBackoff: time.Millisecond,
+			})
+
+			// --- Act ---
+			hook.OnPublished(nil, packets.Packet{TopicName: "devices/dev-1/data", Payload: []byte("1")})
+			// Stop cuts retries short, so wait for the outcome first.
+			require.Eventually(t, func() bool { return hook.stats() == tc.stats }, 5*time.Second, time.Millisecond)
+			require.NoError(t, hook.Stop())
+
+			// --- Assert ---
+			assert.Len(t, publisher.delivered(), tc.delivered)
+			assert.Equal(t, tc.stats, hook.stats())
+		})
+	}
+}
+
+// TestBridgeHookStopEndsRetries verifies Stop does not wait out the retry
+// backoff, counts the abandoned messages as failed and reports them on /metrics.
+func TestBridgeHookStopEndsRetries(t *testing.T) {
+	// --- Arrange ---
+	publisher := &fakeBridgePublisher{failures: 10}
+	hook := newTestBridgeHook(t, publisher, bridgeConfig{
+		BatchSize:    1,
+		MaxRetries:   3,
+		RetryBackoff: time.Hour,
+	})
+	hook.OnPublished(nil, packets.Packet{TopicName: "devices/dev-1/data", Payload: []byte("1")})
+	require.Eventually(t, func() bool {
+		publisher.mu.Lock()
+		defer publisher.mu.Unlock()
+		return publisher.calls == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// --- Act ---
+	stopped := make(chan error, 1)
+	go func() { stopped <- hook.Stop() }()
+
+	// --- Assert ---
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the retry backoff")
+	}
+	assert.Equal(t, bridgeStats{Failed: 1}, hook.stats())
+	var out strings.Builder
+	hook.writeMetrics(&out)
+	assert.Contains(t, out.String(), `mochi_bridge_messages_total{outcome="failed"} 1`)
+	assert.Contains(t, out.String(), `mochi_bridge_messages_total{outcome="forwarded"} 0`)
+}
+
+// TestBridgeForwardsToPubSub runs the bridge against an in-process Pub/Sub fake
+// and publishes from a network client.
+func TestBridgeForwardsToPubSub(t *testing.T) {
+	// --- Arrange ---
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	topicName := "projects/test-project/topics/device-data"
+	_, err = client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: topicName})
+	require.NoError(t, err)
+
+	port := freePort(t)
+	server := mqtt.New(nil)
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	settings := bridgeConfig{ProjectID: "test-project", TopicID: "device-data", BatchDelay: 10 * time.Millisecond}
+	require.NoError(t, server.AddHook(new(pubsubBridgeHook), settings.options(newPubSubPublisherFromClient(client, topicName))))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	device := dialBroker(t, port)
+	connack := sendConnect(t, device, "garden-monitor-001", "", "")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	sendPublish(t, device, "devices/garden-monitor-001/status", []byte(`{"online":true}`))
+	sendPublish(t, device, "devices/garden-monitor-001/data", []byte(`{"temperature":21.5}`))
+
+	// --- Assert ---
+	require.Eventually(t, func() bool { return len(srv.Messages()) > 0 }, 5*time.Second, 20*time.Millisecond)
+	assert.Never(t, func() bool { return len(srv.Messages()) > 1 }, 200*time.Millisecond, 20*time.Millisecond)
+	msg := srv.Messages()[0]
+	assert.Equal(t, []byte(`{"temperature":21.5}`), msg.Data)
+	assert.Equal(t, "devices/garden-monitor-001/data", msg.Attributes[mqttTopicAttribute])
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// sessionTrackerHook records when each client connected, which the Mochi
+// client registry does not keep.
+type sessionTrackerHook struct {
+	mqtt.HookBase
+	mu       sync.RWMutex
+	sessions map[string]trackedSession
+}
+
+// trackedSession is the connect time of a specific client connection. The
+// client pointer tells a taken-over session apart from its replacement.
+type trackedSession struct {
+	client      *mqtt.Client
+	connectedAt time.Time
+}
+
+// newSessionTrackerHook returns an empty session tracker.
+func newSessionTrackerHook() *sessionTrackerHook {
+	return &sessionTrackerHook{sessions: make(map[string]trackedSession)}
+}
+
+// ID returns the ID of the hook.
+func (h *sessionTrackerHook) ID() string {
+	return "session-tracker"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *sessionTrackerHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// OnSessionEstablished records the connect time of the client.
+func (h *sessionTrackerHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessions[cl.ID] = trackedSession{client: cl, connectedAt: time.Now().UTC()}
+}
+
+// OnDisconnect forgets the client, unless the session has already been taken
+// over by a newer connection with the same ID.
+func (h *sessionTrackerHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if session, ok := h.sessions[cl.ID]; ok && session.client == cl {
+		delete(h.sessions, cl.ID)
+	}
+}
+
+// connectedAt returns when the client connected, if it is being tracked.
+func (h *sessionTrackerHook) connectedAt(cl *mqtt.Client) (time.Time, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	session, ok := h.sessions[cl.ID]
+	if !ok || session.client != cl {
+		return time.Time{}, false
+	}
+	return session.connectedAt, true
+}
+
+// clientInfo is the JSON view of a client in the inspection API.
+type clientInfo struct {
+	ID              string             `json:"id"`
+	Username        string             `json:"username"`
+	RemoteAddr      string             `json:"remote_addr"`
+	Listener        string             `json:"listener"`
+	ProtocolVersion byte               `json:"protocol_version"`
+	CleanSession    bool               `json:"clean_session"`
+	Connected       bool               `json:"connected"`
+	ConnectedAt     *time.Time         `json:"connected_at,omitempty"`
+	Subscriptions   []subscriptionInfo `json:"subscriptions"`
+	InflightCount   int                `json:"inflight_count"`
+}
+
+// subscriptionInfo is a single subscription of a client.
+type subscriptionInfo struct {
+	Filter string `json:"filter"`
+	Qos    byte   `json:"qos"`
+}
+
+// clientsHandler serves the client and session inspection API.
+type clientsHandler struct {
+	server  *mqtt.Server
+	tracker *sessionTrackerHook
+	admin   *adminAuth
+}
+
+// newClientsHandler creates the inspection API handler. Disconnecting a client
+// needs the admin token.
+func newClientsHandler(server *mqtt.Server, tracker *sessionTrackerHook, admin *adminAuth) *clientsHandler {
+	return &clientsHandler{server: server, tracker: tracker, admin: admin}
+}
+
+// register adds the inspection routes to the mux:
+//
+//	GET    /clients       connected clients (?all=true includes offline persistent sessions)
+//	GET    /clients/{id}  a single client
+//	DELETE /clients/{id}  disconnect a client (admin token required)
+func (h *clientsHandler) register(mux *http.ServeMux) {
+	mux.HandleFunc("/clients", h.handleList)
+	mux.HandleFunc("/clients/", h.handleClient)
+}
+
+// handleList returns the clients sorted by ID.
+func (h *clientsHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	includeOffline := r.URL.Query().Get("all") == "true"
+	clients := make([]clientInfo, 0)
+	for _, cl := range h.server.Clients.GetAll() {
+		if cl.Net.Inline || (!includeOffline && cl.Closed()) {
+			continue
+		}
+		clients = append(clients, h.describe(cl))
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// handleClient returns or disconnects the client named in the path.
+func (h *clientsHandler) handleClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+	if id == "" {
+		http.Error(w, "Bad request: client ID missing", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete && !h.admin.authorize(w, r) {
+		return
+	}
+
+	cl, ok := h.server.Clients.Get(id)
+	if !ok || cl.Net.Inline {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.describe(cl))
+	case http.MethodDelete:
+		if cl.Closed() {
+			http.Error(w, "Client is not connected", http.StatusConflict)
+			return
+		}
+		if err := h.disconnect(cl); err != nil {
+			h.server.Log.Warn("failed to send disconnect to client", "client", id, "error", err)
+		}
+		h.server.Log.Info("client disconnected through the inspection API", "client", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// disconnect sends cl a DISCONNECT and closes its connection. Mochi returns
+// the reason code as the error for error codes such as administrative action,
+// so only another error means the disconnect could not be sent.
+func (h *clientsHandler) disconnect(cl *mqtt.Client) error {
+	err := h.server.DisconnectClient(cl, packets.ErrAdministrativeAction)
+	if errors.Is(err, packets.ErrAdministrativeAction) {
+		return nil
+	}
+	return err
+}
+
+// describe builds the JSON view of a client.
+func (h *clientsHandler) describe(cl *mqtt.Client) clientInfo {
+	info := clientInfo{
+		ID:              cl.ID,
+		Username:        string(cl.Properties.Username),
+		RemoteAddr:      cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		CleanSession:    cl.Properties.Clean,
+		Connected:       !cl.Closed(),
+		Subscriptions:   make([]subscriptionInfo, 0),
+		InflightCount:   cl.State.Inflight.Len(),
+	}
+
+	if connectedAt, ok := h.tracker.connectedAt(cl); ok {
+		info.ConnectedAt = &connectedAt
+	}
+
+	for filter, sub := range cl.State.Subscriptions.GetAll() {
+		info.Subscriptions = append(info.Subscriptions, subscriptionInfo{Filter: filter, Qos: sub.Qos})
+	}
+	sort.Slice(info.Subscriptions, func(i, j int) bool {
+		return info.Subscriptions[i].Filter < info.Subscriptions[j].Filter
+	})
+	return info
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
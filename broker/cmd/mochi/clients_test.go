@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientsAPIListsDescribesAndDisconnects connects a client over TCP, then
+// inspects and disconnects it through the HTTP API.
+func TestClientsAPIListsDescribesAndDisconnects(t *testing.T) {
+	// --- Arrange ---
+	port := freePort(t)
+	server := mqtt.New(nil)
+	tracker := newSessionTrackerHook()
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddHook(tracker, nil))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	mux := http.NewServeMux()
+	newClientsHandler(server, tracker, newAdminAuth("s3cret")).register(mux)
+	api := httptest.NewServer(mux)
+	t.Cleanup(api.Close)
+
+	conn := dialBroker(t, port)
+	connack := sendConnect(t, conn, "garden-monitor-001", "device-user", "device-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+	sendSubscribe(t, conn, 1, "commands/garden-monitor-001")
+
+	// --- Act ---
+	listResp, err := http.Get(api.URL + "/clients")
+	require.NoError(t, err)
+	defer listResp.Body.Close()
+	var clients []clientInfo
+	require.NoError(t, json.NewDecoder(listResp.Body).Decode(&clients))
+
+	detailResp, err := http.Get(api.URL + "/clients/garden-monitor-001")
+	require.NoError(t, err)
+	defer detailResp.Body.Close()
+	var detail clientInfo
+	require.NoError(t, json.NewDecoder(detailResp.Body).Decode(&detail))
+
+	req, err := http.NewRequest(http.MethodDelete, api.URL+"/clients/garden-monitor-001", nil)
+	require.NoError(t, err)
+	unauthorizedResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	unauthorizedResp.Body.Close()
+	req.Header.Set("Authorization", "Bearer s3cret")
+	deleteResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	deleteResp.Body.Close()
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusOK, listResp.StatusCode)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "garden-monitor-001", clients[0].ID)
+
+	assert.Equal(t, http.StatusOK, detailResp.StatusCode)
+	assert.Equal(t, "device-user", detail.Username)
+	assert.Equal(t, "tcp-test", detail.Listener)
+	assert.Equal(t, conn.LocalAddr().String(), detail.RemoteAddr)
+	assert.True(t, detail.Connected)
+	require.NotNil(t, detail.ConnectedAt)
+	assert.WithinDuration(t, time.Now(), *detail.ConnectedAt, time.Minute)
+	assert.Equal(t, []subscriptionInfo{{Filter: "commands/garden-monitor-001", Qos: 0}}, detail.Subscriptions)
+	assert.Equal(t, 0, detail.InflightCount)
+
+	assert.Equal(t, http.StatusUnauthorized, unauthorizedResp.StatusCode, "disconnecting needs the admin token")
+	assert.Equal(t, http.StatusNoContent, deleteResp.StatusCode)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "the broker should close the connection")
+}
+
+// TestClientsAPIUnknownClient verifies missing clients return 404.
+func TestClientsAPIUnknownClient(t *testing.T) {
+	// --- Arrange ---
+	mux := http.NewServeMux()
+	newClientsHandler(mqtt.New(nil), newSessionTrackerHook(), newAdminAuth("")).register(mux)
+	rec := httptest.NewRecorder()
+
+	// --- Act ---
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/clients/nobody", nil))
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// TestClientsAPIDisconnectSucceeds verifies the administrative action reason
+// code Mochi returns from a disconnect is not taken for a failure.
+func TestClientsAPIDisconnectSucceeds(t *testing.T) {
+	// --- Arrange ---
+	server := mqtt.New(nil)
+	handler := newClientsHandler(server, newSessionTrackerHook(), newAdminAuth(""))
+	cl := server.NewClient(nil, "tcp-test", "garden-monitor-001", false)
+
+	// --- Act ---
+	err := handler.disconnect(cl)
+
+	// --- Assert ---
+	assert.NoError(t, err)
+	assert.True(t, cl.Closed())
+}
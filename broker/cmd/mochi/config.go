@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// User roles understood by defaultACLRules.
+const (
+	roleDevice  = "device"
+	roleService = "service"
+)
+
+// brokerConfig is the broker's file-based configuration, read from the YAML file
+// named by BROKER_CONFIG. Environment variables override the file, so the
+// original env-only deployments keep working without one.
+type brokerConfig struct {
+	LogLevel  string          `yaml:"log_level"`
+	HTTPPort  string          `yaml:"http_port"`
+	Listeners listenersConfig `yaml:"listeners"`
+	Users     []userConfig    `yaml:"users"`
+	ACL       []aclRule       `yaml:"acl"`
+	Limits    limitsConfig    `yaml:"limits"`
+	Storage   storageConfig   `yaml:"storage"`
+	Bridge    bridgeConfig    `yaml:"bridge"`
+	RateLimit rateLimitConfig `yaml:"rate_limits"`
+	Recording recordingConfig `yaml:"recording"`
+	Admin     adminConfig     `yaml:"admin"`
+}
+
+// listenersConfig describes the plain TCP listener and the optional TLS listener.
+type listenersConfig struct {
+	TCPPort string      `yaml:"tcp_port"`
+	TLS     tlsSettings `yaml:"tls"`
+}
+
+// userConfig is a single set of broker credentials. PasswordFile is re-read on
+// every reload, which is how a password is rotated without a restart, and it
+// takes precedence over CLIENT_PASS/SERVICE_PASS for the same user.
+type userConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	Role         string `yaml:"role"`
+}
+
+// limitsConfig overrides the server's default capabilities. Zero values keep the default.
+type limitsConfig struct {
+	MaximumClients               int64  `yaml:"maximum_clients"`
+	MaximumInflight              uint16 `yaml:"maximum_inflight"`
+	MaximumPacketSize            uint32 `yaml:"maximum_packet_size"`
+	MaximumMessageExpiryInterval int64  `yaml:"maximum_message_expiry_interval"`
+	MaximumSessionExpiryInterval uint32 `yaml:"maximum_session_expiry_interval"`
+	ReceiveMaximum               uint16 `yaml:"receive_maximum"`
+}
+
+// loadBrokerConfig reads the config file at path (if any), applies environment
+// overrides and validates the result.
+func loadBrokerConfig(path string) (*brokerConfig, error) {
+	cfg := &brokerConfig{
+		HTTPPort:  "8080",
+		Listeners: listenersConfig{TCPPort: "1883", TLS: tlsSettings{Port: "8883"}},
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read broker config: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse broker config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// applyEnv overrides the file configuration with any environment variables that are set.
+func (c *brokerConfig) applyEnv() error {
+	setFromEnv(&c.LogLevel, "LOG_LEVEL")
+	setFromEnv(&c.HTTPPort, "PORT")
+	setFromEnv(&c.Listeners.TCPPort, "MQTT_PORT")
+	setFromEnv(&c.Listeners.TLS.Port, "TLS_PORT")
+	setFromEnv(&c.Listeners.TLS.CertFile, "TLS_CERT_FILE")
+	setFromEnv(&c.Listeners.TLS.KeyFile, "TLS_KEY_FILE")
+	setFromEnv(&c.Listeners.TLS.ClientCAFile, "TLS_CLIENT_CA_FILE")
+	if require, err := strconv.ParseBool(os.Getenv("TLS_REQUIRE_CLIENT_CERT")); err == nil {
+		c.Listeners.TLS.RequireClientCert = require
+	}
+	setFromEnv(&c.Storage.Type, "STORAGE_TYPE")
+	setFromEnv(&c.Storage.Path, "STORAGE_PATH")
+	setFromEnv(&c.Bridge.ProjectID, "GCP_PROJECT_ID")
+	setFromEnv(&c.Bridge.TopicID, "PUBSUB_BRIDGE_TOPIC_ID")
+	setFromEnv(&c.Recording.Dir, "RECORDING_DIR")
+	setFromEnv(&c.Admin.Token, "ADMIN_TOKEN")
+	setFromEnv(&c.Admin.TokenFile, "ADMIN_TOKEN_FILE")
+	if tap, err := strconv.ParseBool(os.Getenv("TAP_ENABLED")); err == nil {
+		c.Admin.Tap = tap
+	}
+
+	c.upsertUser(os.Getenv("CLIENT_USER"), os.Getenv("CLIENT_PASS"), os.Getenv("CLIENT_PASS_FILE"), roleDevice)
+	c.upsertUser(os.Getenv("SERVICE_USER"), os.Getenv("SERVICE_PASS"), os.Getenv("SERVICE_PASS_FILE"), roleService)
+
+	if aclPath := os.Getenv("MQTT_ACL_FILE"); aclPath != "" {
+		rules, err := loadACLRules(aclPath)
+		if err != nil {
+			return err
+		}
+		c.ACL = rules
+	}
+	return nil
+}
+
+// upsertUser adds a user from the environment, or overrides the password of a
+// user with the same name from the file. A password_file in the config file
+// wins over the environment, so rotating that file takes effect on SIGHUP.
+func (c *brokerConfig) upsertUser(username, password, passwordFile, role string) {
+	if username == "" {
+		return
+	}
+
+	for i := range c.Users {
+		if c.Users[i].Username != username {
+			continue
+		}
+		switch {
+		case password == "" && passwordFile == "":
+		case c.Users[i].PasswordFile != "":
+			log.Printf("Ignoring the environment password for user %s: its password_file %s takes precedence", username, c.Users[i].PasswordFile)
+		default:
+			c.Users[i].Password = password
+			c.Users[i].PasswordFile = passwordFile
+		}
+		if c.Users[i].Role == "" {
+			c.Users[i].Role = role
+		}
+		return
+	}
+
+	c.Users = append(c.Users, userConfig{Username: username, Password: password, PasswordFile: passwordFile, Role: role})
+}
+
+// validate checks that the broker has credentials it can actually use.
+func (c *brokerConfig) validate() error {
+	if err := c.Storage.validate(); err != nil {
+		return err
+	}
+	if err := c.Bridge.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := c.Recording.validate(); err != nil {
+		return err
+	}
+	if err := c.Admin.validate(); err != nil {
+		return err
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no users configured: set users in the config file or CLIENT_USER/SERVICE_USER")
+	}
+	for _, user := range c.Users {
+		if user.Username == "" {
+			return fmt.Errorf("a configured user has no username")
+		}
+		if user.Password == "" && user.PasswordFile == "" {
+			return fmt.Errorf("user %s has no password or password_file", user.Username)
+		}
+	}
+	return nil
+}
+
+// authRules builds the ledger's credential rules, reading password files as it goes.
+func (c *brokerConfig) authRules() (auth.AuthRules, error) {
+	rules := make(auth.AuthRules, 0, len(c.Users))
+	for _, user := range c.Users {
+		password := user.Password
+		if user.PasswordFile != "" {
+			data, err := os.ReadFile(user.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read password file for user %s: %w", user.Username, err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		rules = append(rules, auth.AuthRule{
+			Username: auth.RString(user.Username),
+			Password: auth.RString(password),
+			Allow:    true,
+		})
+	}
+	return rules, nil
+}
+
+// aclRules returns the configured ACL, or the default rules derived from user roles.
+func (c *brokerConfig) aclRules() []aclRule {
+	if len(c.ACL) > 0 {
+		return c.ACL
+	}
+	return defaultACLRules(c.Users)
+}
+
+// slogLevel maps the configured log level onto slog, defaulting to debug.
+func (c *brokerConfig) slogLevel() slog.Level {
+	switch strings.ToLower(c.LogLevel) {
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// capabilities returns the server's default capabilities with the configured limits applied.
+func (l limitsConfig) capabilities() *mqtt.Capabilities {
+	caps := mqtt.NewDefaultServerCapabilities()
+	if l.MaximumClients > 0 {
+		caps.MaximumClients = l.MaximumClients
+	}
+	if l.MaximumInflight > 0 {
+		caps.MaximumInflight = l.MaximumInflight
+	}
+	if l.MaximumPacketSize > 0 {
+		caps.MaximumPacketSize = l.MaximumPacketSize
+	}
+	if l.MaximumMessageExpiryInterval > 0 {
+		caps.MaximumMessageExpiryInterval = l.MaximumMessageExpiryInterval
+	}
+	if l.MaximumSessionExpiryInterval > 0 {
+		caps.MaximumSessionExpiryInterval = l.MaximumSessionExpiryInterval
+	}
+	if l.ReceiveMaximum > 0 {
+		caps.ReceiveMaximum = l.ReceiveMaximum
+	}
+	return caps
+}
+
+// setFromEnv overwrites *target with the named environment variable when it is set.
+func setFromEnv(target *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*target = v
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clearBrokerEnv unsets every environment variable loadBrokerConfig reads, so
+// tests only see what they set themselves.
+func clearBrokerEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{
+		"LOG_LEVEL", "PORT", "MQTT_PORT", "MQTT_ACL_FILE",
+		"TLS_PORT", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "TLS_REQUIRE_CLIENT_CERT",
+		"CLIENT_USER", "CLIENT_PASS", "CLIENT_PASS_FILE", "SERVICE_USER", "SERVICE_PASS", "SERVICE_PASS_FILE",
+		"STORAGE_TYPE", "STORAGE_PATH", "GCP_PROJECT_ID", "PUBSUB_BRIDGE_TOPIC_ID",
+		"RECORDING_DIR", "ADMIN_TOKEN", "ADMIN_TOKEN_FILE", "TAP_ENABLED",
+	} {
+		t.Setenv(key, "")
+	}
+}
+
+// TestLoadBrokerConfigAppliesEnvOverrides verifies the file is read and that
+// environment variables take precedence over it.
+func TestLoadBrokerConfigAppliesEnvOverrides(t *testing.T) {
+	// --- Arrange ---
+	clearBrokerEnv(t)
+	path := filepath.Join(t.TempDir(), "broker.yaml")
+	content := `
+log_level: info
+http_port: "9090"
+listeners:
+  tcp_port: "1884"
+users:
+  - username: sreceiver
+    password: from-file
+    role: service
+limits:
+  maximum_clients: 50
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("PORT", "8081")
+	t.Setenv("SERVICE_USER", "sreceiver")
+	t.Setenv("SERVICE_PASS", "from-env")
+	t.Setenv("CLIENT_USER", "device")
+	t.Setenv("CLIENT_PASS", "device-pass")
+
+	// --- Act ---
+	cfg, err := loadBrokerConfig(path)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, "8081", cfg.HTTPPort, "PORT should override http_port")
+	assert.Equal(t, "1884", cfg.Listeners.TCPPort)
+	assert.Equal(t, "8883", cfg.Listeners.TLS.Port, "TLS port should keep its default")
+	assert.False(t, cfg.Listeners.TLS.enabled())
+	assert.Equal(t, int64(50), cfg.Limits.capabilities().MaximumClients)
+	require.Len(t, cfg.Users, 2)
+	assert.Equal(t, userConfig{Username: "sreceiver", Password: "from-env", Role: roleService}, cfg.Users[0])
+	assert.Equal(t, userConfig{Username: "device", Password: "device-pass", Role: roleDevice}, cfg.Users[1])
+}
+
+// TestLoadBrokerConfigPasswordFileWinsOverEnv verifies an environment password
+// does not hide a password_file from the config file, so a rotated file is
+// still picked up on reload.
+func TestLoadBrokerConfigPasswordFileWinsOverEnv(t *testing.T) {
+	// --- Arrange ---
+	clearBrokerEnv(t)
+	path := filepath.Join(t.TempDir(), "broker.yaml")
+	content := `
+users:
+  - username: sreceiver
+    password_file: /etc/mochi/secrets/service-pass
+    role: service
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("SERVICE_USER", "sreceiver")
+	t.Setenv("SERVICE_PASS", "from-env")
+
+	// --- Act ---
+	cfg, err := loadBrokerConfig(path)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	require.Len(t, cfg.Users, 1)
+	assert.Equal(t, userConfig{Username: "sreceiver", PasswordFile: "/etc/mochi/secrets/service-pass", Role: roleService}, cfg.Users[0])
+}
+
+// TestLoadBrokerConfigRequiresUsers verifies a broker without credentials is rejected.
+func TestLoadBrokerConfigRequiresUsers(t *testing.T) {
+	clearBrokerEnv(t)
+
+	_, err := loadBrokerConfig("")
+
+	assert.Error(t, err)
+}
+
+// TestLedgerUpdateRotatesPasswordWithoutDisconnecting simulates a SIGHUP after
+// the service password file has been rotated.
+func TestLedgerUpdateRotatesPasswordWithoutDisconnecting(t *testing.T) {
+	// --- Arrange ---
+	clearBrokerEnv(t)
+	passwordFile := filepath.Join(t.TempDir(), "service-pass")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("old-pass\n"), 0o600))
+	cfg := &brokerConfig{Users: []userConfig{{Username: "sreceiver", PasswordFile: passwordFile, Role: roleService}}}
+
+	authRules, err := cfg.authRules()
+	require.NoError(t, err)
+	port := freePort(t)
+	server := mqtt.New(nil)
+	ledger, err := addLedgerHooks(server, authRules, cfg.aclRules())
+	require.NoError(t, err)
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	existing := dialBroker(t, port)
+	connack := sendConnect(t, existing, "existing-service", "sreceiver", "old-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	require.NoError(t, os.WriteFile(passwordFile, []byte("new-pass\n"), 0o600))
+	authRules, err = cfg.authRules()
+	require.NoError(t, err)
+	ledger.update(authRules, cfg.aclRules())
+
+	// --- Assert ---
+	oldPass := sendConnect(t, dialBroker(t, port), "old-pass-service", "sreceiver", "old-pass")
+	assert.NotEqual(t, packets.CodeSuccess.Code, oldPass[3], "the old password should be rejected after reload")
+
+	newPass := sendConnect(t, dialBroker(t, port), "new-pass-service", "sreceiver", "new-pass")
+	assert.Equal(t, packets.CodeSuccess.Code, newPass[3], "the new password should be accepted after reload")
+
+	cl, ok := server.Clients.Get("existing-service")
+	require.True(t, ok, "the existing session should survive the reload")
+	assert.False(t, cl.Closed(), "the existing connection should not be dropped")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificates holds the file paths of a throwaway CA, server and client certificate.
+type testCertificates struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+	CAPool         *x509.CertPool
+}
+
+// testUsers returns a device user and a service user with their roles.
+func testUsers() []userConfig {
+	return []userConfig{
+		{Username: "device-user", Password: "device-pass", Role: roleDevice},
+		{Username: "service-user", Password: "service-pass", Role: roleService},
+	}
+}
+
+// dialBroker opens a plain TCP connection to the test broker.
+func dialBroker(t *testing.T, port string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// sendConnect writes a CONNECT packet and returns the 4 byte CONNACK.
+func sendConnect(t *testing.T, conn net.Conn, clientID, username, password string) []byte {
+	t.Helper()
+	_, err := conn.Write(connectPacket(t, clientID, username, password))
+	require.NoError(t, err)
+
+	connack := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, connack)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Connack<<4), connack[0], "expected a CONNACK packet")
+	return connack
+}
+
+// connectPacket encodes a minimal MQTT 3.1.1 CONNECT packet. Credentials are
+// only included when a username is given.
+func connectPacket(t *testing.T, clientID, username, password string) []byte {
+	t.Helper()
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: clientID,
+		},
+	}
+	if username != "" {
+		pk.Connect.UsernameFlag = true
+		pk.Connect.Username = []byte(username)
+		pk.Connect.PasswordFlag = true
+		pk.Connect.Password = []byte(password)
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnectEncode(buf))
+	return buf.Bytes()
+}
+
+// sendSubscribe subscribes to a single filter and returns the SUBACK reason code.
+func sendSubscribe(t *testing.T, conn net.Conn, packetID uint16, filter string) byte {
+	t.Helper()
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		ProtocolVersion: 4,
+		PacketID:        packetID,
+		Filters:         packets.Subscriptions{{Filter: filter}},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.SubscribeEncode(buf))
+	_, err := conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	suback := make([]byte, 5)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, suback)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Suback<<4), suback[0], "expected a SUBACK packet")
+	return suback[4]
+}
+
+// sendPublish writes a QoS 0 PUBLISH packet.
+func sendPublish(t *testing.T, conn net.Conn, topic string, payload []byte) {
+	t.Helper()
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish},
+		ProtocolVersion: 4,
+		TopicName:       topic,
+		Payload:         payload,
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.PublishEncode(buf))
+	_, err := conn.Write(buf.Bytes())
+	require.NoError(t, err)
+}
+
+// freePort asks the OS for an unused TCP port.
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	return port
+}
+
+// writeTestCertificates generates a CA, a server certificate for 127.0.0.1 and
+// a client certificate with the given CN, and writes them as PEM files.
+func writeTestCertificates(t *testing.T, clientCN string) testCertificates {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, ips []net.IP) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return der, key
+	}
+	serverDER, serverKey := issue(2, "localhost", x509.ExtKeyUsageServerAuth, []net.IP{net.ParseIP("127.0.0.1")})
+	clientDER, clientKey := issue(3, clientCN, x509.ExtKeyUsageClientAuth, nil)
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+		return path
+	}
+	writeKey := func(name string, key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return writePEM(name, "EC PRIVATE KEY", der)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return testCertificates{
+		CAFile:         writePEM("ca.pem", "CERTIFICATE", caDER),
+		ServerCertFile: writePEM("server.pem", "CERTIFICATE", serverDER),
+		ServerKeyFile:  writeKey("server-key.pem", serverKey),
+		ClientCertFile: writePEM("client.pem", "CERTIFICATE", clientDER),
+		ClientKeyFile:  writeKey("client-key.pem", clientKey),
+		CAPool:         pool,
+	}
+}
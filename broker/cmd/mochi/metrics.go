@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// metricsHandler serves the broker's Info counters and per-listener connection
+// counts in the Prometheus text exposition format.
+type metricsHandler struct {
+	server      *mqtt.Server
+	listenerIDs []string
+	sources     []metricsSource
+}
+
+// metricsSource is a hook that exports its own metrics alongside the server's.
+type metricsSource interface {
+	writeMetrics(w io.Writer)
+}
+
+// newMetricsHandler creates the /metrics handler. The listener IDs are always
+// reported, so a listener with no connections shows up as zero rather than missing.
+func newMetricsHandler(server *mqtt.Server, listenerIDs ...string) *metricsHandler {
+	return &metricsHandler{server: server, listenerIDs: listenerIDs}
+}
+
+// addSource appends a source's metrics to every scrape.
+func (h *metricsHandler) addSource(source metricsSource) {
+	h.sources = append(h.sources, source)
+}
+
+// ServeHTTP writes a snapshot of the broker metrics.
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.write(w)
+}
+
+// write renders the metrics. Info.Clone loads each counter atomically.
+func (h *metricsHandler) write(w io.Writer) {
+	info := h.server.Info.Clone()
+
+	writeMetric(w, "mochi_uptime_seconds", "Seconds since the broker started.", "gauge", info.Uptime)
+	writeMetric(w, "mochi_clients_connected", "Clients currently connected.", "gauge", info.ClientsConnected)
+	writeMetric(w, "mochi_clients_disconnected", "Persistent clients disconnected but not expired.", "gauge", info.ClientsDisconnected)
+	writeMetric(w, "mochi_clients_maximum", "Maximum number of clients connected at once.", "gauge", info.ClientsMaximum)
+	writeMetric(w, "mochi_clients_total", "Clients known to the broker, connected or not.", "gauge", info.ClientsTotal)
+	writeMetric(w, "mochi_messages_received_total", "PUBLISH packets received.", "counter", info.MessagesReceived)
+	writeMetric(w, "mochi_messages_sent_total", "PUBLISH packets sent.", "counter", info.MessagesSent)
+	writeMetric(w, "mochi_messages_dropped_total", "PUBLISH packets dropped, for example to slow subscribers.", "counter", info.MessagesDropped)
+	writeMetric(w, "mochi_packets_received_total", "Packets of any type received.", "counter", info.PacketsReceived)
+	writeMetric(w, "mochi_packets_sent_total", "Packets of any type sent.", "counter", info.PacketsSent)
+	writeMetric(w, "mochi_bytes_received_total", "Bytes received from clients.", "counter", info.BytesReceived)
+	writeMetric(w, "mochi_bytes_sent_total", "Bytes sent to clients.", "counter", info.BytesSent)
+	writeMetric(w, "mochi_retained_messages", "Retained messages held by the broker.", "gauge", info.Retained)
+	writeMetric(w, "mochi_inflight_messages", "QoS 1 and 2 messages awaiting acknowledgement.", "gauge", info.Inflight)
+	writeMetric(w, "mochi_inflight_dropped_total", "Inflight messages dropped after expiry.", "counter", info.InflightDropped)
+	writeMetric(w, "mochi_subscriptions", "Active subscriptions.", "gauge", info.Subscriptions)
+
+	fmt.Fprintln(w, "# HELP mochi_listener_connections Clients currently connected, by listener.")
+	fmt.Fprintln(w, "# TYPE mochi_listener_connections gauge")
+	counts := h.listenerConnections()
+	ids := make([]string, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(w, "mochi_listener_connections{listener=%q} %d\n", id, counts[id])
+	}
+
+	for _, source := range h.sources {
+		source.writeMetrics(w)
+	}
+}
+
+// listenerConnections counts the open network connections on each listener.
+// The inline client has no listener and is not counted.
+func (h *metricsHandler) listenerConnections() map[string]int64 {
+	counts := make(map[string]int64, len(h.listenerIDs))
+	for _, id := range h.listenerIDs {
+		counts[id] = 0
+	}
+
+	for _, cl := range h.server.Clients.GetAll() {
+		if cl.Net.Inline || cl.Net.Listener == "" || cl.Closed() {
+			continue
+		}
+		counts[cl.Net.Listener]++
+	}
+	return counts
+}
+
+// writeMetric writes a single unlabelled sample with its HELP and TYPE lines.
+func writeMetric(w io.Writer, name, help, metricType string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetricsReportsInfoAndListenerConnections connects a client over TCP and
+// checks the counters and per-listener connection count on /metrics.
+func TestMetricsReportsInfoAndListenerConnections(t *testing.T) {
+	// --- Arrange ---
+	port := freePort(t)
+	server := mqtt.New(nil)
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	conn := dialBroker(t, port)
+	connack := sendConnect(t, conn, "metrics-test", "", "")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+	sendPublish(t, conn, "devices/metrics-test/data", []byte(`{"ok":true}`))
+
+	handler := newMetricsHandler(server, "tcp-test", "tls-test")
+
+	require.Eventually(t, func() bool {
+		return server.Info.Clone().MessagesReceived == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// --- Act ---
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	// --- Assert ---
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, body, "# TYPE mochi_clients_connected gauge\nmochi_clients_connected 1\n")
+	assert.Contains(t, body, "mochi_messages_received_total 1\n")
+	assert.Contains(t, body, `mochi_listener_connections{listener="tcp-test"} 1`)
+	assert.Contains(t, body, `mochi_listener_connections{listener="tls-test"} 0`)
+}
+
+// TestMetricsRejectsNonGet verifies only GET is served.
+func TestMetricsRejectsNonGet(t *testing.T) {
+	// --- Arrange ---
+	handler := newMetricsHandler(mqtt.New(nil))
+	rec := httptest.NewRecorder()
+
+	// --- Act ---
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
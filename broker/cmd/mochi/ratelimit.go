@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Actions taken when a client exceeds a message rate or payload limit.
+const (
+	limitActionDrop       = "drop"
+	limitActionDisconnect = "disconnect"
+)
+
+// Violation kinds, used as the kind label on /metrics.
+const (
+	violationClientRate      = "client_rate"
+	violationUsernameRate    = "username_rate"
+	violationPayloadSize     = "payload_size"
+	violationConnectionLimit = "connections"
+)
+
+// sweepInterval is how often username buckets that have refilled and
+// connection reservations of clients that never got a session are dropped, so
+// neither piles up.
+const sweepInterval = time.Minute
+
+// rateLimitConfig configures the per-client and per-username traffic limits.
+// Zero values disable the corresponding limit. Rates are messages per second;
+// a burst of zero defaults to one second's worth of messages.
+type rateLimitConfig struct {
+	ClientRate                float64 `yaml:"client_rate"`
+	ClientBurst               int     `yaml:"client_burst"`
+	UsernameRate              float64 `yaml:"username_rate"`
+	UsernameBurst             int     `yaml:"username_burst"`
+	MaxPayloadBytes           int     `yaml:"max_payload_bytes"`
+	MaxConnectionsPerUsername int     `yaml:"max_connections_per_username"`
+	Action                    string  `yaml:"action"`
+}
+
+// enabled reports whether any limit is configured.
+func (c rateLimitConfig) enabled() bool {
+	return c.ClientRate > 0 || c.UsernameRate > 0 || c.MaxPayloadBytes > 0 || c.MaxConnectionsPerUsername > 0
+}
+
+// validate checks the configured action is known.
+func (c rateLimitConfig) validate() error {
+	switch c.Action {
+	case "", limitActionDrop, limitActionDisconnect:
+		return nil
+	default:
+		return fmt.Errorf("unsupported rate limit action %q (supported: %s, %s)", c.Action, limitActionDrop, limitActionDisconnect)
+	}
+}
+
+// rateLimitOptions contains the configuration for the rate limit hook.
+type rateLimitOptions struct {
+	Server *mqtt.Server
+	Limits rateLimitConfig
+}
+
+// rateLimitHook enforces message rates, payload sizes and connection counts.
+// Offending publishes are dropped, or the client is disconnected when the
+// action is "disconnect". Connections over the per-username limit are refused.
+// Publishes from the inline client are never limited.
+type rateLimitHook struct {
+	mqtt.HookBase
+	server *mqtt.Server
+	limits rateLimitConfig
+
+	// Client buckets and sessions are keyed by client instance, so a session
+	// takeover leaves the new client's state alone when the old one goes.
+	// pending holds clients counted in sessions by OnConnect whose session is
+	// not established yet, with their username.
+	mu              sync.Mutex
+	clientBuckets   map[*mqtt.Client]*tokenBucket
+	usernameBuckets map[string]*tokenBucket
+	sessions        map[string]map[*mqtt.Client]struct{}
+	pending         map[*mqtt.Client]string
+	lastSweep       time.Time
+
+	violations sync.Map // violation kind -> *atomic.Int64
+}
+
+// ID returns the ID of the hook.
+func (h *rateLimitHook) ID() string {
+	return "rate-limit"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *rateLimitHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// Init validates the options.
+func (h *rateLimitHook) Init(config any) error {
+	if _, ok := config.(*rateLimitOptions); !ok || config == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+	opts := config.(*rateLimitOptions)
+	if err := opts.Limits.validate(); err != nil {
+		return err
+	}
+
+	h.server = opts.Server
+	h.limits = opts.Limits
+	if h.limits.Action == "" {
+		h.limits.Action = limitActionDrop
+	}
+	h.clientBuckets = make(map[*mqtt.Client]*tokenBucket)
+	h.usernameBuckets = make(map[string]*tokenBucket)
+	h.sessions = make(map[string]map[*mqtt.Client]struct{})
+	h.pending = make(map[*mqtt.Client]string)
+	return nil
+}
+
+// OnConnect refuses a connection with a CONNACK when its username already has
+// the maximum number of live sessions, and otherwise counts it straight away,
+// so concurrent connects cannot all pass the check. A reconnect taking over a
+// session with the same client ID does not count against the limit.
+func (h *rateLimitHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if h.limits.MaxConnectionsPerUsername <= 0 {
+		return nil
+	}
+
+	username := string(pk.Connect.Username)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sweep(time.Now())
+
+	live := 0
+	for existing := range h.sessions[username] {
+		if existing.ID != cl.ID && !existing.Closed() {
+			live++
+		}
+	}
+	if live >= h.limits.MaxConnectionsPerUsername {
+		h.violation(violationConnectionLimit)
+		h.Log.Warn("connection limit reached for username, refusing client", "username", username, "client", cl.ID)
+		// The server closes the connection without a CONNACK when OnConnect
+		// fails, so send one to tell the client why. MQTT 3 has no quota code.
+		reason := packets.ErrQuotaExceeded
+		if cl.Properties.ProtocolVersion < 5 {
+			reason = packets.ErrServerUnavailable
+		}
+		_ = h.server.SendConnack(cl, reason, false, nil)
+		return reason
+	}
+
+	// Authentication may still refuse the client, in which case OnDisconnect
+	// is never called; sweep drops the reservation once the client is closed.
+	h.addSession(username, cl)
+	h.pending[cl] = username
+	return nil
+}
+
+// OnSessionEstablished registers the client against its username.
+func (h *rateLimitHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addSession(string(cl.Properties.Username), cl)
+	delete(h.pending, cl)
+}
+
+// OnDisconnect forgets the client's session and rate bucket.
+func (h *rateLimitHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeSession(string(cl.Properties.Username), cl)
+	delete(h.pending, cl)
+	delete(h.clientBuckets, cl)
+}
+
+// addSession counts cl against username. The caller must hold h.mu.
+func (h *rateLimitHook) addSession(username string, cl *mqtt.Client) {
+	if h.sessions[username] == nil {
+		h.sessions[username] = make(map[*mqtt.Client]struct{})
+	}
+	h.sessions[username][cl] = struct{}{}
+}
+
+// removeSession stops counting cl against username. The caller must hold h.mu.
+func (h *rateLimitHook) removeSession(username string, cl *mqtt.Client) {
+	delete(h.sessions[username], cl)
+	if len(h.sessions[username]) == 0 {
+		delete(h.sessions, username)
+	}
+}
+
+// OnPublish checks the payload size and the client and username rates.
+func (h *rateLimitHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	if kind := h.check(cl, pk); kind != "" {
+		h.violation(kind)
+		h.Log.Warn("client exceeded a limit", "client", cl.ID, "topic", pk.TopicName, "limit", kind, "action", h.limits.Action)
+		if h.limits.Action == limitActionDisconnect && h.server != nil {
+			_ = h.server.DisconnectClient(cl, packets.ErrQuotaExceeded)
+		}
+		return pk, packets.ErrRejectPacket
+	}
+	return pk, nil
+}
+
+// check returns the kind of limit the publish violates, or "" if it is allowed.
+func (h *rateLimitHook) check(cl *mqtt.Client, pk packets.Packet) string {
+	if h.limits.MaxPayloadBytes > 0 && len(pk.Payload) > h.limits.MaxPayloadBytes {
+		return violationPayloadSize
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sweep(now)
+
+	if h.limits.ClientRate > 0 {
+		bucket := bucketFor(h.clientBuckets, cl, h.limits.ClientRate, h.limits.ClientBurst, now)
+		if !bucket.take(now) {
+			return violationClientRate
+		}
+	}
+	if h.limits.UsernameRate > 0 {
+		bucket := bucketFor(h.usernameBuckets, string(cl.Properties.Username), h.limits.UsernameRate, h.limits.UsernameBurst, now)
+		if !bucket.take(now) {
+			return violationUsernameRate
+		}
+	}
+	return ""
+}
+
+// bucketFor returns the token bucket for key, creating a full one if needed.
+// The caller must hold h.mu.
+func bucketFor[K comparable](buckets map[K]*tokenBucket, key K, rate float64, burst int, now time.Time) *tokenBucket {
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = newTokenBucket(rate, burst, now)
+		buckets[key] = bucket
+	}
+	return bucket
+}
+
+// sweep drops the username buckets that have refilled and the reservations of
+// clients closed before their session was established, at most once per
+// sweepInterval. A full bucket is the same as a new one, so no username gains
+// anything from it. The caller must hold h.mu.
+func (h *rateLimitHook) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < sweepInterval {
+		return
+	}
+	h.lastSweep = now
+	for username, bucket := range h.usernameBuckets {
+		if bucket.full(now) {
+			delete(h.usernameBuckets, username)
+		}
+	}
+	for cl, username := range h.pending {
+		if cl.Closed() {
+			h.removeSession(username, cl)
+			delete(h.pending, cl)
+		}
+	}
+}
+
+// violation increments the counter for a violation kind.
+func (h *rateLimitHook) violation(kind string) {
+	counter, _ := h.violations.LoadOrStore(kind, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(1)
+}
+
+// violationCounts returns a snapshot of the violation counters.
+func (h *rateLimitHook) violationCounts() map[string]int64 {
+	counts := map[string]int64{
+		violationClientRate:      0,
+		violationUsernameRate:    0,
+		violationPayloadSize:     0,
+		violationConnectionLimit: 0,
+	}
+	h.violations.Range(func(key, value any) bool {
+		counts[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// writeMetrics adds the violation counters to /metrics.
+func (h *rateLimitHook) writeMetrics(w io.Writer) {
+	counts := h.violationCounts()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	_, _ = fmt.Fprintln(w, "# HELP mochi_limit_violations_total Publishes and connections refused by the rate limit hook, by limit.")
+	_, _ = fmt.Fprintln(w, "# TYPE mochi_limit_violations_total counter")
+	for _, kind := range kinds {
+		_, _ = fmt.Fprintf(w, "mochi_limit_violations_total{kind=%q} %d\n", kind, counts[kind])
+	}
+}
+
+// tokenBucket is a simple token bucket refilled at rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	burst  float64
+	rate   float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket. A burst of zero allows one second's
+// worth of messages, and never less than one.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{tokens: b, burst: b, rate: rate, last: now}
+}
+
+// full reports whether the bucket will have refilled to its burst by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// take refills the bucket for the time elapsed and takes a token if one is available.
+func (b *tokenBucket) take(now time.Time) bool {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// addRateLimitHook adds the rate limit hook and returns it so its counters can be exported.
+func addRateLimitHook(server *mqtt.Server, limits rateLimitConfig) *rateLimitHook {
+	log.Printf("MQTT Broker will enforce limits: client rate %.1f/s, username rate %.1f/s, payload %d bytes, %d connections per username (action: %s)",
+		limits.ClientRate, limits.UsernameRate, limits.MaxPayloadBytes, limits.MaxConnectionsPerUsername, limits.Action)
+
+	hook := new(rateLimitHook)
+	if err := server.AddHook(hook, &rateLimitOptions{Server: server, Limits: limits}); err != nil {
+		log.Fatalf("Failed to add rate limit hook: %v", err)
+	}
+	return hook
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startRateLimitedServer starts a broker with the rate limit hook and an inline
+// subscription counting the device data that gets through.
+func startRateLimitedServer(t *testing.T, limits rateLimitConfig) (string, *rateLimitHook, *atomic.Int64) {
+	t.Helper()
+	port := freePort(t)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	hook := addRateLimitHook(server, limits)
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	received := new(atomic.Int64)
+	require.NoError(t, server.Subscribe("devices/+/data", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received.Add(1)
+	}))
+	return port, hook, received
+}
+
+// TestRateLimitDropsExcessAndOversizedPublishes verifies publishes over the
+// client rate or payload size are dropped and counted.
+func TestRateLimitDropsExcessAndOversizedPublishes(t *testing.T) {
+	// --- Arrange ---
+	port, hook, received := startRateLimitedServer(t, rateLimitConfig{ClientRate: 0.1, ClientBurst: 2, MaxPayloadBytes: 16})
+	conn := dialBroker(t, port)
+	connack := sendConnect(t, conn, "noisy-device", "device-user", "device-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	sendPublish(t, conn, "devices/noisy-device/data", []byte(`{"padding":"far too large"}`))
+	for i := 0; i < 5; i++ {
+		sendPublish(t, conn, "devices/noisy-device/data", []byte(`{"ok":true}`))
+	}
+
+	// --- Assert ---
+	require.Eventually(t, func() bool {
+		return hook.violationCounts()[violationClientRate] == 3
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, int64(2), received.Load(), "only the burst should be delivered")
+	assert.Equal(t, int64(1), hook.violationCounts()[violationPayloadSize])
+}
+
+// TestRateLimitDisconnectsOffendingClient verifies the disconnect action closes
+// the connection of a client over its rate.
+func TestRateLimitDisconnectsOffendingClient(t *testing.T) {
+	// --- Arrange ---
+	port, hook, _ := startRateLimitedServer(t, rateLimitConfig{ClientRate: 0.1, ClientBurst: 1, Action: limitActionDisconnect})
+	conn := dialBroker(t, port)
+	connack := sendConnect(t, conn, "noisy-device", "device-user", "device-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	sendPublish(t, conn, "devices/noisy-device/data", []byte(`1`))
+	sendPublish(t, conn, "devices/noisy-device/data", []byte(`2`))
+
+	// --- Assert ---
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := io.ReadAll(conn)
+	assert.NoError(t, err, "the broker should close the connection")
+	assert.Equal(t, int64(1), hook.violationCounts()[violationClientRate])
+}
+
+// TestRateLimitRefusesConnectionsOverUsernameLimit verifies a second connection
+// for the same username is refused while the first is live.
+func TestRateLimitRefusesConnectionsOverUsernameLimit(t *testing.T) {
+	// --- Arrange ---
+	port, hook, _ := startRateLimitedServer(t, rateLimitConfig{MaxConnectionsPerUsername: 1})
+	first := dialBroker(t, port)
+	connack := sendConnect(t, first, "device-1", "device-user", "device-pass")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	second := dialBroker(t, port)
+	_, err := second.Write(connectPacket(t, "device-2", "device-user", "device-pass"))
+	require.NoError(t, err)
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(5*time.Second)))
+	response, _ := io.ReadAll(second)
+
+	// --- Assert ---
+	require.Len(t, response, 4, "the second connection should get a CONNACK before being closed")
+	assert.Equal(t, byte(packets.Connack<<4), response[0])
+	assert.Equal(t, packets.Err3ServerUnavailable.Code, response[3], "the second connection should be refused")
+	assert.Equal(t, int64(1), hook.violationCounts()[violationConnectionLimit])
+}
+
+// TestTokenBucketRefills verifies the bucket allows a burst and then refills at its rate.
+func TestTokenBucketRefills(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(2, 2, start)
+
+	assert.True(t, bucket.take(start))
+	assert.True(t, bucket.take(start))
+	assert.False(t, bucket.take(start), "the burst is used up")
+	assert.True(t, bucket.take(start.Add(500*time.Millisecond)), "half a second refills one token at 2/s")
+	assert.False(t, bucket.take(start.Add(500*time.Millisecond)))
+}
+
+// TestRateLimitSweepsIdleState verifies username buckets that have refilled
+// and reservations of clients that never got a session are dropped, busy
+// buckets are kept, and sweeps are spaced out.
+func TestRateLimitSweepsIdleState(t *testing.T) {
+	// --- Arrange ---
+	hook := new(rateLimitHook)
+	require.NoError(t, hook.Init(&rateLimitOptions{Limits: rateLimitConfig{UsernameRate: 1, UsernameBurst: 2, MaxConnectionsPerUsername: 1}}))
+	start := time.Now()
+	hook.usernameBuckets["idle-user"] = newTokenBucket(1, 2, start)
+	busy := newTokenBucket(1, 2, start)
+	busy.take(start)
+	busy.take(start)
+	hook.usernameBuckets["busy-user"] = busy
+	// A client that failed authentication is closed without OnDisconnect.
+	refused := &mqtt.Client{ID: "refused-device"}
+	hook.addSession("device-user", refused)
+	hook.pending[refused] = "device-user"
+
+	// --- Act & Assert ---
+	hook.sweep(start.Add(time.Second))
+	assert.NotContains(t, hook.usernameBuckets, "idle-user")
+	assert.Contains(t, hook.usernameBuckets, "busy-user", "a bucket still refilling must be kept")
+	assert.Empty(t, hook.sessions)
+	assert.Empty(t, hook.pending)
+
+	hook.sweep(start.Add(5 * time.Second))
+	assert.Contains(t, hook.usernameBuckets, "busy-user", "sweeps should run at most once per interval")
+
+	hook.sweep(start.Add(time.Second + sweepInterval))
+	assert.Empty(t, hook.usernameBuckets)
+}
+
+// TestRateLimitCountsConnectionsFromOnConnect verifies a connection counts
+// against its username as soon as it passes the check, so a second connect
+// racing the first one's session setup is refused.
+func TestRateLimitCountsConnectionsFromOnConnect(t *testing.T) {
+	// --- Arrange ---
+	server := mqtt.New(nil)
+	hook := addRateLimitHook(server, rateLimitConfig{MaxConnectionsPerUsername: 1})
+	connect := packets.Packet{Connect: packets.ConnectParams{Username: []byte("device-user")}}
+	first := server.NewClient(nil, "tcp-test", "device-1", false)
+	second := server.NewClient(nil, "tcp-test", "device-2", false)
+
+	// --- Act ---
+	firstErr := hook.OnConnect(first, connect)
+	secondErr := hook.OnConnect(second, connect)
+
+	// --- Assert ---
+	assert.NoError(t, firstErr)
+	assert.ErrorIs(t, secondErr, packets.ErrServerUnavailable, "the first connection should count before its session is established")
+	assert.Equal(t, int64(1), hook.violationCounts()[violationConnectionLimit])
+}
+
+// TestRateLimitTakeoverKeepsNewClientBucket verifies the old client of a
+// session takeover disconnecting does not refill the bucket of the new client
+// using the same client ID.
+func TestRateLimitTakeoverKeepsNewClientBucket(t *testing.T) {
+	// --- Arrange ---
+	hook := new(rateLimitHook)
+	require.NoError(t, hook.Init(&rateLimitOptions{Limits: rateLimitConfig{ClientRate: 0.1, ClientBurst: 1}}))
+	previous := &mqtt.Client{ID: "device-1"}
+	current := &mqtt.Client{ID: "device-1"}
+	pk := packets.Packet{TopicName: "devices/device-1/data", Payload: []byte(`1`)}
+	require.Empty(t, hook.check(current, pk))
+
+	// --- Act ---
+	hook.OnDisconnect(previous, nil, false)
+
+	// --- Assert ---
+	assert.Equal(t, violationClientRate, hook.check(current, pk), "the new client's burst should still be used up")
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Recording file names: a completed file is renamed from the .part name it
+// is written under, so readers never pick up a half-written gzip stream.
+const (
+	recordingPrefix     = "traffic-"
+	recordingSuffix     = ".ndjson.gz"
+	recordingPartSuffix = ".part"
+	recordingTimeFormat = "20060102T150405.000000000Z"
+)
+
+// recordingConfig configures the optional traffic recorder. Recording is
+// enabled when a directory is set.
+type recordingConfig struct {
+	Dir       string        `yaml:"dir"`
+	Filters   []string      `yaml:"filters"`
+	MaxBytes  int64         `yaml:"max_bytes"`
+	MaxAge    time.Duration `yaml:"max_age"`
+	QueueSize int           `yaml:"queue_size"`
+}
+
+// enabled reports whether the recorder is configured.
+func (r recordingConfig) enabled() bool {
+	return r.Dir != ""
+}
+
+// validate checks the rotation limits.
+func (r recordingConfig) validate() error {
+	if r.MaxBytes < 0 || r.MaxAge < 0 {
+		return fmt.Errorf("recording max_bytes and max_age must not be negative")
+	}
+	return nil
+}
+
+// options converts the config into hook options, filling in defaults.
+func (r recordingConfig) options() *trafficRecorderOptions {
+	opts := &trafficRecorderOptions{
+		Dir:       r.Dir,
+		Filters:   r.Filters,
+		MaxBytes:  r.MaxBytes,
+		MaxAge:    r.MaxAge,
+		QueueSize: r.QueueSize,
+		Now:       time.Now,
+	}
+	if len(opts.Filters) == 0 {
+		opts.Filters = []string{"#"}
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 100 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = time.Hour
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	return opts
+}
+
+// recordedMessage is one line of a recording. The payload is base64 encoded,
+// the same encoding the load generator's replay messages use.
+type recordedMessage struct {
+	Topic      string    `json:"topic"`
+	Payload    []byte    `json:"payload"`
+	QoS        byte      `json:"qos"`
+	Retain     bool      `json:"retain"`
+	ClientID   string    `json:"client_id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// trafficRecorderOptions contains the configuration for the recorder hook.
+// MaxBytes counts uncompressed bytes.
+type trafficRecorderOptions struct {
+	Dir       string
+	Filters   []string
+	MaxBytes  int64
+	MaxAge    time.Duration
+	QueueSize int
+	Now       func() time.Time
+}
+
+// trafficRecorderHook writes publishes matching the configured filters to
+// gzipped NDJSON files, starting a new file when the current one reaches
+// MaxBytes or MaxAge. Like the bridge, it queues messages so a slow disk never
+// blocks the broker, dropping and counting them when the queue is full.
+type trafficRecorderHook struct {
+	mqtt.HookBase
+	config *trafficRecorderOptions
+	queue  chan recordedMessage
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+	writer *recordingWriter
+
+	recorded atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+// ID returns the ID of the hook.
+func (h *trafficRecorderHook) ID() string {
+	return "traffic-recorder"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *trafficRecorderHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init validates the options, creates the directory and starts the writer.
+func (h *trafficRecorderHook) Init(config any) error {
+	if _, ok := config.(*trafficRecorderOptions); !ok || config == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+	h.config = config.(*trafficRecorderOptions)
+	if h.config.Dir == "" {
+		return errors.New("traffic recorder needs a directory")
+	}
+	if h.config.Now == nil {
+		h.config.Now = time.Now
+	}
+	if err := os.MkdirAll(h.config.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	h.writer = &recordingWriter{dir: h.config.Dir, maxBytes: h.config.MaxBytes, maxAge: h.config.MaxAge}
+	h.queue = make(chan recordedMessage, h.config.QueueSize)
+	h.done = make(chan struct{})
+	go h.run()
+	return nil
+}
+
+// Stop writes anything still queued and closes the current file.
+func (h *trafficRecorderHook) Stop() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.queue)
+	h.mu.Unlock()
+
+	<-h.done
+	return h.writer.close()
+}
+
+// OnPublished queues a copy of any publish matching one of the filters.
+func (h *trafficRecorderHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if !h.matches(pk.TopicName) {
+		return
+	}
+
+	msg := recordedMessage{
+		Topic:      pk.TopicName,
+		Payload:    append([]byte(nil), pk.Payload...),
+		QoS:        pk.FixedHeader.Qos,
+		Retain:     pk.FixedHeader.Retain,
+		ReceivedAt: h.config.Now().UTC(),
+	}
+	if cl != nil {
+		msg.ClientID = cl.ID
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.queue <- msg:
+	default:
+		h.dropped.Add(1)
+		h.Log.Warn("traffic recorder queue full, dropping message", "topic", pk.TopicName)
+	}
+}
+
+// matches reports whether the topic matches any configured filter.
+func (h *trafficRecorderHook) matches(topic string) bool {
+	for _, filter := range h.config.Filters {
+		if _, ok := auth.MatchTopic(filter, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run writes queued messages, and closes a file that has reached its age
+// even when no more messages arrive for it.
+func (h *trafficRecorderHook) run() {
+	defer close(h.done)
+
+	tick := time.Second
+	if h.config.MaxAge < tick {
+		tick = h.config.MaxAge
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-h.queue:
+			if !ok {
+				return
+			}
+			if err := h.writer.write(msg, h.config.Now()); err != nil {
+				h.failed.Add(1)
+				h.Log.Error("traffic recorder failed to write message", "topic", msg.Topic, "error", err)
+				continue
+			}
+			h.recorded.Add(1)
+		case <-ticker.C:
+			if err := h.writer.tick(h.config.Now()); err != nil {
+				h.Log.Error("traffic recorder failed to rotate recording", "error", err)
+			}
+		}
+	}
+}
+
+// writeMetrics adds the recorder counters to /metrics.
+func (h *trafficRecorderHook) writeMetrics(w io.Writer) {
+	_, _ = fmt.Fprintln(w, "# HELP mochi_recorder_messages_total Publishes seen by the traffic recorder, by outcome.")
+	_, _ = fmt.Fprintln(w, "# TYPE mochi_recorder_messages_total counter")
+	_, _ = fmt.Fprintf(w, "mochi_recorder_messages_total{outcome=%q} %d\n", "dropped", h.dropped.Load())
+	_, _ = fmt.Fprintf(w, "mochi_recorder_messages_total{outcome=%q} %d\n", "failed", h.failed.Load())
+	_, _ = fmt.Fprintf(w, "mochi_recorder_messages_total{outcome=%q} %d\n", "recorded", h.recorded.Load())
+}
+
+// recordingWriter owns the current recording file. It is only used from the
+// recorder's run goroutine, and from Stop once that has finished.
+type recordingWriter struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	path    string
+	opened  time.Time
+	written int64
+}
+
+// write appends msg as one JSON line, rotating first if the file is full or old.
+func (w *recordingWriter) write(msg recordedMessage, now time.Time) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if w.file != nil && (w.written+int64(len(line)) > w.maxBytes || now.Sub(w.opened) >= w.maxAge) {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.open(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.buf.Write(line)
+	w.written += int64(n)
+	return err
+}
+
+// tick closes the file once it reaches its age, and otherwise flushes it so
+// a crash loses at most the last second of traffic.
+func (w *recordingWriter) tick(now time.Time) error {
+	if w.file == nil {
+		return nil
+	}
+	if now.Sub(w.opened) >= w.maxAge {
+		return w.close()
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.gz.Flush()
+}
+
+// open starts a new file named after now.
+func (w *recordingWriter) open(now time.Time) error {
+	w.path = filepath.Join(w.dir, recordingPrefix+now.UTC().Format(recordingTimeFormat)+recordingSuffix)
+	file, err := os.OpenFile(w.path+recordingPartSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create recording file: %w", err)
+	}
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.buf = bufio.NewWriter(w.gz)
+	w.opened = now
+	w.written = 0
+	return nil
+}
+
+// close finishes the current file, if any, and gives it its final name.
+func (w *recordingWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := errors.Join(w.buf.Flush(), w.gz.Close(), w.file.Close())
+	w.file, w.gz, w.buf = nil, nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to finish recording %s: %w", w.path, err)
+	}
+	if err := os.Rename(w.path+recordingPartSuffix, w.path); err != nil {
+		return fmt.Errorf("failed to finish recording %s: %w", w.path, err)
+	}
+	return nil
+}
+
+// addRecorderHook adds the traffic recorder and returns it so its counters can be exported.
+func addRecorderHook(server *mqtt.Server, settings recordingConfig) *trafficRecorderHook {
+	opts := settings.options()
+	log.Printf("MQTT Broker will record %v to %s (rotating at %d bytes or %s)", opts.Filters, opts.Dir, opts.MaxBytes, opts.MaxAge)
+
+	hook := new(trafficRecorderHook)
+	if err := server.AddHook(hook, opts); err != nil {
+		log.Fatalf("Failed to add traffic recorder hook: %v", err)
+	}
+	return hook
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a settable clock for the recorder.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestRecorderHook initialises a recorder writing to a temporary directory.
+func newTestRecorderHook(t *testing.T, settings recordingConfig, clock *fakeClock) *trafficRecorderHook {
+	t.Helper()
+	settings.Dir = t.TempDir()
+	opts := settings.options()
+	opts.Now = clock.Now
+
+	hook := new(trafficRecorderHook)
+	hook.SetOpts(slog.Default(), nil)
+	require.NoError(t, hook.Init(opts))
+	return hook
+}
+
+// readRecordings returns the completed recordings in dir, oldest first, and
+// the messages in each.
+func readRecordings(t *testing.T, dir string) ([]string, [][]recordedMessage) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, recordingPrefix+"*"+recordingSuffix))
+	require.NoError(t, err)
+	sort.Strings(paths)
+
+	var files [][]recordedMessage
+	for _, path := range paths {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		gz, err := gzip.NewReader(f)
+		require.NoError(t, err)
+
+		var messages []recordedMessage
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var msg recordedMessage
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+			messages = append(messages, msg)
+		}
+		require.NoError(t, scanner.Err())
+		require.NoError(t, f.Close())
+		files = append(files, messages)
+	}
+	return paths, files
+}
+
+// TestRecorderHookWritesMatchingPublishes verifies matching publishes are
+// written with their topic, payload, QoS, retain flag, client and time.
+func TestRecorderHookWritesMatchingPublishes(t *testing.T) {
+	// --- Arrange ---
+	clock := &fakeClock{now: time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)}
+	hook := newTestRecorderHook(t, recordingConfig{Filters: []string{"devices/+/data"}}, clock)
+	cl := &mqtt.Client{ID: "device-1"}
+
+	// --- Act ---
+	hook.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "devices/dev-1/data",
+		Payload:     []byte(`{"temp": 21}`),
+	})
+	hook.OnPublished(cl, packets.Packet{TopicName: "devices/dev-1/status", Payload: []byte("ignored")})
+	require.NoError(t, hook.Stop())
+
+	// --- Assert ---
+	paths, files := readRecordings(t, hook.config.Dir)
+	require.Len(t, paths, 1)
+	assert.Equal(t, "traffic-20250301T120000.000000000Z.ndjson.gz", filepath.Base(paths[0]))
+	require.Len(t, files[0], 1)
+	assert.Equal(t, recordedMessage{
+		Topic:      "devices/dev-1/data",
+		Payload:    []byte(`{"temp": 21}`),
+		QoS:        1,
+		Retain:     true,
+		ClientID:   "device-1",
+		ReceivedAt: clock.now,
+	}, files[0][0])
+	assert.EqualValues(t, 1, hook.recorded.Load())
+
+	parts, err := filepath.Glob(filepath.Join(hook.config.Dir, "*"+recordingPartSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, parts, "finished recordings should lose their .part suffix")
+}
+
+// TestRecorderHookRotates verifies a new file is started when the current one
+// reaches its size or its age.
+func TestRecorderHookRotates(t *testing.T) {
+	testCases := []struct {
+		name     string
+		settings recordingConfig
+		step     time.Duration
+	}{
+		{name: "by size", settings: recordingConfig{MaxBytes: 400, MaxAge: time.Hour}, step: time.Millisecond},
+		{name: "by age", settings: recordingConfig{MaxAge: time.Minute}, step: 45 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			clock := &fakeClock{now: time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)}
+			hook := newTestRecorderHook(t, tc.settings, clock)
+			payload := []byte(`{"reading": 1234567890}`)
+
+			// --- Act ---
+			for i := 0; i < 4; i++ {
+				hook.OnPublished(&mqtt.Client{ID: "device-1"}, packets.Packet{TopicName: "devices/dev-1/data", Payload: payload})
+				// Let the writer take the message before the clock moves on.
+				require.Eventually(t, func() bool { return hook.recorded.Load() == int64(i+1) }, 5*time.Second, time.Millisecond)
+				clock.advance(tc.step)
+			}
+			require.NoError(t, hook.Stop())
+
+			// --- Assert ---
+			_, files := readRecordings(t, hook.config.Dir)
+			assert.Len(t, files, 2)
+			total := 0
+			for _, messages := range files {
+				total += len(messages)
+			}
+			assert.Equal(t, 4, total, "rotation must not lose messages")
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"go.etcd.io/bbolt"
+)
+
+// storageTypeBolt selects the bbolt file storage hook.
+const storageTypeBolt = "bolt"
+
+// storageOpenTimeout bounds how long the broker waits for the database file
+// lock, e.g. while a previous instance is still shutting down.
+const storageOpenTimeout = 5 * time.Second
+
+// storageConfig selects the optional on-disk storage hook. With no type the
+// broker keeps retained messages, sessions and inflight messages in memory only.
+type storageConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+// enabled reports whether a storage hook is configured.
+func (s storageConfig) enabled() bool {
+	return s.Type != ""
+}
+
+// validate checks the storage type is supported and has a file to write to.
+func (s storageConfig) validate() error {
+	switch s.Type {
+	case "":
+		return nil
+	case storageTypeBolt:
+		if s.Path == "" {
+			return fmt.Errorf("storage type %s needs a path", s.Type)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported storage type %q (supported: %s)", s.Type, storageTypeBolt)
+	}
+}
+
+// addStorageHook adds the persistence hook. It must be added before the server
+// is started, as Serve restores clients, subscriptions, retained and inflight
+// messages from the store.
+func addStorageHook(server *mqtt.Server, settings storageConfig) error {
+	log.Printf("MQTT Broker will persist state with %s storage at %s", settings.Type, settings.Path)
+
+	return server.AddHook(new(bolt.Hook), &bolt.Options{
+		Path:    settings.Path,
+		Options: &bbolt.Options{Timeout: storageOpenTimeout},
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startStorageServer starts a broker on the given port backed by the bolt file at path.
+func startStorageServer(t *testing.T, port, path string) *mqtt.Server {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, addStorageHook(server, storageConfig{Type: storageTypeBolt, Path: path}))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	return server
+}
+
+// sendPersistentConnect connects with a persistent (non-clean) session and
+// returns the 4 byte CONNACK.
+func sendPersistentConnect(t *testing.T, conn net.Conn, clientID string) []byte {
+	t.Helper()
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Keepalive:        30,
+			ClientIdentifier: clientID,
+		},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.ConnectEncode(buf))
+	_, err := conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	connack := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, connack)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Connack<<4), connack[0], "expected a CONNACK packet")
+	return connack
+}
+
+// sendQos1Subscribe subscribes to a single filter at QoS 1 and returns the SUBACK reason code.
+func sendQos1Subscribe(t *testing.T, conn net.Conn, packetID uint16, filter string) byte {
+	t.Helper()
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		ProtocolVersion: 4,
+		PacketID:        packetID,
+		Filters:         packets.Subscriptions{{Filter: filter, Qos: 1}},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, pk.SubscribeEncode(buf))
+	_, err := conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	suback := make([]byte, 5)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, suback)
+	require.NoError(t, err)
+	require.Equal(t, byte(packets.Suback<<4), suback[0], "expected a SUBACK packet")
+	return suback[4]
+}
+
+// readPublish reads and decodes the next packet, which must be a PUBLISH.
+func readPublish(t *testing.T, conn net.Conn) packets.Packet {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	header := make([]byte, 1)
+	_, err := io.ReadFull(conn, header)
+	require.NoError(t, err)
+
+	// The remaining length is a variable byte integer of up to four bytes.
+	remaining, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(conn, b)
+		require.NoError(t, err)
+		remaining += int(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, remaining)
+	_, err = io.ReadFull(conn, body)
+	require.NoError(t, err)
+
+	pk := packets.Packet{ProtocolVersion: 4}
+	require.NoError(t, pk.FixedHeader.Decode(header[0]))
+	require.Equal(t, packets.Publish, pk.FixedHeader.Type, "expected a PUBLISH packet")
+	require.NoError(t, pk.PublishDecode(body))
+	return pk
+}
+
+// TestStorageRedeliversAfterRestart publishes a retained message and a QoS 1
+// message for an offline persistent subscriber, restarts the broker on the same
+// bolt file and checks both are delivered by the new instance.
+func TestStorageRedeliversAfterRestart(t *testing.T) {
+	// --- Arrange ---
+	path := filepath.Join(t.TempDir(), "broker.db")
+	firstPort := freePort(t)
+	first := startStorageServer(t, firstPort, path)
+
+	subscriber := dialBroker(t, firstPort)
+	sendPersistentConnect(t, subscriber, "persistent-subscriber")
+	require.Equal(t, byte(1), sendQos1Subscribe(t, subscriber, 1, "devices/+/data"))
+	require.NoError(t, subscriber.Close())
+	require.Eventually(t, func() bool {
+		cl, ok := first.Clients.Get("persistent-subscriber")
+		return ok && cl.Closed()
+	}, 5*time.Second, 50*time.Millisecond, "the subscriber should go offline")
+
+	require.NoError(t, first.Publish("devices/garden-monitor-001/data", []byte(`{"seq":1}`), false, 1))
+	require.NoError(t, first.Publish("devices/garden-monitor-001/status", []byte(`{"online":true}`), true, 0))
+	require.Eventually(t, func() bool {
+		info := first.Info.Clone()
+		return info.Inflight == 1 && info.Retained == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// --- Act ---
+	require.NoError(t, first.Close())
+	secondPort := freePort(t)
+	second := startStorageServer(t, secondPort, path)
+	t.Cleanup(func() { _ = second.Close() })
+
+	// --- Assert ---
+	resumed := dialBroker(t, secondPort)
+	connack := sendPersistentConnect(t, resumed, "persistent-subscriber")
+	assert.Equal(t, byte(1), connack[2], "the restored session should be present")
+	inflight := readPublish(t, resumed)
+	assert.Equal(t, "devices/garden-monitor-001/data", inflight.TopicName)
+	assert.Equal(t, []byte(`{"seq":1}`), inflight.Payload)
+	assert.Equal(t, byte(1), inflight.FixedHeader.Qos)
+
+	fresh := dialBroker(t, secondPort)
+	sendConnect(t, fresh, "fresh-subscriber", "", "")
+	sendSubscribe(t, fresh, 1, "devices/+/status")
+	retained := readPublish(t, fresh)
+	assert.Equal(t, "devices/garden-monitor-001/status", retained.TopicName)
+	assert.Equal(t, []byte(`{"online":true}`), retained.Payload)
+	assert.True(t, retained.FixedHeader.Retain)
+}
+
+// TestStorageConfigValidation verifies unsupported types and missing paths are rejected.
+func TestStorageConfigValidation(t *testing.T) {
+	assert.NoError(t, storageConfig{}.validate())
+	assert.NoError(t, storageConfig{Type: storageTypeBolt, Path: "broker.db"}.validate())
+	assert.Error(t, storageConfig{Type: storageTypeBolt}.validate())
+	assert.Error(t, storageConfig{Type: "badger", Path: "broker.db"}.validate())
+}
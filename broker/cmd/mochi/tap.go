@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// tapBufferSize is how many messages a tap holds for a slow reader before
+// dropping new ones.
+const tapBufferSize = 256
+
+// tapHandler streams publishes matching a topic filter as Server-Sent Events,
+// using an inline subscription so no MQTT credentials are needed. It is only
+// served behind the admin token.
+type tapHandler struct {
+	server *mqtt.Server
+	nextID atomic.Int64
+
+	// done is closed by close to end every open stream.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tapEvent is the JSON data of a single tapped publish. Payloads that are not
+// valid UTF-8 are sent base64 encoded in PayloadBase64 instead.
+type tapEvent struct {
+	Topic         string    `json:"topic"`
+	ClientID      string    `json:"client_id"`
+	Qos           byte      `json:"qos"`
+	Retain        bool      `json:"retain"`
+	Payload       string    `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payload_base64,omitempty"`
+	ReceivedAt    time.Time `json:"received_at"`
+}
+
+// newTapHandler creates the /tap handler. The server must have the inline client enabled.
+func newTapHandler(server *mqtt.Server) *tapHandler {
+	return &tapHandler{server: server, done: make(chan struct{})}
+}
+
+// close ends every open stream, so they do not hold up the HTTP server's
+// shutdown. It is registered with http.Server.RegisterOnShutdown.
+func (h *tapHandler) close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// ServeHTTP subscribes to the filter given in the query string and streams
+// matching publishes until the request is cancelled.
+func (h *tapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		http.Error(w, "Bad request: filter query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan tapEvent, tapBufferSize)
+	var dropped atomic.Int64
+	subscriptionID := int(h.nextID.Add(1))
+	err := h.server.Subscribe(filter, subscriptionID, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		select {
+		case events <- newTapEvent(pk):
+		default:
+			dropped.Add(1)
+		}
+	})
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		_ = h.server.Unsubscribe(filter, subscriptionID)
+		h.server.Log.Info("tap closed", "filter", filter, "dropped", dropped.Load())
+	}()
+	h.server.Log.Info("tap opened", "filter", filter, "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// The opening comment tells the reader the subscription is in place.
+	_, _ = fmt.Fprintf(w, ": tapping %s\n\n", filter)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: publish\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// newTapEvent copies the interesting parts of a publish into a tap event.
+func newTapEvent(pk packets.Packet) tapEvent {
+	event := tapEvent{
+		Topic:      pk.TopicName,
+		ClientID:   pk.Origin,
+		Qos:        pk.FixedHeader.Qos,
+		Retain:     pk.FixedHeader.Retain,
+		ReceivedAt: time.Now().UTC(),
+	}
+	if utf8.Valid(pk.Payload) {
+		event.Payload = string(pk.Payload)
+	} else {
+		event.PayloadBase64 = append([]byte(nil), pk.Payload...)
+	}
+	return event
+}
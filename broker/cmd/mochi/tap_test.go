@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTapStreamsMatchingPublishes opens a tap on device data and checks that a
+// device publish is streamed while other topics are not.
+func TestTapStreamsMatchingPublishes(t *testing.T) {
+	// --- Arrange ---
+	port := freePort(t)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: "127.0.0.1:" + port})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	api := httptest.NewServer(newTapHandler(server))
+	t.Cleanup(api.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.URL+"/tap?filter="+url.QueryEscape("devices/+/data"), nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	opening, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, ": tapping devices/+/data\n", opening)
+
+	device := dialBroker(t, port)
+	connack := sendConnect(t, device, "garden-monitor-001", "", "")
+	require.Equal(t, packets.CodeSuccess.Code, connack[3])
+
+	// --- Act ---
+	sendPublish(t, device, "devices/garden-monitor-001/status", []byte(`{"online":true}`))
+	sendPublish(t, device, "devices/garden-monitor-001/data", []byte(`{"temperature":21.5}`))
+
+	// --- Assert ---
+	var data string
+	for data == "" {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(strings.TrimSpace(line), "data: ")
+		}
+	}
+
+	var event tapEvent
+	require.NoError(t, json.Unmarshal([]byte(data), &event))
+	assert.Equal(t, "devices/garden-monitor-001/data", event.Topic)
+	assert.Equal(t, "garden-monitor-001", event.ClientID)
+	assert.Equal(t, `{"temperature":21.5}`, event.Payload)
+	assert.Empty(t, event.PayloadBase64)
+}
+
+// TestTapCloseEndsOpenStreams verifies close ends a stream that would
+// otherwise stay open, as the HTTP server's shutdown relies on.
+func TestTapCloseEndsOpenStreams(t *testing.T) {
+	// --- Arrange ---
+	tap := newTapHandler(mqtt.New(&mqtt.Options{InlineClient: true}))
+	api := httptest.NewServer(tap)
+	t.Cleanup(api.Close)
+
+	resp, err := http.Get(api.URL + "/tap?filter=" + url.QueryEscape("devices/#"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	// --- Act ---
+	tap.close()
+
+	// --- Assert ---
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		assert.NoError(t, err, "the stream should end cleanly")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream stayed open after close")
+	}
+}
+
+// TestTapRequiresFilter verifies a tap without a filter is rejected.
+func TestTapRequiresFilter(t *testing.T) {
+	// --- Arrange ---
+	rec := httptest.NewRecorder()
+
+	// --- Act ---
+	newTapHandler(mqtt.New(&mqtt.Options{InlineClient: true})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tap", nil))
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// TestTapEventEncodesBinaryPayloads verifies non UTF-8 payloads are base64 encoded.
+func TestTapEventEncodesBinaryPayloads(t *testing.T) {
+	event := newTapEvent(packets.Packet{TopicName: "devices/d/data", Payload: []byte{0xff, 0x00}})
+
+	assert.Empty(t, event.Payload)
+	assert.Equal(t, []byte{0xff, 0x00}, event.PayloadBase64)
+}
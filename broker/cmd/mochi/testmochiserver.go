@@ -12,50 +12,108 @@ import (
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
-	"github.com/mochi-mqtt/server/v2/hooks/auth"
 	"github.com/mochi-mqtt/server/v2/listeners"
 )
 
+// Listener IDs, also used as the listener label on /metrics.
+const (
+	tcpListenerID = "tcp-default"
+	tlsListenerID = "tls-default"
+)
+
 func main() {
-	// Channel to listen for OS signals for graceful shutdown
+	// Load the broker configuration: an optional YAML file plus env overrides.
+	configPath := os.Getenv("BROKER_CONFIG")
+	cfg, err := loadBrokerConfig(configPath)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid broker configuration: %v", err)
+	}
+
+	// Channel to listen for OS signals for graceful shutdown and config reloads
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Create and configure the MQTT Server
-	server := mqtt.New(nil)
+	// The inline client backs the /tap endpoint.
+	server := mqtt.New(&mqtt.Options{
+		Capabilities: cfg.Limits.capabilities(),
+		InlineClient: true,
+	})
 
-	// ... (logging setup remains the same) ...
-	logLevel := os.Getenv("LOG_LEVEL")
 	level := new(slog.LevelVar)
 	server.Log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: level,
 	}))
-	switch logLevel {
-	case "info":
-		level.Set(slog.LevelInfo)
-	default:
-		level.Set(slog.LevelDebug)
-	}
+	level.Set(cfg.slogLevel())
 
-	addAuthHook(server)
-	// MODIFIED: Pass a dedicated port for MQTT
-	addMqttListener(server, "1883")
+	ledger := addAuthHook(server, cfg)
+	adminToken, err := cfg.Admin.resolveToken()
+	if err != nil {
+		log.Fatalf("FATAL: Failed to load admin token: %v", err)
+	}
+	admin := newAdminAuth(adminToken)
+	tracker := newSessionTrackerHook()
+	if err := server.AddHook(tracker, nil); err != nil {
+		log.Fatalf("Failed to add session tracker hook: %v", err)
+	}
+	if cfg.Storage.enabled() {
+		if err := addStorageHook(server, cfg.Storage); err != nil {
+			log.Fatalf("Failed to add storage hook: %v", err)
+		}
+	}
+	var bridge *pubsubBridgeHook
+	if cfg.Bridge.enabled() {
+		bridge = addBridgeHook(context.Background(), server, cfg.Bridge)
+	}
+	var rateLimits *rateLimitHook
+	if cfg.RateLimit.enabled() {
+		rateLimits = addRateLimitHook(server, cfg.RateLimit)
+	}
+	var recorder *trafficRecorderHook
+	if cfg.Recording.enabled() {
+		recorder = addRecorderHook(server, cfg.Recording)
+	}
+	addMqttListener(server, cfg.Listeners.TCPPort)
+	if cfg.Listeners.TLS.enabled() {
+		addTLSListener(server, cfg.Listeners.TLS, ledger)
+	}
 
-	// --- Health Check Server ---
-	// MODIFIED: Use the $PORT environment variable for the health check server
-	httpPort := os.Getenv("PORT")
-	if httpPort == "" {
-		httpPort = "8080" // A common default for local development
+	listenerIDs := []string{tcpListenerID}
+	if cfg.Listeners.TLS.enabled() {
+		listenerIDs = append(listenerIDs, tlsListenerID)
 	}
-	httpServer := &http.Server{Addr: ":" + httpPort}
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+
+	// --- Health Check, Metrics and Client Inspection Server ---
+	httpPort := cfg.HTTPPort
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
+	metrics := newMetricsHandler(server, listenerIDs...)
+	if bridge != nil {
+		metrics.addSource(bridge)
+	}
+	if rateLimits != nil {
+		metrics.addSource(rateLimits)
+	}
+	if recorder != nil {
+		metrics.addSource(recorder)
+	}
+	mux.Handle("/metrics", metrics)
+	newClientsHandler(server, tracker, admin).register(mux)
+	httpServer := &http.Server{Addr: ":" + httpPort, Handler: mux}
+	// The tap streams every matching publish, so it is opt-in and behind the
+	// admin token. Open streams end when the HTTP server shuts down.
+	if cfg.Admin.Tap {
+		tap := newTapHandler(server)
+		mux.Handle("/tap", admin.require(tap))
+		httpServer.RegisterOnShutdown(tap.close)
+	}
 
 	// Run the HTTP server in a goroutine
 	go func() {
-		log.Printf("Starting health check server on port %s", httpPort)
+		log.Printf("Starting health check and metrics server on port %s", httpPort)
 		if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("HTTP server ListenAndServe: %v", err)
 		}
@@ -69,8 +127,14 @@ func main() {
 		}
 	}()
 
-	// Wait for shutdown signal - THIS IS THE LINE THAT KEEPS THE SERVER UP
-	<-sigs
+	// Wait for shutdown signal - THIS IS THE LINE THAT KEEPS THE SERVER UP.
+	// SIGHUP reloads the credentials, ACLs and log level without disconnecting anyone.
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig(configPath, ledger, admin, level)
+	}
 
 	// --- Graceful Shutdown ---
 	log.Println("Shutdown signal received, gracefully shutting down...")
@@ -85,32 +149,54 @@ func main() {
 	log.Println("Mochi MQTT Broker gracefully stopped.")
 }
 
-// ... addAuthHook remains the same ...
-func addAuthHook(server *mqtt.Server) {
-	clientUser := os.Getenv("CLIENT_USER")
-	clientPass := os.Getenv("CLIENT_PASS")
-	serviceUser := os.Getenv("SERVICE_USER")
-	servicePass := os.Getenv("SERVICE_PASS")
-
-	if clientUser == "" || clientPass == "" || serviceUser == "" || servicePass == "" {
-		log.Fatal("FATAL: Missing one or more credential environment variables.")
+// addAuthHook configures the credential ledger and the per-user topic ACLs.
+func addAuthHook(server *mqtt.Server, cfg *brokerConfig) *authLedger {
+	authRules, err := cfg.authRules()
+	if err != nil {
+		log.Fatalf("FATAL: Failed to load credentials: %v", err)
 	}
 
-	authRules := auth.AuthRules{
-		{Username: auth.RString(clientUser), Password: auth.RString(clientPass), Allow: true},
-		{Username: auth.RString(serviceUser), Password: auth.RString(servicePass), Allow: true},
+	ledger, err := addLedgerHooks(server, authRules, cfg.aclRules())
+	if err != nil {
+		log.Fatalf("Failed to add auth hook: %v", err)
 	}
+	return ledger
+}
 
-	if err := server.AddHook(new(auth.AllowHook), &auth.Options{Ledger: &auth.Ledger{Auth: authRules}}); err != nil {
-		log.Fatalf("Failed to add auth hook: %v", err)
+// reloadConfig re-reads the configuration and swaps the auth ledger and admin
+// token in place.
+// A bad config is logged and ignored so a typo cannot take the broker down.
+// Listener, limit, storage, bridge and recording changes only take effect after a restart.
+func reloadConfig(configPath string, ledger *authLedger, admin *adminAuth, level *slog.LevelVar) {
+	log.Println("SIGHUP received, reloading broker configuration...")
+
+	cfg, err := loadBrokerConfig(configPath)
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current configuration: %v", err)
+		return
 	}
+	authRules, err := cfg.authRules()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	adminToken, err := cfg.Admin.resolveToken()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current configuration: %v", err)
+		return
+	}
+
+	ledger.update(authRules, cfg.aclRules())
+	admin.update(adminToken)
+	level.Set(cfg.slogLevel())
+	log.Printf("Broker configuration reloaded: %d users, %d ACL rules", len(authRules), len(cfg.aclRules()))
 }
 
 // MODIFIED: Takes a port argument and no longer uses the $PORT env var
 func addMqttListener(server *mqtt.Server, port string) {
 	log.Printf("MQTT Broker will listen on port %s", port)
 
-	tcp := listeners.NewTCP(listeners.Config{ID: "tcp-default", Address: ":" + port})
+	tcp := listeners.NewTCP(listeners.Config{ID: tcpListenerID, Address: ":" + port})
 	if err := server.AddListener(tcp); err != nil {
 		log.Fatalf("Failed to add MQTT listener: %v", err)
 	}
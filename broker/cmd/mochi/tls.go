@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// tlsSettings describes the optional TLS listener used by field devices.
+type tlsSettings struct {
+	Port              string `yaml:"port"`
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	ClientCAFile      string `yaml:"client_ca_file"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// enabled reports whether the TLS listener is configured. It needs both a
+// certificate and its key.
+func (s tlsSettings) enabled() bool {
+	return s.CertFile != "" && s.KeyFile != ""
+}
+
+// newServerTLSConfig builds the tls.Config for the listener. When a client CA
+// is configured, client certificates are verified against it; RequireClientCert
+// turns that into mutual TLS.
+func newServerTLSConfig(settings tlsSettings) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if settings.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", settings.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if settings.RequireClientCert {
+		if cfg.ClientCAs == nil {
+			return nil, fmt.Errorf("requiring client certificates needs a client CA file")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// addTLSListener adds the TLS listener and, when client certificates can be
+// verified, the hook that maps the certificate CN to the MQTT username. Only
+// CNs that are users in ledger are accepted.
+func addTLSListener(server *mqtt.Server, settings tlsSettings, ledger *authLedger) {
+	log.Printf("MQTT Broker will listen for TLS on port %s (client CA: %t, client cert required: %t)",
+		settings.Port, settings.ClientCAFile != "", settings.RequireClientCert)
+
+	tlsConfig, err := newServerTLSConfig(settings)
+	if err != nil {
+		log.Fatalf("Failed to configure MQTT TLS listener: %v", err)
+	}
+
+	if tlsConfig.ClientCAs != nil {
+		if err := server.AddHook(&certIdentityHook{ledger: ledger}, nil); err != nil {
+			log.Fatalf("Failed to add certificate identity hook: %v", err)
+		}
+	}
+
+	tlsListener := listeners.NewTCP(listeners.Config{
+		ID:        tlsListenerID,
+		Address:   ":" + settings.Port,
+		TLSConfig: tlsConfig,
+	})
+	if err := server.AddListener(tlsListener); err != nil {
+		log.Fatalf("Failed to add MQTT TLS listener: %v", err)
+	}
+}
+
+// certIdentityHook uses the common name of a verified client certificate as
+// the client's MQTT username, so the auth ledger applies the same rules to
+// certificate logins as to username/password logins. A verified certificate
+// whose CN is a configured user is sufficient authentication on its own; the
+// CA alone does not let in a CN the broker does not know.
+type certIdentityHook struct {
+	mqtt.HookBase
+	ledger *authLedger
+}
+
+// ID returns the ID of the hook.
+func (h *certIdentityHook) ID() string {
+	return "cert-identity"
+}
+
+// Provides indicates which hook methods this hook provides.
+func (h *certIdentityHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPacketRead,
+		mqtt.OnConnectAuthenticate,
+	}, []byte{b})
+}
+
+// OnPacketRead rewrites the username of a CONNECT packet before the server
+// parses it, replacing whatever the device sent with the certificate CN.
+func (h *certIdentityHook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.FixedHeader.Type != packets.Connect {
+		return pk, nil
+	}
+
+	cn, ok := peerCommonName(cl)
+	if !ok {
+		return pk, nil
+	}
+
+	pk.Connect.Username = []byte(cn)
+	pk.Connect.UsernameFlag = true
+	return pk, nil
+}
+
+// OnConnectAuthenticate accepts a client that presented a verified certificate
+// for a configured user. Anything else falls through to the auth ledger, which
+// checks the username and password as for any other login.
+func (h *certIdentityHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	cn, ok := peerCommonName(cl)
+	return ok && h.ledger.hasUser(cn)
+}
+
+// peerCommonName returns the CN of the client's verified leaf certificate.
+func peerCommonName(cl *mqtt.Client) (string, bool) {
+	tlsConn, ok := cl.Net.Conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	cn := state.VerifiedChains[0][0].Subject.CommonName
+	return cn, cn != ""
+}
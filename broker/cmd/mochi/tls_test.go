@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTLSTestServer starts a server with a mutual TLS listener for certs whose
+// ledger knows only the given users.
+func newTLSTestServer(t *testing.T, certs testCertificates, usernames ...string) (*mqtt.Server, string) {
+	t.Helper()
+	port := freePort(t)
+
+	var rules auth.AuthRules
+	for _, username := range usernames {
+		rules = append(rules, auth.AuthRule{Username: auth.RString(username), Password: "unused", Allow: true})
+	}
+	server := mqtt.New(nil)
+	ledger, err := addLedgerHooks(server, rules, nil)
+	require.NoError(t, err)
+	addTLSListener(server, tlsSettings{
+		Port:              port,
+		CertFile:          certs.ServerCertFile,
+		KeyFile:           certs.ServerKeyFile,
+		ClientCAFile:      certs.CAFile,
+		RequireClientCert: true,
+	}, ledger)
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+	return server, port
+}
+
+// TestTLSListenerMapsCertificateCNToUsername verifies that a device presenting a
+// client certificate is authenticated by it and gets the CN as its username.
+func TestTLSListenerMapsCertificateCNToUsername(t *testing.T) {
+	// --- Arrange ---
+	certs := writeTestCertificates(t, "garden-monitor-001")
+	server, port := newTLSTestServer(t, certs, "garden-monitor-001")
+
+	clientCert, err := tls.LoadX509KeyPair(certs.ClientCertFile, certs.ClientKeyFile)
+	require.NoError(t, err)
+
+	// --- Act ---
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+port, &tls.Config{
+		RootCAs:      certs.CAPool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	connack := sendConnect(t, conn, "tls-test-client", "", "")
+
+	// --- Assert ---
+	assert.Equal(t, packets.CodeSuccess.Code, connack[3], "connection should be accepted on the certificate alone")
+	assert.Eventually(t, func() bool {
+		cl, ok := server.Clients.Get("tls-test-client")
+		return ok && string(cl.Properties.Username) == "garden-monitor-001"
+	}, 5*time.Second, 50*time.Millisecond, "username should be taken from the certificate CN")
+}
+
+// TestTLSListenerRejectsUnknownCommonName verifies that a certificate signed by
+// the client CA is refused when its CN is not a configured user.
+func TestTLSListenerRejectsUnknownCommonName(t *testing.T) {
+	// --- Arrange ---
+	certs := writeTestCertificates(t, "unknown-device")
+	server, port := newTLSTestServer(t, certs, "garden-monitor-001")
+
+	clientCert, err := tls.LoadX509KeyPair(certs.ClientCertFile, certs.ClientKeyFile)
+	require.NoError(t, err)
+
+	// --- Act ---
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+port, &tls.Config{
+		RootCAs:      certs.CAPool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	connack := sendConnect(t, conn, "tls-unknown-client", "", "")
+
+	// --- Assert ---
+	assert.NotEqual(t, packets.CodeSuccess.Code, connack[3], "a CN that is not a user should be refused")
+	_, ok := server.Clients.Get("tls-unknown-client")
+	assert.False(t, ok)
+}
+
+// TestTLSListenerRejectsMissingClientCertificate verifies that mutual TLS is enforced.
+func TestTLSListenerRejectsMissingClientCertificate(t *testing.T) {
+	// --- Arrange ---
+	certs := writeTestCertificates(t, "garden-monitor-001")
+	_, port := newTLSTestServer(t, certs, "garden-monitor-001")
+
+	// --- Act ---
+	// With TLS 1.3 the server's rejection only surfaces on the first read.
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+port, &tls.Config{RootCAs: certs.CAPool})
+	if err == nil {
+		t.Cleanup(func() { _ = conn.Close() })
+		buf := connectPacket(t, "tls-no-cert-client", "", "")
+		_, _ = conn.Write(buf)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 4))
+	}
+
+	// --- Assert ---
+	assert.Error(t, err, "a client without a certificate should not be able to connect")
+}
+
+// TestNewServerTLSConfigRequiresClientCA verifies the config is rejected when
+// client certificates are required but cannot be verified.
+func TestNewServerTLSConfigRequiresClientCA(t *testing.T) {
+	certs := writeTestCertificates(t, "garden-monitor-001")
+
+	_, err := newServerTLSConfig(tlsSettings{
+		CertFile:          certs.ServerCertFile,
+		KeyFile:           certs.ServerKeyFile,
+		RequireClientCert: true,
+	})
+
+	assert.Error(t, err)
+}
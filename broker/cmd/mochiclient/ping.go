@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runPing connects, reports how long that took, then publishes count messages
+// at QoS 1 to a topic it subscribes to itself and reports each round trip.
+// It fails if any ping is lost.
+func runPing(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	topic := fs.String("topic", "", "Topic to ping through (default mochiclient/ping/<client ID>); the ACL must allow publish and subscribe")
+	count := fs.Int("count", 3, "How many round trips to time")
+	interval := fs.Duration("interval", time.Second, "Time between pings")
+	if err := conn.parse(fs, args); err != nil {
+		return err
+	}
+	if *count < 1 {
+		return fmt.Errorf("-count must be at least 1")
+	}
+
+	opts, err := conn.clientOptions()
+	if err != nil {
+		return err
+	}
+	pingTopic := *topic
+	if pingTopic == "" {
+		pingTopic = "mochiclient/ping/" + opts.ClientID
+	}
+
+	start := time.Now()
+	client, err := conn.connect(opts)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(500)
+	fmt.Fprintf(out, "connected to %s in %s\n", conn.broker, time.Since(start).Round(time.Microsecond))
+
+	// Echoes nobody waits for any more are dropped rather than block paho.
+	echoes := make(chan string, *count)
+	if err := waitToken(client.Subscribe(pingTopic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case echoes <- string(msg.Payload()):
+		default:
+		}
+	}), conn.timeout); err != nil {
+		return fmt.Errorf("failed to subscribe to '%s': %w", pingTopic, err)
+	}
+
+	var lost int
+	var total time.Duration
+	for seq := 1; seq <= *count; seq++ {
+		if seq > 1 {
+			time.Sleep(*interval)
+		}
+		rtt, err := pingOnce(client, pingTopic, seq, echoes, conn.timeout)
+		if err != nil {
+			lost++
+			fmt.Fprintf(out, "ping %d: %v\n", seq, err)
+			continue
+		}
+		total += rtt
+		fmt.Fprintf(out, "ping %d: %s\n", seq, rtt.Round(time.Microsecond))
+	}
+
+	fmt.Fprintf(out, "%d sent, %d received", *count, *count-lost)
+	if received := *count - lost; received > 0 {
+		fmt.Fprintf(out, ", average %s", (total / time.Duration(received)).Round(time.Microsecond))
+	}
+	fmt.Fprintln(out)
+	if lost > 0 {
+		return fmt.Errorf("%d of %d pings lost", lost, *count)
+	}
+	log.Println("Ping finished.")
+	return nil
+}
+
+// pingOnce publishes seq and waits for it to come back on echoes, skipping
+// late echoes of earlier pings.
+func pingOnce(client mqtt.Client, topic string, seq int, echoes <-chan string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	if err := waitToken(client.Publish(topic, 1, false, strconv.Itoa(seq)), timeout); err != nil {
+		return 0, fmt.Errorf("publish failed: %w", err)
+	}
+	deadline := time.After(timeout - time.Since(start))
+	for {
+		select {
+		case echo := <-echoes:
+			if echo == strconv.Itoa(seq) {
+				return time.Since(start), nil
+			}
+		case <-deadline:
+			return 0, fmt.Errorf("no echo within %s", timeout)
+		}
+	}
+}
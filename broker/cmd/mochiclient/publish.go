@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// pubFlags are the pub command's flags.
+type pubFlags struct {
+	topic   string
+	message string
+	file    string
+	count   int
+	rate    float64
+	qos     int
+	retain  bool
+}
+
+// runPub publishes a message count times, paced by rate. The message comes
+// from -m, -file (- for stdin) or, when neither is given, is the hello message
+// mochiclient has always sent.
+func runPub(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("pub", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	p := &pubFlags{}
+	fs.StringVar(&p.topic, "topic", "devices/local/events", "MQTT topic to publish to")
+	fs.StringVar(&p.message, "m", "", "Message to publish")
+	fs.StringVar(&p.file, "file", "", "File to publish, or - to read the message from stdin")
+	fs.IntVar(&p.count, "count", 1, "How many times to publish the message")
+	fs.Float64Var(&p.rate, "rate", 0, "Messages per second when -count is more than 1 (0 publishes as fast as possible)")
+	fs.IntVar(&p.qos, "qos", 0, "QoS to publish at (0, 1 or 2)")
+	fs.BoolVar(&p.retain, "retain", false, "Ask the broker to retain the message")
+	if err := conn.parse(fs, args); err != nil {
+		return err
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	// Read the message before the password prompt can take over the terminal.
+	payload, err := loadPayload(p.message, p.file, stdin)
+	if err != nil {
+		return err
+	}
+
+	opts, err := conn.clientOptions()
+	if err != nil {
+		return err
+	}
+	client, err := conn.connect(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		client.Disconnect(500)
+		log.Println("Client disconnected.")
+	}()
+
+	var interval time.Duration
+	if p.rate > 0 {
+		interval = time.Duration(float64(time.Second) / p.rate)
+	}
+	log.Printf("Publishing %d message(s) to topic '%s'...", p.count, p.topic)
+	next := time.Now()
+	for i := 0; i < p.count; i++ {
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		next = next.Add(interval)
+
+		message := payload
+		if message == nil {
+			message = helloPayload()
+		}
+		if err := waitToken(client.Publish(p.topic, byte(p.qos), p.retain, message), conn.timeout); err != nil {
+			return fmt.Errorf("failed to publish message %d: %w", i+1, err)
+		}
+	}
+	log.Printf("✅ %d message(s) published successfully!", p.count)
+	return nil
+}
+
+// validate checks the pub flags make sense together.
+func (p *pubFlags) validate() error {
+	if p.message != "" && p.file != "" {
+		return fmt.Errorf("use only one of -m and -file")
+	}
+	if p.count < 1 {
+		return fmt.Errorf("-count must be at least 1")
+	}
+	if p.rate < 0 {
+		return fmt.Errorf("-rate must not be negative")
+	}
+	if p.qos < 0 || p.qos > 2 {
+		return fmt.Errorf("-qos must be 0, 1 or 2")
+	}
+	return nil
+}
+
+// loadPayload returns the message to publish: message itself, the contents of
+// file, or stdin when file is -. It returns nil when neither is given.
+func loadPayload(message, file string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case message != "":
+		return []byte(message), nil
+	case file == "-":
+		payload, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message from stdin: %w", err)
+		}
+		return payload, nil
+	case file != "":
+		payload, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message file: %w", err)
+		}
+		return payload, nil
+	default:
+		return nil, nil
+	}
+}
+
+// helloPayload is the default message, stamped with the current time.
+func helloPayload() []byte {
+	return []byte(fmt.Sprintf(`{"timestamp": %d, "message": "Hello from secure client!"}`, time.Now().Unix()))
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
+	"os"
 	"strings"
 	"syscall"
 	"time"
@@ -26,60 +31,206 @@ var onConnectionLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client
 	log.Printf("Connection Lost: %v", err)
 }
 
+// usage describes the subcommands; each prints its own flags with -h.
+const usage = `Usage: mochiclient <command> [flags]
+
+Commands:
+  pub   publish a message from -m, -file or stdin, optionally repeated at a rate
+  sub   print messages matching a topic filter
+  ping  connect and time publish round trips through the broker
+
+Every command takes -broker, -user and one of -pass, -secret or the password
+prompt, and for tls:// brokers -ca, -cert, -key and -insecure-skip-verify.
+Run "mochiclient <command> -h" for its flags. Without a command, mochiclient
+publishes a single hello message, as it always has.
+`
+
 func main() {
-	// --- Configuration: Define flags for command-line arguments ---
-	brokerURL := flag.String("broker", "", "MQTT broker URL (e.g., tcp://host:port) (required)")
-	topic := flag.String("topic", "devices/local/events", "MQTT topic to publish to")
-	username := flag.String("user", "", "Username for MQTT broker (required)")
-	password := flag.String("pass", "", "Password for MQTT broker (overrides -secret and prompt)")
-	secretName := flag.String("secret", "", "Google Secret Manager name (e.g., projects/p/s/v/l)")
-	flag.Parse()
-
-	// --- Basic Validation ---
-	if *brokerURL == "" || *username == "" {
-		log.Println("ERROR: The -broker and -user flags are required.")
-		flag.Usage()
+	args := os.Args[1:]
+	command := "pub"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "pub":
+		err = runPub(args, os.Stdin)
+	case "sub":
+		err = runSub(args, os.Stdout)
+	case "ping":
+		err = runPing(args, os.Stdout)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", command, err)
+	}
+}
+
+// connectionFlags are the flags every command uses to reach the broker.
+type connectionFlags struct {
+	broker    string
+	username  string
+	password  string
+	secret    string
+	clientID  string
+	keepalive time.Duration
+	timeout   time.Duration
 
-	finalBrokerURL := ensurePort(*brokerURL)
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
 
-	// --- Determine Password Source ---
-	finalPassword, err := getFinalPassword(*password, *secretName)
+// addConnectionFlags registers the connection flags on fs.
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	c := &connectionFlags{}
+	fs.StringVar(&c.broker, "broker", "", "MQTT broker URL (e.g., tcp://host:port) (required)")
+	fs.StringVar(&c.username, "user", "", "Username for MQTT broker (required)")
+	fs.StringVar(&c.password, "pass", "", "Password for MQTT broker (overrides -secret and prompt)")
+	fs.StringVar(&c.secret, "secret", "", "Google Secret Manager name (e.g., projects/p/s/v/l)")
+	fs.StringVar(&c.clientID, "id", "", "MQTT client ID (default local-go-client-<unix time>)")
+	fs.DurationVar(&c.keepalive, "keepalive", 30*time.Second, "MQTT keepalive")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "How long to wait for the broker to connect and acknowledge")
+	fs.StringVar(&c.caFile, "ca", "", "PEM CA bundle to verify a tls:// broker with, instead of the system roots")
+	fs.StringVar(&c.certFile, "cert", "", "PEM client certificate to present to a tls:// broker (needs -key)")
+	fs.StringVar(&c.keyFile, "key", "", "PEM private key for -cert")
+	fs.BoolVar(&c.insecureSkipVerify, "insecure-skip-verify", false, "Do not verify the broker's certificate (testing only)")
+	return c
+}
+
+// parse parses args into fs and checks the connection flags are set.
+func (c *connectionFlags) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.broker == "" || c.username == "" {
+		fs.Usage()
+		return fmt.Errorf("the -broker and -user flags are required")
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
+// clientOptions resolves the password and builds the paho client options.
+func (c *connectionFlags) clientOptions() (*mqtt.ClientOptions, error) {
+	// Check the TLS flags before the password prompt.
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	finalPassword, err := getFinalPassword(c.password, c.secret)
 	if err != nil {
-		log.Fatalf("Failed to get password: %v", err)
+		return nil, fmt.Errorf("failed to get password: %w", err)
 	}
 
-	// --- Configure MQTT Client Options ---
+	clientID := c.clientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("local-go-client-%d", time.Now().Unix())
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(finalBrokerURL)
-	opts.SetClientID(fmt.Sprintf("local-go-client-%d", time.Now().Unix()))
-	opts.SetUsername(*username)
+	opts.AddBroker(ensurePort(c.broker))
+	opts.SetClientID(clientID)
+	opts.SetUsername(c.username)
 	opts.SetPassword(finalPassword)
-	opts.SetKeepAlive(30 * time.Second)
+	opts.SetKeepAlive(c.keepalive)
+	opts.SetConnectTimeout(c.timeout)
 	opts.OnConnect = onConnectHandler
 	opts.OnConnectionLost = onConnectionLostHandler
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
 
-	// --- Connect, Publish, and Disconnect ---
-	log.Printf("Attempting to connect to %s...", *brokerURL)
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.WaitTimeout(10*time.Second) && token.Error() != nil {
-		log.Fatalf("Failed to connect: %v", token.Error())
+// tlsConfig builds the TLS settings for a TLS broker URL: -ca replaces the
+// system roots, -cert and -key present a client certificate for mutual TLS
+// and -insecure-skip-verify turns verification off. It returns nil for a
+// plain broker URL, which the TLS flags cannot be used with.
+func (c *connectionFlags) tlsConfig() (*tls.Config, error) {
+	flagsSet := c.caFile != "" || c.certFile != "" || c.keyFile != "" || c.insecureSkipVerify
+	scheme, _, _ := strings.Cut(c.broker, "://")
+	if !isTLSScheme(scheme) {
+		if flagsSet {
+			return nil, fmt.Errorf("-ca, -cert, -key and -insecure-skip-verify need a tls:// or ssl:// broker URL")
+		}
+		return nil, nil
+	}
+
+	brokerURL, err := url.Parse(c.broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	cfg := &tls.Config{
+		ServerName:         brokerURL.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.insecureSkipVerify,
+	}
+	if c.insecureSkipVerify {
+		log.Println("WARNING: not verifying the broker's certificate.")
+	}
+
+	if c.caFile != "" {
+		caPEM, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (c.certFile == "") != (c.keyFile == "") {
+		return nil, fmt.Errorf("-cert and -key must be given together")
 	}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
 
-	payload := fmt.Sprintf(`{"timestamp": %d, "message": "Hello from secure client!"}`, time.Now().Unix())
-	log.Printf("Publishing message to topic '%s'...", *topic)
-	token := client.Publish(*topic, 0, false, payload)
-	token.Wait()
+// isTLSScheme reports whether a broker URL scheme connects over TLS.
+func isTLSScheme(scheme string) bool {
+	switch strings.ToLower(scheme) {
+	case "tls", "ssl", "mqtts":
+		return true
+	default:
+		return false
+	}
+}
 
-	if token.Error() != nil {
-		log.Printf("Failed to publish: %v", token.Error())
-	} else {
-		log.Println("✅ Message published successfully!")
+// connect connects a client with opts, waiting at most the connect timeout.
+func (c *connectionFlags) connect(opts *mqtt.ClientOptions) (mqtt.Client, error) {
+	log.Printf("Attempting to connect to %s...", c.broker)
+	client := mqtt.NewClient(opts)
+	if err := waitToken(client.Connect(), c.timeout); err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
+	return client, nil
+}
 
-	client.Disconnect(500)
-	log.Println("Client disconnected.")
+// waitToken waits up to timeout for token to complete and returns its error.
+func waitToken(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return token.Error()
 }
 
 // ensurePort checks if a URL has a port and adds a default if it doesn't.
@@ -98,12 +249,9 @@ func ensurePort(brokerURL string) string {
 	}
 
 	// Port is missing, add a default based on the scheme
-	var defaultPort string
-	switch strings.ToLower(scheme) {
-	case "tls", "ssl":
+	defaultPort := "1883"
+	if isTLSScheme(scheme) {
 		defaultPort = "8883"
-	default:
-		defaultPort = "1883"
 	}
 
 	log.Printf("Port not found in broker URL, adding default port %s", defaultPort)
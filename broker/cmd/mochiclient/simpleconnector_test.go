@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEnsurePort verifies a default port is added for the URL's scheme.
+func TestEnsurePort(t *testing.T) {
+	testCases := []struct {
+		url  string
+		want string
+	}{
+		{url: "tcp://broker.internal", want: "tcp://broker.internal:1883"},
+		{url: "tls://broker.internal", want: "tls://broker.internal:8883"},
+		{url: "ssl://broker.internal", want: "ssl://broker.internal:8883"},
+		{url: "mqtts://broker.internal", want: "mqtts://broker.internal:8883"},
+		{url: "tcp://broker.internal:1884", want: "tcp://broker.internal:1884"},
+		{url: "broker.internal", want: "broker.internal"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			assert.Equal(t, tc.want, ensurePort(tc.url))
+		})
+	}
+}
+
+// TestLoadPayload verifies the message is read from the flag, a file or stdin.
+func TestLoadPayload(t *testing.T) {
+	// --- Arrange ---
+	path := filepath.Join(t.TempDir(), "message.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"from": "file"}`), 0o600))
+	stdin := strings.NewReader(`{"from": "stdin"}`)
+
+	// --- Act ---
+	fromFlag, flagErr := loadPayload(`{"from": "flag"}`, "", stdin)
+	fromFile, fileErr := loadPayload("", path, stdin)
+	fromStdin, stdinErr := loadPayload("", "-", stdin)
+	none, noneErr := loadPayload("", "", stdin)
+	_, missingErr := loadPayload("", filepath.Join(t.TempDir(), "missing.json"), stdin)
+
+	// --- Assert ---
+	require.NoError(t, flagErr)
+	assert.Equal(t, `{"from": "flag"}`, string(fromFlag))
+	require.NoError(t, fileErr)
+	assert.Equal(t, `{"from": "file"}`, string(fromFile))
+	require.NoError(t, stdinErr)
+	assert.Equal(t, `{"from": "stdin"}`, string(fromStdin))
+	require.NoError(t, noneErr)
+	assert.Nil(t, none, "no message means the default hello message")
+	assert.ErrorContains(t, missingErr, "failed to read message file")
+}
+
+// TestPubFlagsValidate verifies conflicting or out of range pub flags are rejected.
+func TestPubFlagsValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		flags   pubFlags
+		wantErr string
+	}{
+		{name: "defaults", flags: pubFlags{count: 1}},
+		{name: "repeated at a rate", flags: pubFlags{message: "x", count: 100, rate: 10, qos: 1}},
+		{name: "message and file", flags: pubFlags{message: "x", file: "-", count: 1}, wantErr: "only one of"},
+		{name: "no messages", flags: pubFlags{count: 0}, wantErr: "-count"},
+		{name: "negative rate", flags: pubFlags{count: 1, rate: -1}, wantErr: "-rate"},
+		{name: "bad qos", flags: pubFlags{count: 1, qos: 3}, wantErr: "-qos"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.flags.validate()
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestPrintMessage verifies the header line and that only JSON payloads are
+// pretty-printed.
+func TestPrintMessage(t *testing.T) {
+	// --- Arrange ---
+	at := time.Date(2025, 3, 1, 12, 0, 0, 500000000, time.UTC)
+	var out bytes.Buffer
+
+	// --- Act ---
+	require.NoError(t, printMessage(&out, at, "devices/d1/events", 1, true, []byte(`{"temp":21}`), true))
+	require.NoError(t, printMessage(&out, at, "devices/d1/raw", 0, false, []byte(`not json`), true))
+	require.NoError(t, printMessage(&out, at, "devices/d1/events", 0, false, []byte(`{"temp":21}`), false))
+
+	// --- Assert ---
+	assert.Equal(t, "2025-03-01T12:00:00.5Z devices/d1/events qos=1 retained\n{\n  \"temp\": 21\n}\n"+
+		"2025-03-01T12:00:00.5Z devices/d1/raw qos=0\nnot json\n"+
+		"2025-03-01T12:00:00.5Z devices/d1/events qos=0\n{\"temp\":21}\n", out.String())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// subFlags are the sub command's flags.
+type subFlags struct {
+	topic  string
+	qos    int
+	count  int
+	pretty bool
+}
+
+// runSub prints every message matching the topic filter to out, one line of
+// receive time, topic and flags followed by the payload, until count messages
+// have arrived or it is interrupted.
+func runSub(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("sub", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	s := &subFlags{}
+	fs.StringVar(&s.topic, "topic", "#", "MQTT topic filter to subscribe to")
+	fs.IntVar(&s.qos, "qos", 0, "QoS to subscribe at (0, 1 or 2)")
+	fs.IntVar(&s.count, "count", 0, "Exit after this many messages (0 runs until interrupted)")
+	fs.BoolVar(&s.pretty, "pretty", false, "Pretty-print JSON payloads")
+	if err := conn.parse(fs, args); err != nil {
+		return err
+	}
+	if s.qos < 0 || s.qos > 2 {
+		return fmt.Errorf("-qos must be 0, 1 or 2")
+	}
+	if s.count < 0 {
+		return fmt.Errorf("-count must not be negative")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts, err := conn.clientOptions()
+	if err != nil {
+		return err
+	}
+	client, err := conn.connect(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		client.Disconnect(500)
+		log.Println("Client disconnected.")
+	}()
+
+	// paho calls the handler from its own goroutine; the lock keeps lines whole
+	// and the count exact.
+	var mu sync.Mutex
+	received := 0
+	done := make(chan struct{})
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if s.count > 0 && received >= s.count {
+			return
+		}
+		if err := printMessage(out, time.Now(), msg.Topic(), msg.Qos(), msg.Retained(), msg.Payload(), s.pretty); err != nil {
+			log.Printf("Failed to print message: %v", err)
+		}
+		received++
+		if s.count > 0 && received == s.count {
+			close(done)
+		}
+	}
+	if err := waitToken(client.Subscribe(s.topic, byte(s.qos), handler), conn.timeout); err != nil {
+		return fmt.Errorf("failed to subscribe to '%s': %w", s.topic, err)
+	}
+	log.Printf("Subscribed to '%s', waiting for messages...", s.topic)
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	mu.Lock()
+	log.Printf("Received %d message(s).", received)
+	mu.Unlock()
+	return nil
+}
+
+// printMessage writes one received message: a header line with the receive
+// time, topic, QoS and retained flag, then the payload, indented when pretty
+// is set and it is JSON.
+func printMessage(out io.Writer, at time.Time, topic string, qos byte, retained bool, payload []byte, pretty bool) error {
+	header := fmt.Sprintf("%s %s qos=%d", at.Format(time.RFC3339Nano), topic, qos)
+	if retained {
+		header += " retained"
+	}
+	if pretty {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, payload, "", "  "); err == nil {
+			payload = indented.Bytes()
+		}
+	}
+	_, err := fmt.Fprintf(out, "%s\n%s\n", header, payload)
+	return err
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificates holds the file paths of a throwaway CA, server and client certificate.
+type testCertificates struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+	CAPool         *x509.CertPool
+}
+
+// writeTestCertificates generates a CA, a server certificate for 127.0.0.1 and
+// a client certificate with the given CN, and writes them as PEM files.
+func writeTestCertificates(t *testing.T, clientCN string) testCertificates {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, ips []net.IP) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return der, key
+	}
+	serverDER, serverKey := issue(2, "localhost", x509.ExtKeyUsageServerAuth, []net.IP{net.ParseIP("127.0.0.1")})
+	clientDER, clientKey := issue(3, clientCN, x509.ExtKeyUsageClientAuth, nil)
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+		return path
+	}
+	writeKey := func(name string, key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return writePEM(name, "EC PRIVATE KEY", der)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return testCertificates{
+		CAFile:         writePEM("ca.pem", "CERTIFICATE", caDER),
+		ServerCertFile: writePEM("server.pem", "CERTIFICATE", serverDER),
+		ServerKeyFile:  writeKey("server-key.pem", serverKey),
+		ClientCertFile: writePEM("client.pem", "CERTIFICATE", clientDER),
+		ClientKeyFile:  writeKey("client-key.pem", clientKey),
+		CAPool:         pool,
+	}
+}
+
+// handshakeResult is what a test TLS listener saw of one connection's handshake.
+type handshakeResult struct {
+	state tls.ConnectionState
+	err   error
+}
+
+// startTLSListener starts a bare TLS listener that requires a client
+// certificate signed by the test CA when requireClientCert is set. It reports
+// every handshake and answers the MQTT CONNECT that follows a successful one
+// with a CONNACK, which is as much of a broker as the client needs to connect.
+func startTLSListener(t *testing.T, certs testCertificates, requireClientCert bool) (string, <-chan handshakeResult) {
+	t.Helper()
+	serverCert, err := tls.LoadX509KeyPair(certs.ServerCertFile, certs.ServerKeyFile)
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}, MinVersion: tls.VersionTLS12}
+	if requireClientCert {
+		tlsConfig.ClientCAs = certs.CAPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	handshakes := make(chan handshakeResult, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				_ = tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+				err := tlsConn.Handshake()
+				handshakes <- handshakeResult{state: tlsConn.ConnectionState(), err: err}
+				if err != nil || readPacket(tlsConn) != nil {
+					return
+				}
+				// CONNACK: session not present, connection accepted.
+				if _, err := tlsConn.Write([]byte{0x20, 0x02, 0x00, 0x00}); err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, tlsConn)
+			}()
+		}
+	}()
+	return "tls://" + l.Addr().String(), handshakes
+}
+
+// readPacket reads and discards one MQTT control packet.
+func readPacket(r io.Reader) error {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	length, multiplier := 0, 1
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		length += int(header[0]&0x7f) * multiplier
+		if header[0]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	_, err := io.CopyN(io.Discard, r, int64(length))
+	return err
+}
+
+// TestConnectOverTLS connects to TLS listeners with each combination of TLS
+// flags and checks the handshake succeeds only when it should, presenting the
+// client certificate when one is configured.
+func TestConnectOverTLS(t *testing.T) {
+	const clientCN = "mochiclient"
+	certs := writeTestCertificates(t, clientCN)
+
+	testCases := []struct {
+		name              string
+		requireClientCert bool
+		flags             connectionFlags
+		wantErr           bool
+	}{
+		{name: "verified with -ca", flags: connectionFlags{caFile: certs.CAFile}},
+		{name: "unknown CA", wantErr: true},
+		{name: "unverified with -insecure-skip-verify", flags: connectionFlags{insecureSkipVerify: true}},
+		{
+			name:              "client certificate",
+			requireClientCert: true,
+			flags:             connectionFlags{caFile: certs.CAFile, certFile: certs.ClientCertFile, keyFile: certs.ClientKeyFile},
+		},
+		{name: "missing client certificate", requireClientCert: true, flags: connectionFlags{caFile: certs.CAFile}, wantErr: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			brokerURL, handshakes := startTLSListener(t, certs, tc.requireClientCert)
+			conn := tc.flags
+			conn.broker = brokerURL
+			conn.username = "tester"
+			conn.password = "secret"
+			conn.clientID = fmt.Sprintf("tls-test-%d", i)
+			conn.keepalive = 30 * time.Second
+			conn.timeout = 5 * time.Second
+
+			// --- Act ---
+			opts, err := conn.clientOptions()
+			require.NoError(t, err)
+			client, err := conn.connect(opts)
+
+			// --- Assert ---
+			var handshake handshakeResult
+			select {
+			case handshake = <-handshakes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the TLS handshake")
+			}
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Error(t, handshake.err, "the handshake should fail")
+				return
+			}
+			require.NoError(t, err)
+			defer client.Disconnect(100)
+			require.NoError(t, handshake.err)
+			if tc.requireClientCert {
+				require.NotEmpty(t, handshake.state.PeerCertificates)
+				assert.Equal(t, clientCN, handshake.state.PeerCertificates[0].Subject.CommonName)
+			} else {
+				assert.Empty(t, handshake.state.PeerCertificates)
+			}
+		})
+	}
+}
+
+// TestTLSConfigRejectsBadFlags verifies TLS flag mistakes are reported before
+// connecting.
+func TestTLSConfigRejectsBadFlags(t *testing.T) {
+	certs := writeTestCertificates(t, "mochiclient")
+
+	testCases := []struct {
+		name    string
+		flags   connectionFlags
+		wantErr string
+	}{
+		{name: "plain broker", flags: connectionFlags{broker: "tcp://127.0.0.1:1883", caFile: certs.CAFile}, wantErr: "tls://"},
+		{name: "cert without key", flags: connectionFlags{broker: "tls://127.0.0.1", certFile: certs.ClientCertFile}, wantErr: "together"},
+		{name: "missing CA file", flags: connectionFlags{broker: "tls://127.0.0.1", caFile: filepath.Join(t.TempDir(), "none.pem")}, wantErr: "CA file"},
+		{name: "CA file without certificates", flags: connectionFlags{broker: "ssl://127.0.0.1", caFile: certs.ServerKeyFile}, wantErr: "no certificates"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.flags.tlsConfig()
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+
+	plain, err := (&connectionFlags{broker: "tcp://127.0.0.1:1883"}).tlsConfig()
+	require.NoError(t, err)
+	assert.Nil(t, plain, "a plain broker needs no TLS settings")
+	secure, err := (&connectionFlags{broker: "tls://broker.internal:8883", caFile: certs.CAFile}).tlsConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "broker.internal", secure.ServerName)
+	assert.NotNil(t, secure.RootCAs)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// aclRule grants a user publish and subscribe access to a set of topic filters.
+// The placeholder {username} in a filter is replaced with the rule's username.
+type aclRule struct {
+	Username  string   `yaml:"username"`
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+}
+
+// aclFile is the layout of the YAML file named by MQTT_ACL_FILE.
+type aclFile struct {
+	ACL []aclRule `yaml:"acl"`
+}
+
+// defaultACLRules lets the ingestion service subscribe to device data only.
+// Load test traffic is published by the inline client, which bypasses ACLs.
+func defaultACLRules(serviceUser string) []aclRule {
+	return []aclRule{
+		{Username: serviceUser, Subscribe: []string{"devices/+/data"}},
+	}
+}
+
+// loadACLRules reads ACL rules from a YAML file, expanding ${VAR} references in usernames.
+func loadACLRules(path string) ([]aclRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACL file: %w", err)
+	}
+
+	var file aclFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse ACL file %s: %w", path, err)
+	}
+
+	for i := range file.ACL {
+		file.ACL[i].Username = os.ExpandEnv(file.ACL[i].Username)
+		if file.ACL[i].Username == "" {
+			return nil, fmt.Errorf("ACL rule %d in %s has no username", i, path)
+		}
+	}
+	return file.ACL, nil
+}
+
+// buildACL converts the declarative rules into ledger rules. Each user's rule
+// denies anything it does not grant, and a final rule denies everything to
+// users without a rule of their own.
+func buildACL(rules []aclRule) auth.ACLRules {
+	acl := make(auth.ACLRules, 0, len(rules)+1)
+	for _, rule := range rules {
+		filters := auth.Filters{"#": auth.Deny}
+		for _, filter := range rule.Publish {
+			key := auth.RString(strings.ReplaceAll(filter, "{username}", rule.Username))
+			filters[key] = grant(filters[key], auth.WriteOnly)
+		}
+		for _, filter := range rule.Subscribe {
+			key := auth.RString(strings.ReplaceAll(filter, "{username}", rule.Username))
+			filters[key] = grant(filters[key], auth.ReadOnly)
+		}
+		acl = append(acl, auth.ACLRule{Username: auth.RString(rule.Username), Filters: filters})
+	}
+	return append(acl, auth.ACLRule{Username: "*", Filters: auth.Filters{"#": auth.Deny}})
+}
+
+// grant combines an existing access level with a new one.
+func grant(current, access auth.Access) auth.Access {
+	if current == auth.Deny || current == access {
+		return access
+	}
+	return auth.ReadWrite
+}
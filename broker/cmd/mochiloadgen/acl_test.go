@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDefaultACLRestrictsServiceUser verifies the ingestion service can only
+// subscribe to device data and other users are denied everything.
+func TestDefaultACLRestrictsServiceUser(t *testing.T) {
+	// --- Arrange ---
+	hook := new(auth.Hook)
+	hook.SetOpts(slog.Default(), nil)
+	require.NoError(t, hook.Init(&auth.Options{
+		Ledger: &auth.Ledger{ACL: buildACL(defaultACLRules("sreceiver"))},
+	}))
+
+	service := &mqtt.Client{ID: "ingestion", Properties: mqtt.ClientProperties{Username: []byte("sreceiver")}}
+	stranger := &mqtt.Client{ID: "stranger", Properties: mqtt.ClientProperties{Username: []byte("stranger")}}
+
+	// --- Act & Assert ---
+	assert.True(t, hook.OnACLCheck(service, "devices/+/data", false), "service should subscribe to device data")
+	assert.False(t, hook.OnACLCheck(service, "#", false), "service should not subscribe to everything")
+	assert.False(t, hook.OnACLCheck(service, "devices/garden-monitor-001/data", true), "service should not publish")
+	assert.False(t, hook.OnACLCheck(stranger, "devices/+/data", false), "unknown users should be denied")
+}
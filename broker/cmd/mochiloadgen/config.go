@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mochi/lib"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadgenConfig is the load generator's file-based configuration, read from the
+// YAML file named by LOADGEN_CONFIG. Environment variables override the file,
+// so the original env-only deployments keep working without one.
+type loadgenConfig struct {
+	LogLevel       string    `yaml:"log_level"`
+	HTTPPort       string    `yaml:"http_port"`
+	MQTTPort       string    `yaml:"mqtt_port"`
+	Username       string    `yaml:"username"`
+	Password       string    `yaml:"password"`
+	PasswordSecret string    `yaml:"password_secret"`
+	ACL            []aclRule `yaml:"acl"`
+
+	// ShutdownTimeout is how long running load tests may drain on shutdown
+	// before they are cancelled.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// IngestionTopic is the filter the ingestion service subscribes to (its
+	// MQTT_TOPIC). Load test topics that would not match it are rejected.
+	IngestionTopic string `yaml:"ingestion_topic"`
+
+	// ClientPasswordSecrets are the Secret Manager secrets a network client
+	// load test may name as its password_secret. The password is sent to the
+	// broker the request names, so list only secrets meant for test brokers.
+	ClientPasswordSecrets []string `yaml:"client_password_secrets"`
+
+	// RecordingsDir holds the broker recordings that replay requests may name.
+	// Replaying recordings is off when it is empty.
+	RecordingsDir string `yaml:"recordings_dir"`
+
+	Passthrough passthroughConfig `yaml:"passthrough"`
+
+	// ControlAuth protects the load test endpoints; Limits caps each request.
+	ControlAuth controlAuthConfig `yaml:"control_auth"`
+	Limits      limitsConfig      `yaml:"limits"`
+}
+
+// Control endpoint authentication modes: none, a static bearer token, or an
+// OIDC ID token such as Google signs for service accounts.
+const (
+	controlAuthNone   = "none"
+	controlAuthBearer = "bearer"
+	controlAuthOIDC   = "oidc"
+)
+
+// controlAuthConfig selects how callers of /load-test and /generators are
+// authenticated.
+type controlAuthConfig struct {
+	Mode          string   `yaml:"mode"`
+	Token         string   `yaml:"token"`
+	TokenSecret   string   `yaml:"token_secret"`
+	Audience      string   `yaml:"audience"`
+	AllowedEmails []string `yaml:"allowed_emails"`
+	CertsURL      string   `yaml:"certs_url"`
+}
+
+// validate checks the mode is known and has what it needs. There is no
+// default: leaving the endpoints open must be asked for with mode none.
+func (a controlAuthConfig) validate() error {
+	switch a.Mode {
+	case "":
+		return fmt.Errorf("control auth mode must be set (mode or CONTROL_AUTH_MODE): bearer, oidc, or none to leave the control endpoints open")
+	case controlAuthNone:
+	case controlAuthBearer:
+		if a.Token == "" && a.TokenSecret == "" {
+			return fmt.Errorf("control auth mode bearer needs a token (token_secret/CONTROL_AUTH_TOKEN_SECRET or token/CONTROL_AUTH_TOKEN)")
+		}
+	case controlAuthOIDC:
+		if a.Audience == "" {
+			return fmt.Errorf("control auth mode oidc needs an audience (audience or CONTROL_AUTH_AUDIENCE)")
+		}
+		// Any Google account can get a token for the audience, so the callers must be listed.
+		if len(a.AllowedEmails) == 0 {
+			return fmt.Errorf("control auth mode oidc needs the allowed caller emails (allowed_emails or CONTROL_AUTH_ALLOWED_EMAILS)")
+		}
+	default:
+		return fmt.Errorf("unsupported control auth mode %q (supported: none, bearer, oidc)", a.Mode)
+	}
+	return nil
+}
+
+// resolveToken returns the bearer token, preferring Secret Manager so a reload
+// picks up the latest secret version.
+func (a controlAuthConfig) resolveToken(ctx context.Context) (string, error) {
+	if a.TokenSecret == "" {
+		return a.Token, nil
+	}
+	return getSecret(ctx, a.TokenSecret)
+}
+
+// limitsConfig caps what a single load test request may ask for; zero is
+// unlimited. MaxRequestBytes caps the size of any control or push request body.
+type limitsConfig struct {
+	MaxDevices      int           `yaml:"max_devices"`
+	MaxRateHz       float64       `yaml:"max_rate_hz"`
+	MaxDuration     time.Duration `yaml:"max_duration"`
+	MaxRequestBytes int64         `yaml:"max_request_bytes"`
+}
+
+// validate checks no limit is negative and request bodies are capped.
+func (l limitsConfig) validate() error {
+	if l.MaxDevices < 0 || l.MaxRateHz < 0 || l.MaxDuration < 0 {
+		return fmt.Errorf("load test limits must not be negative")
+	}
+	if l.MaxRequestBytes <= 0 {
+		return fmt.Errorf("max request bytes must be positive (max_request_bytes or MAX_REQUEST_BYTES)")
+	}
+	return nil
+}
+
+// requestLimits converts the limits for the handler.
+func (l limitsConfig) requestLimits() lib.RequestLimits {
+	return lib.RequestLimits{MaxDevices: l.MaxDevices, MaxRateHz: l.MaxRateHz, MaxDuration: l.MaxDuration}
+}
+
+// Pub/Sub passthrough modes: messages arrive by push to the HTTP endpoint, by
+// a pull subscriber, or both.
+const (
+	passthroughOff  = "off"
+	passthroughPush = "push"
+	passthroughPull = "pull"
+	passthroughBoth = "both"
+)
+
+// Push passthrough authentication: Pub/Sub's OIDC push token, or none.
+const (
+	pushAuthOIDC = "oidc"
+	pushAuthNone = "none"
+)
+
+// passthroughConfig selects how Pub/Sub messages are passed through to MQTT.
+// Push requests must carry an OIDC token for PushAudience from one of
+// PushServiceAccounts unless PushAuth is none; TopicPrefixes limit the MQTT
+// topics messages may be published to in every mode.
+type passthroughConfig struct {
+	Mode           string `yaml:"mode"`
+	ProjectID      string `yaml:"project_id"`
+	SubscriptionID string `yaml:"subscription_id"`
+	PushPath       string `yaml:"push_path"`
+
+	PushAuth            string   `yaml:"push_auth"`
+	PushAudience        string   `yaml:"push_audience"`
+	PushServiceAccounts []string `yaml:"push_service_accounts"`
+	TopicPrefixes       []string `yaml:"topic_prefixes"`
+}
+
+// push reports whether the push endpoint should be registered.
+func (p passthroughConfig) push() bool {
+	return p.Mode == passthroughPush || p.Mode == passthroughBoth
+}
+
+// pull reports whether the pull subscriber should be started.
+func (p passthroughConfig) pull() bool {
+	return p.Mode == passthroughPull || p.Mode == passthroughBoth
+}
+
+// validate checks the mode is known and a pull subscriber knows what to pull from.
+func (p passthroughConfig) validate() error {
+	switch p.Mode {
+	case passthroughOff, passthroughPush, passthroughPull, passthroughBoth:
+	default:
+		return fmt.Errorf("unsupported passthrough mode %q (supported: off, push, pull, both)", p.Mode)
+	}
+	if p.pull() && (p.ProjectID == "" || p.SubscriptionID == "") {
+		return fmt.Errorf("passthrough mode %s needs GCP_PROJECT_ID and PUBSUB_SUBSCRIPTION_ID", p.Mode)
+	}
+	switch p.PushAuth {
+	case pushAuthNone:
+	case pushAuthOIDC:
+		if p.push() && (p.PushAudience == "" || len(p.PushServiceAccounts) == 0) {
+			return fmt.Errorf("passthrough mode %s needs PASSTHROUGH_PUSH_AUDIENCE and PASSTHROUGH_PUSH_SERVICE_ACCOUNTS to verify push tokens (or push_auth: none)", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unsupported passthrough push auth %q (supported: oidc, none)", p.PushAuth)
+	}
+	return nil
+}
+
+// pushAuthenticator creates the verifier for push requests, or nil when they
+// are not authenticated.
+func (p passthroughConfig) pushAuthenticator() (lib.Authenticator, error) {
+	if p.PushAuth == pushAuthNone {
+		return nil, nil
+	}
+	return lib.NewOIDCVerifier(lib.OIDCOptions{
+		Audience:      p.PushAudience,
+		AllowedEmails: p.PushServiceAccounts,
+	})
+}
+
+// loadLoadgenConfig reads the config file at path (if any), applies environment
+// overrides and validates the result.
+func loadLoadgenConfig(path string) (*loadgenConfig, error) {
+	cfg := &loadgenConfig{
+		HTTPPort: "8080",
+		MQTTPort: "1883",
+
+		ShutdownTimeout: 30 * time.Second,
+		Passthrough: passthroughConfig{
+			Mode:     passthroughOff,
+			PushPath: "/passthrough",
+			PushAuth: pushAuthOIDC,
+		},
+		Limits: limitsConfig{
+			MaxRequestBytes: lib.DefaultMaxBodyBytes,
+		},
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read loadgen config: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse loadgen config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// applyEnv overrides the file configuration with any environment variables that are set.
+func (c *loadgenConfig) applyEnv() error {
+	setFromEnv(&c.LogLevel, "LOG_LEVEL")
+	setFromEnv(&c.HTTPPort, "PORT")
+	setFromEnv(&c.MQTTPort, "MQTT_PORT")
+	setFromEnv(&c.Username, "MQTT_USERNAME")
+	setFromEnv(&c.Password, "MQTT_PASSWORD")
+	setFromEnv(&c.PasswordSecret, "MQTT_PASS_SECRET_NAME")
+	setFromEnv(&c.IngestionTopic, "MQTT_TOPIC")
+	setListFromEnv(&c.ClientPasswordSecrets, "LOADTEST_CLIENT_PASSWORD_SECRETS")
+	setFromEnv(&c.RecordingsDir, "REPLAY_RECORDINGS_DIR")
+	setFromEnv(&c.Passthrough.Mode, "PASSTHROUGH_MODE")
+	setFromEnv(&c.Passthrough.ProjectID, "GCP_PROJECT_ID")
+	setFromEnv(&c.Passthrough.SubscriptionID, "PUBSUB_SUBSCRIPTION_ID")
+	setFromEnv(&c.Passthrough.PushPath, "PASSTHROUGH_PUSH_PATH")
+	setFromEnv(&c.Passthrough.PushAuth, "PASSTHROUGH_PUSH_AUTH")
+	setFromEnv(&c.Passthrough.PushAudience, "PASSTHROUGH_PUSH_AUDIENCE")
+	setListFromEnv(&c.Passthrough.PushServiceAccounts, "PASSTHROUGH_PUSH_SERVICE_ACCOUNTS")
+	setListFromEnv(&c.Passthrough.TopicPrefixes, "PASSTHROUGH_TOPIC_PREFIXES")
+	setFromEnv(&c.ControlAuth.Mode, "CONTROL_AUTH_MODE")
+	setFromEnv(&c.ControlAuth.Token, "CONTROL_AUTH_TOKEN")
+	setFromEnv(&c.ControlAuth.TokenSecret, "CONTROL_AUTH_TOKEN_SECRET")
+	setFromEnv(&c.ControlAuth.Audience, "CONTROL_AUTH_AUDIENCE")
+	setFromEnv(&c.ControlAuth.CertsURL, "CONTROL_AUTH_CERTS_URL")
+	setListFromEnv(&c.ControlAuth.AllowedEmails, "CONTROL_AUTH_ALLOWED_EMAILS")
+
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q: %w", v, err)
+		}
+		c.ShutdownTimeout = timeout
+	}
+	if v := os.Getenv("LOADTEST_MAX_DEVICES"); v != "" {
+		maxDevices, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid LOADTEST_MAX_DEVICES %q: %w", v, err)
+		}
+		c.Limits.MaxDevices = maxDevices
+	}
+	if v := os.Getenv("LOADTEST_MAX_RATE_HZ"); v != "" {
+		maxRate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid LOADTEST_MAX_RATE_HZ %q: %w", v, err)
+		}
+		c.Limits.MaxRateHz = maxRate
+	}
+	if v := os.Getenv("LOADTEST_MAX_DURATION"); v != "" {
+		maxDuration, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid LOADTEST_MAX_DURATION %q: %w", v, err)
+		}
+		c.Limits.MaxDuration = maxDuration
+	}
+	if v := os.Getenv("MAX_REQUEST_BYTES"); v != "" {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_REQUEST_BYTES %q: %w", v, err)
+		}
+		c.Limits.MaxRequestBytes = maxBytes
+	}
+
+	if aclPath := os.Getenv("MQTT_ACL_FILE"); aclPath != "" {
+		rules, err := loadACLRules(aclPath)
+		if err != nil {
+			return err
+		}
+		c.ACL = rules
+	}
+	return nil
+}
+
+// validate checks that the broker has credentials for the ingestion service.
+func (c *loadgenConfig) validate() error {
+	if c.Username == "" {
+		return fmt.Errorf("MQTT username must be set (username or MQTT_USERNAME)")
+	}
+	if c.Password == "" && c.PasswordSecret == "" {
+		return fmt.Errorf("MQTT password must be set (password_secret/MQTT_PASS_SECRET_NAME or password/MQTT_PASSWORD)")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must not be negative")
+	}
+	if err := c.ControlAuth.validate(); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	return c.Passthrough.validate()
+}
+
+// resolvePassword returns the MQTT password, preferring Secret Manager so a
+// reload picks up the latest secret version.
+func (c *loadgenConfig) resolvePassword(ctx context.Context) (string, error) {
+	if c.PasswordSecret == "" {
+		return c.Password, nil
+	}
+	return getSecret(ctx, c.PasswordSecret)
+}
+
+// aclRules returns the configured ACL or the defaults for the configured user.
+func (c *loadgenConfig) aclRules() []aclRule {
+	if len(c.ACL) > 0 {
+		return c.ACL
+	}
+	return defaultACLRules(c.Username)
+}
+
+// slogLevel maps the configured log level onto slog, defaulting to debug.
+func (c *loadgenConfig) slogLevel() slog.Level {
+	switch strings.ToLower(c.LogLevel) {
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// setFromEnv overwrites *target with the named environment variable when it is set.
+func setFromEnv(target *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*target = v
+	}
+}
+
+// setListFromEnv overwrites *target with the named comma-separated environment
+// variable when it is set.
+func setListFromEnv(target *[]string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*target = strings.Split(v, ",")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mochi/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clearLoadgenEnv unsets every environment variable loadLoadgenConfig reads, so
+// tests only see what they set themselves.
+func clearLoadgenEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{
+		"LOG_LEVEL", "PORT", "MQTT_PORT", "MQTT_USERNAME", "MQTT_PASSWORD", "MQTT_PASS_SECRET_NAME", "MQTT_ACL_FILE",
+		"PASSTHROUGH_MODE", "GCP_PROJECT_ID", "PUBSUB_SUBSCRIPTION_ID", "PASSTHROUGH_PUSH_PATH", "SHUTDOWN_TIMEOUT", "MQTT_TOPIC",
+		"CONTROL_AUTH_MODE", "CONTROL_AUTH_TOKEN", "CONTROL_AUTH_TOKEN_SECRET", "CONTROL_AUTH_AUDIENCE", "CONTROL_AUTH_CERTS_URL",
+		"CONTROL_AUTH_ALLOWED_EMAILS", "LOADTEST_MAX_DEVICES", "LOADTEST_MAX_RATE_HZ", "LOADTEST_MAX_DURATION", "MAX_REQUEST_BYTES",
+		"PASSTHROUGH_PUSH_AUTH", "PASSTHROUGH_PUSH_AUDIENCE", "PASSTHROUGH_PUSH_SERVICE_ACCOUNTS", "PASSTHROUGH_TOPIC_PREFIXES",
+		"LOADTEST_CLIENT_PASSWORD_SECRETS", "REPLAY_RECORDINGS_DIR",
+	} {
+		t.Setenv(key, "")
+	}
+}
+
+// TestLoadLoadgenConfigEnvOverridesFile verifies environment variables take
+// precedence over the config file.
+func TestLoadLoadgenConfigEnvOverridesFile(t *testing.T) {
+	// --- Arrange ---
+	path := filepath.Join(t.TempDir(), "loadgen.yaml")
+	content := `
+log_level: info
+mqtt_port: "1884"
+username: file-user
+password: file-pass
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	clearLoadgenEnv(t)
+	t.Setenv("MQTT_USERNAME", "env-user")
+	t.Setenv("CONTROL_AUTH_MODE", controlAuthNone)
+
+	// --- Act ---
+	cfg, err := loadLoadgenConfig(path)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, "env-user", cfg.Username)
+	assert.Equal(t, "1884", cfg.MQTTPort)
+	assert.Equal(t, "8080", cfg.HTTPPort)
+	password, err := cfg.resolvePassword(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "file-pass", password)
+	assert.Equal(t, defaultACLRules("env-user"), cfg.aclRules())
+}
+
+// TestLoadLoadgenConfigRequiresPassword verifies a config without any password source is rejected.
+func TestLoadLoadgenConfigRequiresPassword(t *testing.T) {
+	// --- Arrange ---
+	clearLoadgenEnv(t)
+	t.Setenv("MQTT_USERNAME", "sreceiver")
+
+	// --- Act ---
+	_, err := loadLoadgenConfig("")
+
+	// --- Assert ---
+	assert.ErrorContains(t, err, "password")
+}
+
+// TestLoadLoadgenConfigShutdownTimeout verifies the drain timeout defaults,
+// reads from the file and can be overridden from the environment.
+func TestLoadLoadgenConfigShutdownTimeout(t *testing.T) {
+	// --- Arrange ---
+	path := filepath.Join(t.TempDir(), "loadgen.yaml")
+	content := `
+username: file-user
+password: file-pass
+shutdown_timeout: 10s
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	clearLoadgenEnv(t)
+	t.Setenv("MQTT_USERNAME", "env-user")
+	t.Setenv("MQTT_PASSWORD", "env-pass")
+	t.Setenv("CONTROL_AUTH_MODE", controlAuthNone)
+
+	// --- Act ---
+	defaults, defaultsErr := loadLoadgenConfig("")
+	fromFile, fileErr := loadLoadgenConfig(path)
+	t.Setenv("SHUTDOWN_TIMEOUT", "2m")
+	fromEnv, envErr := loadLoadgenConfig(path)
+	t.Setenv("SHUTDOWN_TIMEOUT", "soon")
+	_, badErr := loadLoadgenConfig(path)
+
+	// --- Assert ---
+	require.NoError(t, defaultsErr)
+	assert.Equal(t, 30*time.Second, defaults.ShutdownTimeout)
+	require.NoError(t, fileErr)
+	assert.Equal(t, 10*time.Second, fromFile.ShutdownTimeout)
+	require.NoError(t, envErr)
+	assert.Equal(t, 2*time.Minute, fromEnv.ShutdownTimeout)
+	assert.ErrorContains(t, badErr, "SHUTDOWN_TIMEOUT")
+}
+
+// TestPassthroughConfigModes verifies which passthrough parts each mode enables
+// and that pull modes need a subscription.
+func TestPassthroughConfigModes(t *testing.T) {
+	testCases := []struct {
+		mode    string
+		push    bool
+		pull    bool
+		wantErr bool
+	}{
+		{passthroughOff, false, false, false},
+		{passthroughPush, true, false, false},
+		{passthroughPull, false, true, false},
+		{passthroughBoth, true, true, false},
+		{"sideways", false, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			cfg := passthroughConfig{Mode: tc.mode, ProjectID: "test-project", SubscriptionID: "mqtt-passthrough", PushAuth: pushAuthNone}
+
+			assert.Equal(t, tc.push, cfg.push())
+			assert.Equal(t, tc.pull, cfg.pull())
+			if tc.wantErr {
+				assert.Error(t, cfg.validate())
+			} else {
+				assert.NoError(t, cfg.validate())
+			}
+		})
+	}
+
+	assert.Error(t, passthroughConfig{Mode: passthroughPull, PushAuth: pushAuthNone}.validate(), "pull needs a project and subscription")
+}
+
+// TestLoadLoadgenConfigPushAuth verifies push passthrough verifies tokens by
+// default and needs to know whose tokens to accept.
+func TestLoadLoadgenConfigPushAuth(t *testing.T) {
+	// --- Arrange ---
+	clearLoadgenEnv(t)
+	t.Setenv("MQTT_USERNAME", "env-user")
+	t.Setenv("MQTT_PASSWORD", "env-pass")
+	t.Setenv("PASSTHROUGH_MODE", passthroughPush)
+	t.Setenv("CONTROL_AUTH_MODE", controlAuthNone)
+
+	// --- Act ---
+	_, unverifiedErr := loadLoadgenConfig("")
+	t.Setenv("PASSTHROUGH_PUSH_AUDIENCE", "https://loadgen.example.com/passthrough")
+	t.Setenv("PASSTHROUGH_PUSH_SERVICE_ACCOUNTS", "push@project.iam.gserviceaccount.com,backup@project.iam.gserviceaccount.com")
+	t.Setenv("PASSTHROUGH_TOPIC_PREFIXES", "devices/,commands/")
+	verified, verifiedErr := loadLoadgenConfig("")
+	t.Setenv("PASSTHROUGH_PUSH_AUTH", "maybe")
+	_, badAuthErr := loadLoadgenConfig("")
+
+	// --- Assert ---
+	assert.ErrorContains(t, unverifiedErr, "PASSTHROUGH_PUSH_AUDIENCE")
+	require.NoError(t, verifiedErr)
+	assert.Equal(t, pushAuthOIDC, verified.Passthrough.PushAuth)
+	assert.Len(t, verified.Passthrough.PushServiceAccounts, 2)
+	assert.Equal(t, []string{"devices/", "commands/"}, verified.Passthrough.TopicPrefixes)
+	pushAuth, err := verified.Passthrough.pushAuthenticator()
+	require.NoError(t, err)
+	assert.NotNil(t, pushAuth)
+	assert.ErrorContains(t, badAuthErr, "unsupported passthrough push auth")
+}
+
+// TestLoadLoadgenConfigControlAuthAndLimits verifies control authentication
+// and request limits are read from the file and the environment.
+func TestLoadLoadgenConfigControlAuthAndLimits(t *testing.T) {
+	// --- Arrange ---
+	path := filepath.Join(t.TempDir(), "loadgen.yaml")
+	content := `
+username: file-user
+password: file-pass
+control_auth:
+  mode: oidc
+  audience: https://loadgen.example.com
+  allowed_emails: [scheduler@project.iam.gserviceaccount.com]
+limits:
+  max_devices: 5000
+  max_rate_hz: 2500
+  max_duration: 30m
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	clearLoadgenEnv(t)
+
+	// --- Act ---
+	defaults, defaultsErr := loadLoadgenConfig(path)
+	t.Setenv("CONTROL_AUTH_MODE", "bearer")
+	t.Setenv("CONTROL_AUTH_TOKEN", "s3cret")
+	t.Setenv("LOADTEST_MAX_DURATION", "5m")
+	fromEnv, envErr := loadLoadgenConfig(path)
+	t.Setenv("CONTROL_AUTH_TOKEN", "")
+	_, noTokenErr := loadLoadgenConfig(path)
+	t.Setenv("CONTROL_AUTH_MODE", "password")
+	_, badModeErr := loadLoadgenConfig(path)
+	t.Setenv("CONTROL_AUTH_MODE", "")
+	t.Setenv("LOADTEST_MAX_RATE_HZ", "-1")
+	_, negativeErr := loadLoadgenConfig(path)
+	t.Setenv("LOADTEST_MAX_RATE_HZ", "")
+	t.Setenv("MAX_REQUEST_BYTES", "0")
+	_, uncappedErr := loadLoadgenConfig(path)
+
+	// --- Assert ---
+	require.NoError(t, defaultsErr)
+	assert.Equal(t, controlAuthOIDC, defaults.ControlAuth.Mode)
+	assert.Equal(t, []string{"scheduler@project.iam.gserviceaccount.com"}, defaults.ControlAuth.AllowedEmails)
+	assert.Equal(t, 5000, defaults.Limits.MaxDevices)
+	assert.Equal(t, 30*time.Minute, defaults.Limits.requestLimits().MaxDuration)
+	assert.Equal(t, lib.DefaultMaxBodyBytes, defaults.Limits.MaxRequestBytes)
+
+	require.NoError(t, envErr)
+	assert.Equal(t, controlAuthBearer, fromEnv.ControlAuth.Mode)
+	token, err := fromEnv.ControlAuth.resolveToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", token)
+	assert.Equal(t, 5*time.Minute, fromEnv.Limits.MaxDuration)
+	assert.Equal(t, 2500.0, fromEnv.Limits.MaxRateHz)
+
+	assert.ErrorContains(t, noTokenErr, "needs a token")
+	assert.ErrorContains(t, badModeErr, "unsupported control auth mode")
+	assert.ErrorContains(t, negativeErr, "must not be negative")
+	assert.ErrorContains(t, uncappedErr, "MAX_REQUEST_BYTES")
+}
+
+// TestControlAuthConfigOIDCNeedsAllowedEmails verifies oidc mode does not
+// accept any caller that can get a token for the audience.
+func TestControlAuthConfigOIDCNeedsAllowedEmails(t *testing.T) {
+	cfg := controlAuthConfig{Mode: controlAuthOIDC, Audience: "https://loadgen.example.com"}
+
+	assert.ErrorContains(t, cfg.validate(), "CONTROL_AUTH_ALLOWED_EMAILS")
+
+	cfg.AllowedEmails = []string{"scheduler@project.iam.gserviceaccount.com"}
+	assert.NoError(t, cfg.validate())
+}
+
+// TestLoadLoadgenConfigRequiresControlAuthMode verifies the control endpoints
+// are only left open when mode none is asked for.
+func TestLoadLoadgenConfigRequiresControlAuthMode(t *testing.T) {
+	// --- Arrange ---
+	clearLoadgenEnv(t)
+	t.Setenv("MQTT_USERNAME", "env-user")
+	t.Setenv("MQTT_PASSWORD", "env-pass")
+
+	// --- Act ---
+	_, unsetErr := loadLoadgenConfig("")
+	t.Setenv("CONTROL_AUTH_MODE", controlAuthNone)
+	open, openErr := loadLoadgenConfig("")
+
+	// --- Assert ---
+	assert.ErrorContains(t, unsetErr, "CONTROL_AUTH_MODE")
+	require.NoError(t, openErr)
+	assert.Equal(t, controlAuthNone, open.ControlAuth.Mode)
+}
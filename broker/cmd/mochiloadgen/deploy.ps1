@@ -35,6 +35,8 @@ $vmInstanceName = "mochi-test-vm-$(Get-Date -Format 'yyyyMMdd-HHmmss')"
 $sa_email = "$($serviceAccountName)@$($projectId).iam.gserviceaccount.com"
 $imageUri = "$($region)-docker.pkg.dev/$($projectId)/$($arRepo)/$($imageName):latest"
 $secretName = "projects/$($projectId)/secrets/SERVICE_PASS/versions/latest"
+$controlTokenSecretId = "LOADGEN_CONTROL_TOKEN"
+$controlTokenSecret = "projects/$($projectId)/secrets/$($controlTokenSecretId)/versions/latest"
 
 Write-Host "### Creating GCE instance '$($vmInstanceName)' and deploying container... ###"
 gcloud compute instances create-with-container $vmInstanceName `
@@ -45,11 +47,14 @@ gcloud compute instances create-with-container $vmInstanceName `
     --tags=$networkTagMochi `
     --scopes=https://www.googleapis.com/auth/cloud-platform `
     --container-image=$imageUri `
-    --container-env="MQTT_USERNAME=sreceiver,MQTT_PASS_SECRET_NAME=$($secretName)" `
+    --container-env="MQTT_USERNAME=sreceiver,MQTT_PASS_SECRET_NAME=$($secretName),CONTROL_AUTH_MODE=bearer,CONTROL_AUTH_TOKEN_SECRET=$($controlTokenSecret)" `
     --container-restart-policy=always
 
 # --- 4. Provide Instructions ---
 $VM_IP = $(gcloud compute instances describe $vmInstanceName --project=$projectId --zone=$zone --format='get(networkInterfaces[0].networkIP)')
 Write-Host "`n✅ Deployment Complete: VM '$($vmInstanceName)' is running at internal IP ${VM_IP}." -ForegroundColor Green
 Write-Host "`n### To trigger the test from Cloud Shell, first start the IAP tunnel in a new terminal: ###" -ForegroundColor Cyan
-Write-Host "gcloud compute start-iap-tunnel $($vmInstanceName) 8080 --local-host-port=localhost:8080 --zone=$($zone) --project=$($projectId)"
\ No newline at end of file
+Write-Host "gcloud compute start-iap-tunnel $($vmInstanceName) 8080 --local-host-port=localhost:8080 --zone=$($zone) --project=$($projectId)"
+Write-Host "`n### Then send requests with the control token: ###" -ForegroundColor Cyan
+Write-Host "`$token = gcloud secrets versions access latest --secret=$($controlTokenSecretId) --project=$($projectId)"
+Write-Host "curl -X POST -H `"Authorization: Bearer `$token`" -H `"Content-Type: application/json`" -d '@payload.json' http://localhost:8080/load-test"
\ No newline at end of file
@@ -0,0 +1,380 @@
+package lib
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleCertsURL is where Google publishes the keys that sign its ID tokens.
+const GoogleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// GoogleIssuers are the issuers of Google-signed ID tokens.
+var GoogleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+const (
+	// keyRefresh is how long fetched signing keys are used before they are
+	// fetched again.
+	keyRefresh = time.Hour
+	// keyRefetchBackoff is the least time between key fetches, whether triggered
+	// by a token signed with an unknown key or retrying a failed fetch, so bad
+	// tokens cannot hammer the key endpoint.
+	keyRefetchBackoff = time.Minute
+	// clockSkew is how far token times may be off from the local clock.
+	clockSkew = time.Minute
+)
+
+// ErrUnauthenticated is returned when a request carries no usable credentials.
+var ErrUnauthenticated = errors.New("missing or malformed bearer token")
+
+// Authenticator checks the credentials on an HTTP request.
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+// RequireAuth wraps next so only requests auth accepts reach it; the rest get
+// a 401. A nil auth lets every request through.
+func RequireAuth(auth Authenticator, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.Authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="loadgen"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrUnauthenticated
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// TokenAuth accepts requests that carry a static bearer token. The token can
+// be replaced while the server runs, e.g. when its secret is rotated.
+type TokenAuth struct {
+	mu    sync.RWMutex
+	token []byte
+}
+
+// NewTokenAuth creates a TokenAuth for token.
+func NewTokenAuth(token string) *TokenAuth {
+	return &TokenAuth{token: []byte(token)}
+}
+
+// Update replaces the accepted token.
+func (a *TokenAuth) Update(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = []byte(token)
+}
+
+// Authenticate checks the request's bearer token in constant time.
+func (a *TokenAuth) Authenticate(r *http.Request) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return fmt.Errorf("invalid bearer token")
+	}
+	return nil
+}
+
+// IDTokenClaims are the ID token claims the verifier checks.
+type IDTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Audience      audience `json:"aud"`
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	IssuedAt      int64    `json:"iat"`
+	ExpiresAt     int64    `json:"exp"`
+}
+
+// audience is a token's aud claim, which may be a string or a list.
+type audience []string
+
+// UnmarshalJSON accepts either form of the aud claim.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("aud must be a string or a list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// OIDCOptions configures an OIDCVerifier.
+type OIDCOptions struct {
+	// Audience is the aud a token must carry, normally the URL of the service.
+	Audience string
+	// Issuers are the accepted iss values; Google's when empty.
+	Issuers []string
+	// AllowedEmails, when set, limits tokens to these verified emails, e.g.
+	// the service accounts allowed to call.
+	AllowedEmails []string
+	// CertsURL serves the signing keys as a JWK set; Google's when empty.
+	CertsURL string
+	// HTTPClient fetches the keys; http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// OIDCVerifier accepts requests carrying an RS256-signed OIDC ID token, such
+// as the Google-signed tokens Cloud Scheduler, Pub/Sub push and
+// `gcloud auth print-identity-token` send.
+type OIDCVerifier struct {
+	audience      string
+	issuers       []string
+	allowedEmails []string
+	keys          *keySet
+	now           func() time.Time
+}
+
+// NewOIDCVerifier creates a verifier for tokens issued to opts.Audience.
+func NewOIDCVerifier(opts OIDCOptions) (*OIDCVerifier, error) {
+	if opts.Audience == "" {
+		return nil, fmt.Errorf("OIDC verification needs an audience")
+	}
+	issuers := opts.Issuers
+	if len(issuers) == 0 {
+		issuers = GoogleIssuers
+	}
+	certsURL := opts.CertsURL
+	if certsURL == "" {
+		certsURL = GoogleCertsURL
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OIDCVerifier{
+		audience:      opts.Audience,
+		issuers:       issuers,
+		allowedEmails: opts.AllowedEmails,
+		keys:          &keySet{url: certsURL, client: client},
+		now:           time.Now,
+	}, nil
+}
+
+// Authenticate verifies the request's bearer token.
+func (v *OIDCVerifier) Authenticate(r *http.Request) error {
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	_, err = v.Verify(r.Context(), token)
+	return err
+}
+
+// Verify checks token's signature, issuer, audience, lifetime and, when
+// allowed emails are configured, its verified email. It returns the claims of
+// a valid token.
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (*IDTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid ID token signature")
+	}
+
+	var claims IDTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	if !slices.Contains(v.issuers, claims.Issuer) {
+		return nil, fmt.Errorf("ID token issuer %q is not accepted", claims.Issuer)
+	}
+	if !slices.Contains(claims.Audience, v.audience) {
+		return nil, fmt.Errorf("ID token audience %v does not include %q", []string(claims.Audience), v.audience)
+	}
+	now := v.now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, fmt.Errorf("ID token is not valid yet")
+	}
+	if len(v.allowedEmails) > 0 {
+		if !claims.EmailVerified || !slices.Contains(v.allowedEmails, claims.Email) {
+			return nil, fmt.Errorf("ID token email %q is not allowed", claims.Email)
+		}
+	}
+	return &claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into v.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// keySet caches the RSA keys published as a JWK set at url. Keys are fetched
+// on first use, again once they are keyRefresh old, and early when a token
+// names a key that is not in the set, as happens after a key rotation. Fetches
+// are at least keyRefetchBackoff apart whether or not they succeed, so bad
+// tokens cannot make every request wait on the issuer.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	fetchErr  error
+	// fetching is closed when the fetch in progress, if any, finishes.
+	fetching chan struct{}
+}
+
+// key returns the key with ID kid, fetching the set if needed. The lock is not
+// held during the fetch; callers arriving meanwhile wait for its result.
+func (k *keySet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	for {
+		k.mu.Lock()
+		key, ok := k.keys[kid]
+		if !k.needsFetch(ok) {
+			err := k.fetchErr
+			k.mu.Unlock()
+			switch {
+			case ok:
+				// Keep using keys we already have rather than fail every request.
+				return key, nil
+			case k.keys == nil && err != nil:
+				return nil, err
+			default:
+				return nil, fmt.Errorf("ID token signed with unknown key %q", kid)
+			}
+		}
+		if fetching := k.fetching; fetching != nil {
+			k.mu.Unlock()
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		fetching := make(chan struct{})
+		k.fetching = fetching
+		k.mu.Unlock()
+
+		keys, err := k.fetch(ctx)
+
+		k.mu.Lock()
+		// A caller giving up is not the issuer failing, so it does not start
+		// the backoff; whoever waited on this fetch tries again.
+		if ctx.Err() == nil {
+			k.attempted, k.fetchErr = time.Now(), err
+			if err == nil {
+				k.keys, k.fetched = keys, k.attempted
+			}
+		}
+		k.fetching = nil
+		close(fetching)
+		k.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// needsFetch reports whether the set should be fetched for a key that ok says
+// is or is not cached. It must be called with mu held.
+func (k *keySet) needsFetch(ok bool) bool {
+	if !k.attempted.IsZero() && time.Since(k.attempted) < keyRefetchBackoff {
+		return false
+	}
+	return !ok || time.Since(k.fetched) >= keyRefresh
+}
+
+// fetch downloads and parses the JWK set.
+func (k *keySet) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing key request: %w", err)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch signing keys from %s: %s", k.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("malformed signing key %q", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
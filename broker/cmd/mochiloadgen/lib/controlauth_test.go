@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer signs ID tokens with a locally generated key and serves the
+// matching JWK set, standing in for Google's token issuer.
+type testIssuer struct {
+	key     *rsa.PrivateKey
+	kid     string
+	url     string
+	fetches atomic.Int32
+}
+
+// newTestIssuer generates a signing key and serves its JWK set until the test ends.
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer := &testIssuer{key: key, kid: "test-key"}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": issuer.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(srv.Close)
+	issuer.url = srv.URL
+	return issuer
+}
+
+// claims returns valid Google-style claims for audience, which tests then alter.
+func (i *testIssuer) claims(audience string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"sub":            "1234567890",
+		"email":          "scheduler@project.iam.gserviceaccount.com",
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+// sign returns claims as an RS256 token signed with kid.
+func (i *testIssuer) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestOIDCVerifierVerify checks the signature, issuer, audience, lifetime and
+// email of ID tokens signed with a local key.
+func TestOIDCVerifierVerify(t *testing.T) {
+	// --- Arrange ---
+	issuer := newTestIssuer(t)
+	const aud = "https://loadgen.example.com"
+	verifier, err := NewOIDCVerifier(OIDCOptions{
+		Audience:      aud,
+		AllowedEmails: []string{"scheduler@project.iam.gserviceaccount.com"},
+		CertsURL:      issuer.url,
+	})
+	require.NoError(t, err)
+	other := newTestIssuer(t)
+
+	testCases := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{
+			name:  "valid token",
+			token: func() string { return issuer.sign(t, issuer.kid, issuer.claims(aud)) },
+		},
+		{
+			name: "audience list",
+			token: func() string {
+				claims := issuer.claims(aud)
+				claims["aud"] = []string{"other", aud}
+				return issuer.sign(t, issuer.kid, claims)
+			},
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				return issuer.sign(t, issuer.kid, issuer.claims("https://other.example.com"))
+			},
+			wantErr: "audience",
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := issuer.claims(aud)
+				claims["iss"] = "https://evil.example.com"
+				return issuer.sign(t, issuer.kid, claims)
+			},
+			wantErr: "issuer",
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := issuer.claims(aud)
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return issuer.sign(t, issuer.kid, claims)
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "email not allowed",
+			token: func() string {
+				claims := issuer.claims(aud)
+				claims["email"] = "intruder@example.com"
+				return issuer.sign(t, issuer.kid, claims)
+			},
+			wantErr: "not allowed",
+		},
+		{
+			name: "email not verified",
+			token: func() string {
+				claims := issuer.claims(aud)
+				claims["email_verified"] = false
+				return issuer.sign(t, issuer.kid, claims)
+			},
+			wantErr: "not allowed",
+		},
+		{
+			name:    "signed by another key",
+			token:   func() string { return other.sign(t, issuer.kid, issuer.claims(aud)) },
+			wantErr: "signature",
+		},
+		{
+			name:    "unknown key",
+			token:   func() string { return issuer.sign(t, "rotated-key", issuer.claims(aud)) },
+			wantErr: "unknown key",
+		},
+		{
+			name:    "malformed",
+			token:   func() string { return "not-a-token" },
+			wantErr: "malformed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			claims, err := verifier.Verify(context.Background(), tc.token())
+
+			// --- Assert ---
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "scheduler@project.iam.gserviceaccount.com", claims.Email)
+		})
+	}
+	assert.Equal(t, int32(1), issuer.fetches.Load(), "keys should be cached, and unknown keys not refetched within the backoff")
+}
+
+// TestKeySetSharesAndBacksOffFailedFetches verifies concurrent lookups share
+// one fetch, and that a failed fetch is not retried within the backoff.
+func TestKeySetSharesAndBacksOffFailedFetches(t *testing.T) {
+	// --- Arrange ---
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	keys := &keySet{url: srv.URL, client: srv.Client()}
+
+	// --- Act ---
+	const callers = 10
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := keys.key(context.Background(), "test-key")
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return fetches.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	var failed []error
+	for i := 0; i < callers; i++ {
+		failed = append(failed, <-errs)
+	}
+	_, laterErr := keys.key(context.Background(), "test-key")
+
+	// --- Assert ---
+	for _, err := range failed {
+		assert.ErrorContains(t, err, "503")
+	}
+	assert.ErrorContains(t, laterErr, "503", "the failure is reported until the backoff passes")
+	assert.Equal(t, int32(1), fetches.Load(), "callers should share one fetch and not retry within the backoff")
+}
+
+// TestRequireAuth verifies unauthenticated requests are rejected with a 401
+// before they reach the wrapped handler.
+func TestRequireAuth(t *testing.T) {
+	// --- Arrange ---
+	handled := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+		w.WriteHeader(http.StatusAccepted)
+	})
+	tokenAuth := NewTokenAuth("s3cret")
+	protected := RequireAuth(tokenAuth, next)
+
+	testCases := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "no header", wantStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", authorization: "Basic s3cret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "right token", authorization: "Bearer s3cret", wantStatus: http.StatusAccepted},
+		{name: "scheme is case insensitive", authorization: "bearer s3cret", wantStatus: http.StatusAccepted},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			req := httptest.NewRequest(http.MethodPost, "/load-test", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			protected.ServeHTTP(rec, req)
+
+			// --- Assert ---
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			if tc.wantStatus == http.StatusUnauthorized {
+				assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+	assert.Equal(t, 2, handled)
+
+	// A rotated token replaces the old one.
+	tokenAuth.Update("rotated")
+	req := httptest.NewRequest(http.MethodPost, "/load-test", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	protected.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Without an authenticator every request gets through.
+	rec = httptest.NewRecorder()
+	RequireAuth(nil, next).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/load-test", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+}
@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// Defaults for fault injection.
+const (
+	defaultSequenceField  = "sequence"
+	defaultTimestampField = "timestamp"
+	defaultOversizedBytes = 256 * 1024
+)
+
+// FaultOptions injects bad device behaviour into a fleet's traffic. Each
+// percentage is the chance, per message, of that fault. Sequence and
+// timestamp faults only apply to JSON object payloads that have the field.
+type FaultOptions struct {
+	MalformedPercent     float64 `json:"malformed_percent,omitempty"`
+	TruncatedPercent     float64 `json:"truncated_percent,omitempty"`
+	DuplicatePercent     float64 `json:"duplicate_percent,omitempty"`
+	OutOfOrderPercent    float64 `json:"out_of_order_percent,omitempty"`
+	SequenceResetPercent float64 `json:"sequence_reset_percent,omitempty"`
+	ClockSkewPercent     float64 `json:"clock_skew_percent,omitempty"`
+	ClockSkewSeconds     float64 `json:"clock_skew_seconds,omitempty"`
+	OversizedPercent     float64 `json:"oversized_percent,omitempty"`
+	OversizedBytes       int     `json:"oversized_bytes,omitempty"`
+
+	SequenceField  string `json:"sequence_field,omitempty"`
+	TimestampField string `json:"timestamp_field,omitempty"`
+}
+
+// validate checks percentages are in range and skew has a size.
+func (o *FaultOptions) validate() error {
+	for name, pct := range map[string]float64{
+		"malformed_percent":      o.MalformedPercent,
+		"truncated_percent":      o.TruncatedPercent,
+		"duplicate_percent":      o.DuplicatePercent,
+		"out_of_order_percent":   o.OutOfOrderPercent,
+		"sequence_reset_percent": o.SequenceResetPercent,
+		"clock_skew_percent":     o.ClockSkewPercent,
+		"oversized_percent":      o.OversizedPercent,
+	} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("fault %s must be between 0 and 100", name)
+		}
+	}
+	if o.MalformedPercent+o.TruncatedPercent > 100 {
+		return fmt.Errorf("fault malformed_percent and truncated_percent must add up to at most 100")
+	}
+	if o.ClockSkewPercent > 0 && o.ClockSkewSeconds <= 0 {
+		return fmt.Errorf("fault clock_skew_percent needs a positive clock_skew_seconds")
+	}
+	if o.OversizedBytes < 0 {
+		return fmt.Errorf("fault oversized_bytes must not be negative")
+	}
+	return nil
+}
+
+// FaultCounts is the faults section of a job's status.
+type FaultCounts struct {
+	Malformed     int64 `json:"malformed"`
+	Truncated     int64 `json:"truncated"`
+	Duplicated    int64 `json:"duplicated"`
+	OutOfOrder    int64 `json:"out_of_order"`
+	SequenceReset int64 `json:"sequence_reset"`
+	ClockSkewed   int64 `json:"clock_skewed"`
+	Oversized     int64 `json:"oversized"`
+}
+
+// FaultCounters counts the faults injected across a job.
+type FaultCounters struct {
+	malformed     atomic.Int64
+	truncated     atomic.Int64
+	duplicated    atomic.Int64
+	outOfOrder    atomic.Int64
+	sequenceReset atomic.Int64
+	clockSkewed   atomic.Int64
+	oversized     atomic.Int64
+}
+
+// Counts returns a snapshot of the counters.
+func (c *FaultCounters) Counts() FaultCounts {
+	return FaultCounts{
+		Malformed:     c.malformed.Load(),
+		Truncated:     c.truncated.Load(),
+		Duplicated:    c.duplicated.Load(),
+		OutOfOrder:    c.outOfOrder.Load(),
+		SequenceReset: c.sequenceReset.Load(),
+		ClockSkewed:   c.clockSkewed.Load(),
+		Oversized:     c.oversized.Load(),
+	}
+}
+
+// ReportStatus adds the fault counts to a job's status.
+func (c *FaultCounters) ReportStatus(status *JobStatus) {
+	counts := c.Counts()
+	status.Faults = &counts
+}
+
+// faultGenerator wraps a device's generator and corrupts some of its payloads.
+// A duplicate re-sends the previous payload byte for byte in place of a new one.
+type faultGenerator struct {
+	inner  loadgen.PayloadGenerator
+	opts   FaultOptions
+	counts *FaultCounters
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	last      []byte
+	seqOffset int64
+}
+
+// newFaultGenerator wraps inner with the fleet's fault options.
+func newFaultGenerator(inner loadgen.PayloadGenerator, opts FaultOptions, counts *FaultCounters, seed int64) *faultGenerator {
+	if opts.SequenceField == "" {
+		opts.SequenceField = defaultSequenceField
+	}
+	if opts.TimestampField == "" {
+		opts.TimestampField = defaultTimestampField
+	}
+	if opts.OversizedBytes == 0 {
+		opts.OversizedBytes = defaultOversizedBytes
+	}
+	return &faultGenerator{inner: inner, opts: opts, counts: counts, rng: rand.New(rand.NewSource(seed))}
+}
+
+// ValidateDeviceID defers to the wrapped generator.
+func (g *faultGenerator) ValidateDeviceID(id string) error {
+	return validateDeviceID(g.inner, id)
+}
+
+// GeneratePayload generates the next payload and applies any faults rolled for it.
+func (g *faultGenerator) GeneratePayload(device *loadgen.Device) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.last != nil && g.roll(g.opts.DuplicatePercent) {
+		g.counts.duplicated.Add(1)
+		return g.last, nil
+	}
+
+	payload, err := g.inner.GeneratePayload(device)
+	if err != nil {
+		return nil, err
+	}
+	payload = g.applyFieldFaults(payload)
+	if g.roll(g.opts.OversizedPercent) {
+		payload = g.oversize(payload)
+	}
+
+	// Malformed and truncated payloads are exclusive: one roll picks at most one.
+	roll := g.rng.Float64() * 100
+	switch {
+	case roll < g.opts.MalformedPercent:
+		g.counts.malformed.Add(1)
+		payload = malform(payload)
+	case roll < g.opts.MalformedPercent+g.opts.TruncatedPercent && len(payload) > 1:
+		g.counts.truncated.Add(1)
+		payload = append([]byte(nil), payload[:1+g.rng.Intn(len(payload)-1)]...)
+	}
+
+	g.last = payload
+	return payload, nil
+}
+
+// roll reports whether a fault with the given percentage happens.
+func (g *faultGenerator) roll(percent float64) bool {
+	return percent > 0 && g.rng.Float64()*100 < percent
+}
+
+// applyFieldFaults applies the sequence and timestamp faults to a JSON object payload.
+func (g *faultGenerator) applyFieldFaults(payload []byte) []byte {
+	if g.opts.OutOfOrderPercent == 0 && g.opts.SequenceResetPercent == 0 && g.seqOffset == 0 && g.opts.ClockSkewPercent == 0 {
+		return payload
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		return payload
+	}
+	changed := false
+
+	if n, ok := fields[g.opts.SequenceField].(json.Number); ok {
+		if seq, err := n.Int64(); err == nil {
+			if g.roll(g.opts.SequenceResetPercent) {
+				g.counts.sequenceReset.Add(1)
+				g.seqOffset = seq - 1
+			}
+			seq -= g.seqOffset
+			if g.roll(g.opts.OutOfOrderPercent) {
+				g.counts.outOfOrder.Add(1)
+				seq -= int64(2 + g.rng.Intn(4))
+			}
+			fields[g.opts.SequenceField] = seq
+			changed = true
+		}
+	}
+
+	if ts, ok := fields[g.opts.TimestampField]; ok && g.roll(g.opts.ClockSkewPercent) {
+		skew := time.Duration((g.rng.Float64()*2 - 1) * g.opts.ClockSkewSeconds * float64(time.Second))
+		if skewed, ok := skewTimestamp(ts, skew); ok {
+			g.counts.clockSkewed.Add(1)
+			fields[g.opts.TimestampField] = skewed
+			changed = true
+		}
+	}
+
+	if !changed {
+		return payload
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return out
+}
+
+// oversize pads a JSON object payload, or any other payload, to at least OversizedBytes.
+func (g *faultGenerator) oversize(payload []byte) []byte {
+	need := g.opts.OversizedBytes - len(payload)
+	if need <= 0 {
+		return payload
+	}
+	g.counts.oversized.Add(1)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err == nil && fields != nil {
+		padding, _ := json.Marshal(strings.Repeat("x", need))
+		fields["padding"] = padding
+		if out, err := json.Marshal(fields); err == nil {
+			return out
+		}
+	}
+	return append(append([]byte(nil), payload...), bytes.Repeat([]byte("x"), need)...)
+}
+
+// malform breaks a payload's JSON syntax.
+func malform(payload []byte) []byte {
+	if i := bytes.IndexByte(payload, ':'); i >= 0 {
+		out := append([]byte(nil), payload...)
+		out[i] = '='
+		return out
+	}
+	return append([]byte("{"), payload...)
+}
+
+// skewTimestamp shifts an RFC 3339 string or a Unix timestamp (seconds or
+// milliseconds) by skew.
+func skewTimestamp(v any, skew time.Duration) (any, bool) {
+	switch ts := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return nil, false
+		}
+		return t.Add(skew).Format(time.RFC3339Nano), true
+	case json.Number:
+		n, err := ts.Int64()
+		if err != nil {
+			return nil, false
+		}
+		if n > 1e12 {
+			return n + skew.Milliseconds(), true
+		}
+		return n + int64(skew.Seconds()), true
+	default:
+		return nil, false
+	}
+}
+
+// InjectFaults wraps every device's generator with the fault options.
+func InjectFaults(devices []*loadgen.Device, opts FaultOptions, counts *FaultCounters, rng *rand.Rand) {
+	for _, device := range devices {
+		device.PayloadGenerator = newFaultGenerator(device.PayloadGenerator, opts, counts, rng.Int63())
+	}
+}
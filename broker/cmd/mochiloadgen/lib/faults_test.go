@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// faultTestDevice returns a device whose template payload has a sequence and a timestamp.
+func faultTestDevice(t *testing.T) *loadgen.Device {
+	t.Helper()
+	generator, err := NewTemplatePayloadGenerator(json.RawMessage(`{"de": "{{device_id}}", "sequence": "{{seq}}", "timestamp": "{{timestamp}}"}`))
+	require.NoError(t, err)
+	return &loadgen.Device{ID: "garden-00001", PayloadGenerator: generator}
+}
+
+// generate returns n payloads from device.
+func generate(t *testing.T, device *loadgen.Device, n int) [][]byte {
+	t.Helper()
+	var payloads [][]byte
+	for i := 0; i < n; i++ {
+		payload, err := device.PayloadGenerator.GeneratePayload(device)
+		require.NoError(t, err)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// TestFaultInjectionBreaksPayloads verifies malformed and truncated payloads
+// are not valid JSON and are counted.
+func TestFaultInjectionBreaksPayloads(t *testing.T) {
+	// --- Arrange ---
+	device := faultTestDevice(t)
+	counts := &FaultCounters{}
+	InjectFaults([]*loadgen.Device{device}, FaultOptions{MalformedPercent: 50, TruncatedPercent: 50}, counts, rand.New(rand.NewSource(1)))
+
+	// --- Act ---
+	payloads := generate(t, device, 100)
+
+	// --- Assert ---
+	for _, payload := range payloads {
+		assert.False(t, json.Valid(payload), "payload should be broken: %s", payload)
+	}
+	got := counts.Counts()
+	assert.Equal(t, int64(100), got.Malformed+got.Truncated)
+	assert.Positive(t, got.Malformed)
+	assert.Positive(t, got.Truncated)
+}
+
+// TestFaultInjectionSequenceAndDuplicates verifies duplicates repeat the
+// previous payload and that sequence resets restart the numbering.
+func TestFaultInjectionSequenceAndDuplicates(t *testing.T) {
+	// --- Arrange ---
+	device := faultTestDevice(t)
+	counts := &FaultCounters{}
+	InjectFaults([]*loadgen.Device{device}, FaultOptions{DuplicatePercent: 20, SequenceResetPercent: 5, OutOfOrderPercent: 10}, counts, rand.New(rand.NewSource(7)))
+
+	// --- Act ---
+	payloads := generate(t, device, 500)
+
+	// --- Assert ---
+	got := counts.Counts()
+	assert.Positive(t, got.Duplicated)
+	assert.Positive(t, got.SequenceReset)
+	assert.Positive(t, got.OutOfOrder)
+
+	duplicates, decreases := 0, 0
+	previous := int64(0)
+	for i, payload := range payloads {
+		if i > 0 && string(payload) == string(payloads[i-1]) {
+			duplicates++
+			continue
+		}
+		var msg struct {
+			Sequence int64 `json:"sequence"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &msg))
+		if msg.Sequence < previous {
+			decreases++
+		}
+		previous = msg.Sequence
+	}
+	assert.GreaterOrEqual(t, int64(duplicates), got.Duplicated)
+	assert.Positive(t, decreases)
+}
+
+// TestFaultInjectionSkewAndOversize verifies timestamps are shifted within
+// the configured skew and oversized payloads stay valid JSON.
+func TestFaultInjectionSkewAndOversize(t *testing.T) {
+	// --- Arrange ---
+	device := faultTestDevice(t)
+	counts := &FaultCounters{}
+	InjectFaults([]*loadgen.Device{device}, FaultOptions{ClockSkewPercent: 100, ClockSkewSeconds: 3600, OversizedPercent: 100, OversizedBytes: 4096}, counts, rand.New(rand.NewSource(3)))
+
+	// --- Act ---
+	start := time.Now()
+	payloads := generate(t, device, 20)
+
+	// --- Assert ---
+	skewed := 0
+	for _, payload := range payloads {
+		assert.GreaterOrEqual(t, len(payload), 4096)
+		var msg struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &msg))
+		offset := msg.Timestamp.Sub(start)
+		assert.LessOrEqual(t, offset.Abs(), time.Hour+time.Minute)
+		if offset.Abs() > time.Minute {
+			skewed++
+		}
+	}
+	assert.Positive(t, skewed)
+	assert.Equal(t, FaultCounts{ClockSkewed: 20, Oversized: 20}, counts.Counts())
+}
+
+// TestFaultOptionsValidate verifies out of range options are rejected.
+func TestFaultOptionsValidate(t *testing.T) {
+	for _, opts := range []FaultOptions{
+		{MalformedPercent: 120},
+		{DuplicatePercent: -1},
+		{MalformedPercent: 60, TruncatedPercent: 60},
+		{ClockSkewPercent: 10},
+		{OversizedBytes: -5},
+	} {
+		assert.Error(t, opts.validate(), "%+v", opts)
+	}
+	assert.NoError(t, (&FaultOptions{ClockSkewPercent: 10, ClockSkewSeconds: 30}).validate())
+}
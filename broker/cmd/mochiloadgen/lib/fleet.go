@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"regexp"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// MaxFleetDevices caps how many devices a single request may expand into.
+const MaxFleetDevices = 50000
+
+// Rate distributions for the devices of a fleet.
+const (
+	RateFixed   = "fixed"
+	RateUniform = "uniform"
+	RateNormal  = "normal"
+)
+
+// idPlaceholder matches the index placeholder in a fleet ID pattern: {d}, or
+// {05d} to zero-pad. A width without the 0, such as {5d}, would pad with spaces
+// and is not accepted.
+var idPlaceholder = regexp.MustCompile(`\{(0\d+)?d\}`)
+
+// FleetRequest describes many similar devices at once. IDPattern must contain
+// one index placeholder: "garden-{05d}" expands to garden-00001, garden-00002 ...
+type FleetRequest struct {
+	// Name fills the {fleet} topic placeholder.
+	Name       string `json:"name,omitempty"`
+	Count      int    `json:"count"`
+	IDPattern  string `json:"id_pattern"`
+	StartIndex *int   `json:"start_index,omitempty"`
+
+	// RateDistribution is fixed (every device at rate_hz), uniform (between
+	// min_rate_hz and max_rate_hz) or normal (mean rate_hz, rate_stddev_hz).
+	RateDistribution string  `json:"rate_distribution,omitempty"`
+	RateHz           float64 `json:"rate_hz"`
+	MinRateHz        float64 `json:"min_rate_hz,omitempty"`
+	MaxRateHz        float64 `json:"max_rate_hz,omitempty"`
+	RateStddevHz     float64 `json:"rate_stddev_hz,omitempty"`
+
+	PayloadGenerator string          `json:"payload_generator"`
+	GeneratorOptions json.RawMessage `json:"generator_options,omitempty"`
+
+	// Faults optionally makes some of the fleet's messages bad.
+	Faults *FaultOptions `json:"faults,omitempty"`
+
+	// Metadata fills further topic placeholders; QoS and Retain override the
+	// request's publish settings for the fleet's messages.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	QoS      *byte             `json:"qos,omitempty"`
+	Retain   bool              `json:"retain,omitempty"`
+}
+
+// DeviceIDValidator is implemented by payload generators that only work with
+// some device IDs, so bad IDs are rejected before a load test starts.
+type DeviceIDValidator interface {
+	ValidateDeviceID(id string) error
+}
+
+// validateDeviceID checks id against the generator, if it cares.
+func validateDeviceID(generator loadgen.PayloadGenerator, id string) error {
+	if id == "" {
+		return fmt.Errorf("device ID must not be empty")
+	}
+	if v, ok := generator.(DeviceIDValidator); ok {
+		return v.ValidateDeviceID(id)
+	}
+	return nil
+}
+
+// validate checks the fleet before any devices are built.
+func (f *FleetRequest) validate() error {
+	if f.Count <= 0 {
+		return fmt.Errorf("fleet %q needs a positive count", f.IDPattern)
+	}
+	if len(idPlaceholder.FindAllStringIndex(f.IDPattern, -1)) != 1 {
+		return fmt.Errorf("fleet id_pattern %q must contain exactly one index placeholder such as {05d}", f.IDPattern)
+	}
+	switch f.RateDistribution {
+	case "", RateFixed:
+		if f.RateHz <= 0 {
+			return fmt.Errorf("fleet %q needs a positive rate_hz", f.IDPattern)
+		}
+	case RateUniform:
+		if f.MinRateHz <= 0 || f.MaxRateHz < f.MinRateHz {
+			return fmt.Errorf("fleet %q needs 0 < min_rate_hz <= max_rate_hz for a uniform rate", f.IDPattern)
+		}
+	case RateNormal:
+		if f.RateHz <= 0 || f.RateStddevHz < 0 {
+			return fmt.Errorf("fleet %q needs a positive rate_hz and a non-negative rate_stddev_hz for a normal rate", f.IDPattern)
+		}
+	default:
+		return fmt.Errorf("unknown rate distribution %q (supported: %s, %s, %s)", f.RateDistribution, RateFixed, RateUniform, RateNormal)
+	}
+	if f.Faults != nil {
+		if err := f.Faults.validate(); err != nil {
+			return fmt.Errorf("fleet %q: %w", f.IDPattern, err)
+		}
+	}
+	return nil
+}
+
+// deviceID returns the ID of the device at index.
+func (f *FleetRequest) deviceID(index int) string {
+	return idPlaceholder.ReplaceAllStringFunc(f.IDPattern, func(placeholder string) string {
+		verb := idPlaceholder.FindStringSubmatch(placeholder)[1]
+		return fmt.Sprintf("%"+verb+"d", index)
+	})
+}
+
+// rate draws a device's message rate from the fleet's distribution. Normal
+// rates are clamped so no device ends up silent.
+func (f *FleetRequest) rate(rng *rand.Rand) float64 {
+	switch f.RateDistribution {
+	case RateUniform:
+		return f.MinRateHz + rng.Float64()*(f.MaxRateHz-f.MinRateHz)
+	case RateNormal:
+		rate := f.RateHz + rng.NormFloat64()*f.RateStddevHz
+		if minimum := f.RateHz / 100; rate < minimum {
+			rate = minimum
+		}
+		return rate
+	default:
+		return f.RateHz
+	}
+}
+
+// Expand builds the fleet's devices, each with its own payload generator.
+// Injected faults are counted in faults.
+func (f *FleetRequest) Expand(rng *rand.Rand, faults *FaultCounters) ([]*loadgen.Device, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	start := 1
+	if f.StartIndex != nil {
+		start = *f.StartIndex
+	}
+
+	devices := make([]*loadgen.Device, 0, f.Count)
+	for i := 0; i < f.Count; i++ {
+		generator, err := DefaultGenerators.New(f.PayloadGenerator, f.GeneratorOptions)
+		if err != nil {
+			return nil, fmt.Errorf("fleet %q: %w", f.IDPattern, err)
+		}
+		id := f.deviceID(start + i)
+		if err := validateDeviceID(generator, id); err != nil {
+			return nil, fmt.Errorf("fleet %q: %w", f.IDPattern, err)
+		}
+		devices = append(devices, &loadgen.Device{
+			ID:               id,
+			MessageRate:      f.rate(rng),
+			PayloadGenerator: generator,
+		})
+	}
+	if f.Faults != nil {
+		InjectFaults(devices, *f.Faults, faults, rng)
+	}
+	return devices, nil
+}
+
+// BuildDevices expands the explicit devices and fleets of a request into the
+// load generator's devices, rejecting duplicate IDs and oversized requests.
+// Faults injected into fleets are counted in faults. The returned settings,
+// keyed by device ID, are what the topic router needs for each device.
+func BuildDevices(req *LoadTestRequest, rng *rand.Rand, faults *FaultCounters) ([]*loadgen.Device, map[string]DeviceSettings, error) {
+	total := len(req.Devices)
+	if total > MaxFleetDevices {
+		return nil, nil, fmt.Errorf("request has %d devices, more than the limit of %d", total, MaxFleetDevices)
+	}
+	for _, fleet := range req.Fleets {
+		// Compare before adding so counts near MaxInt cannot overflow the
+		// total. Expand rejects counts below one.
+		count := max(fleet.Count, 0)
+		if count > MaxFleetDevices-total {
+			return nil, nil, fmt.Errorf("request expands to more than the limit of %d devices", MaxFleetDevices)
+		}
+		total += count
+	}
+
+	devices := make([]*loadgen.Device, 0, total)
+	settings := make(map[string]DeviceSettings, total)
+	for _, devReq := range req.Devices {
+		generator, err := devReq.newGenerator()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := validateDeviceID(generator, devReq.ID); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := settings[devReq.ID]; ok {
+			return nil, nil, fmt.Errorf("duplicate device ID %q", devReq.ID)
+		}
+		devices = append(devices, &loadgen.Device{
+			ID:               devReq.ID,
+			MessageRate:      devReq.MessageRateHz,
+			PayloadGenerator: generator,
+		})
+		settings[devReq.ID] = DeviceSettings{Fleet: devReq.Fleet, Metadata: devReq.Metadata, QoS: devReq.QoS, Retain: devReq.Retain}
+	}
+	for i := range req.Fleets {
+		fleet := &req.Fleets[i]
+		fleetDevices, err := fleet.Expand(rng, faults)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, device := range fleetDevices {
+			if _, ok := settings[device.ID]; ok {
+				return nil, nil, fmt.Errorf("duplicate device ID %q", device.ID)
+			}
+			settings[device.ID] = DeviceSettings{Fleet: fleet.Name, Metadata: fleet.Metadata, QoS: fleet.QoS, Retain: fleet.Retain}
+		}
+		devices = append(devices, fleetDevices...)
+	}
+	return devices, settings, nil
+}
+
+// InjectsFaults reports whether any fleet of the request has faults configured.
+func (r *LoadTestRequest) InjectsFaults() bool {
+	for _, fleet := range r.Fleets {
+		if fleet.Faults != nil {
+			return true
+		}
+	}
+	return false
+}
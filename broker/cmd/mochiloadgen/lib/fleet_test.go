@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBuildDevicesExpandsFleets verifies fleets expand into devices with
+// patterned IDs, rates from their distribution and their own generators.
+func TestBuildDevicesExpandsFleets(t *testing.T) {
+	// --- Arrange ---
+	req := &LoadTestRequest{
+		Devices: []DeviceRequest{{ID: "garden-monitor-001", MessageRateHz: 2, PayloadGenerator: "gardenMonitor"}},
+		Fleets: []FleetRequest{
+			{Count: 1000, IDPattern: "garden-{05d}", RateHz: 0.5, PayloadGenerator: "gardenMonitor"},
+			{
+				Count: 10, IDPattern: "meter-{d}", RateDistribution: RateUniform, MinRateHz: 1, MaxRateHz: 3,
+				PayloadGenerator: "replay", GeneratorOptions: json.RawMessage(`{"messages": ["e30="]}`),
+			},
+		},
+	}
+
+	// --- Act ---
+	devices, _, err := BuildDevices(req, rand.New(rand.NewSource(1)), &FaultCounters{})
+
+	// --- Assert ---
+	require.NoError(t, err)
+	require.Len(t, devices, 1011)
+	assert.Equal(t, "garden-monitor-001", devices[0].ID)
+	assert.Equal(t, "garden-00001", devices[1].ID)
+	assert.Equal(t, "garden-01000", devices[1000].ID)
+	assert.Equal(t, 0.5, devices[1].MessageRate)
+	assert.NotSame(t, devices[1].PayloadGenerator, devices[2].PayloadGenerator)
+	for _, device := range devices[1001:] {
+		assert.Regexp(t, `^meter-\d+$`, device.ID)
+		assert.GreaterOrEqual(t, device.MessageRate, 1.0)
+		assert.LessOrEqual(t, device.MessageRate, 3.0)
+	}
+	assert.NotNil(t, devices[1001].PayloadGenerator)
+}
+
+// TestBuildDevicesRejectsBadFleets verifies invalid requests are reported as
+// errors rather than failing once the load test is running.
+func TestBuildDevicesRejectsBadFleets(t *testing.T) {
+	testCases := []struct {
+		name string
+		req  LoadTestRequest
+		err  string
+	}{
+		{
+			name: "ID too short for gardenMonitor",
+			req:  LoadTestRequest{Fleets: []FleetRequest{{Count: 5, IDPattern: "g{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "at least 4 characters",
+		},
+		{
+			name: "explicit device ID too short",
+			req:  LoadTestRequest{Devices: []DeviceRequest{{ID: "g1", MessageRateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "at least 4 characters",
+		},
+		{
+			name: "no placeholder",
+			req:  LoadTestRequest{Fleets: []FleetRequest{{Count: 5, IDPattern: "garden", RateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "placeholder",
+		},
+		{
+			name: "space-padded placeholder",
+			req:  LoadTestRequest{Fleets: []FleetRequest{{Count: 5, IDPattern: "garden-{5d}", RateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "placeholder",
+		},
+		{
+			name: "duplicate IDs across fleets",
+			req: LoadTestRequest{Fleets: []FleetRequest{
+				{Count: 2, IDPattern: "garden-{04d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+				{Count: 2, IDPattern: "garden-{04d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+			}},
+			err: "duplicate device ID",
+		},
+		{
+			name: "too many devices",
+			req:  LoadTestRequest{Fleets: []FleetRequest{{Count: MaxFleetDevices + 1, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "more than the limit",
+		},
+		{
+			name: "fleets whose counts overflow",
+			req: LoadTestRequest{Fleets: []FleetRequest{
+				{Count: math.MaxInt - 1, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+				{Count: math.MaxInt - 1, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+			}},
+			err: "more than the limit",
+		},
+		{
+			name: "fleets each under the limit",
+			req: LoadTestRequest{Fleets: []FleetRequest{
+				{Count: MaxFleetDevices, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+				{Count: 1, IDPattern: "greenhouse-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor"},
+			}},
+			err: "more than the limit",
+		},
+		{
+			name: "unknown generator option",
+			req: LoadTestRequest{Fleets: []FleetRequest{{
+				Count: 1, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "gardenMonitor", GeneratorOptions: json.RawMessage(`{"colour": "green"}`),
+			}}},
+			err: `has no option "colour"`,
+		},
+		{
+			name: "unknown rate distribution",
+			req:  LoadTestRequest{Fleets: []FleetRequest{{Count: 1, IDPattern: "garden-{d}", RateDistribution: "poisson", RateHz: 1, PayloadGenerator: "gardenMonitor"}}},
+			err:  "unknown rate distribution",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			_, _, err := BuildDevices(&tc.req, rand.New(rand.NewSource(1)), &FaultCounters{})
+
+			// --- Assert ---
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+// TestGardenMonitorRejectsShortIDs verifies the generator returns an error
+// instead of panicking when called directly with a short ID.
+func TestGardenMonitorRejectsShortIDs(t *testing.T) {
+	// --- Arrange ---
+	generator := NewGardenMonitorPayloadGenerator()
+
+	// --- Act ---
+	_, err := generator.GeneratePayload(&loadgen.Device{ID: "g1"})
+
+	// --- Assert ---
+	assert.Error(t, err)
+}
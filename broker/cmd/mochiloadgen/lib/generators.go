@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// Option types a generator can declare in its schema.
+const (
+	OptionString = "string"
+	OptionNumber = "number"
+	OptionBool   = "bool"
+	OptionArray  = "array"
+	OptionObject = "object"
+)
+
+// GeneratorOption describes one option a payload generator accepts.
+type GeneratorOption struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description"`
+}
+
+// GeneratorSpec registers a payload generator under a name. New is called
+// once per device with options already checked against the schema, so
+// generators may keep per-device state.
+type GeneratorSpec struct {
+	Name        string
+	Description string
+	Options     []GeneratorOption
+	New         func(options json.RawMessage) (loadgen.PayloadGenerator, error)
+}
+
+// GeneratorInfo is the description of a registered generator returned by GET /generators.
+type GeneratorInfo struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Options     []GeneratorOption `json:"options"`
+}
+
+// GeneratorRegistry holds the payload generators load tests can use by name.
+type GeneratorRegistry struct {
+	mu    sync.RWMutex
+	specs map[string]GeneratorSpec
+}
+
+// NewGeneratorRegistry creates an empty registry.
+func NewGeneratorRegistry() *GeneratorRegistry {
+	return &GeneratorRegistry{specs: make(map[string]GeneratorSpec)}
+}
+
+// DefaultGenerators is the registry used by load test requests. It starts
+// with the built-in gardenMonitor, replay and template generators.
+var DefaultGenerators = newDefaultGenerators()
+
+// RegisterGenerator adds a generator to DefaultGenerators.
+func RegisterGenerator(spec GeneratorSpec) error {
+	return DefaultGenerators.Register(spec)
+}
+
+// Register adds a generator. Names must be unique.
+func (r *GeneratorRegistry) Register(spec GeneratorSpec) error {
+	if spec.Name == "" || spec.New == nil {
+		return fmt.Errorf("payload generator needs a name and a constructor")
+	}
+	for _, opt := range spec.Options {
+		switch opt.Type {
+		case OptionString, OptionNumber, OptionBool, OptionArray, OptionObject:
+		default:
+			return fmt.Errorf("payload generator %s: option %s has unsupported type %q", spec.Name, opt.Name, opt.Type)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.specs[spec.Name]; ok {
+		return fmt.Errorf("payload generator %s is already registered", spec.Name)
+	}
+	r.specs[spec.Name] = spec
+	return nil
+}
+
+// New checks options against the generator's schema and creates a generator.
+func (r *GeneratorRegistry) New(name string, options json.RawMessage) (loadgen.PayloadGenerator, error) {
+	r.mu.RLock()
+	spec, ok := r.specs[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown payload generator: %s", name)
+	}
+	if err := checkOptions(spec, options); err != nil {
+		return nil, err
+	}
+	return spec.New(options)
+}
+
+// List describes the registered generators, sorted by name.
+func (r *GeneratorRegistry) List() []GeneratorInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	infos := make([]GeneratorInfo, 0, len(r.specs))
+	for _, spec := range r.specs {
+		options := spec.Options
+		if options == nil {
+			options = []GeneratorOption{}
+		}
+		infos = append(infos, GeneratorInfo{Name: spec.Name, Description: spec.Description, Options: options})
+	}
+	sort.Slice(infos, func(i, k int) bool { return infos[i].Name < infos[k].Name })
+	return infos
+}
+
+// ServeHTTP lists the registered generators.
+func (r *GeneratorRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, r.List())
+}
+
+// checkOptions rejects unknown options, missing required ones and values of the wrong type.
+func checkOptions(spec GeneratorSpec, options json.RawMessage) error {
+	values := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(options)) > 0 && !bytes.Equal(bytes.TrimSpace(options), []byte("null")) {
+		if err := json.Unmarshal(options, &values); err != nil {
+			return fmt.Errorf("generator_options for %s must be a JSON object: %w", spec.Name, err)
+		}
+	}
+
+	declared := make(map[string]GeneratorOption, len(spec.Options))
+	for _, opt := range spec.Options {
+		declared[opt.Name] = opt
+		if _, ok := values[opt.Name]; opt.Required && !ok {
+			return fmt.Errorf("payload generator %s requires option %q", spec.Name, opt.Name)
+		}
+	}
+	for name, value := range values {
+		opt, ok := declared[name]
+		if !ok {
+			return fmt.Errorf("payload generator %s has no option %q", spec.Name, name)
+		}
+		if !optionHasType(value, opt.Type) {
+			return fmt.Errorf("payload generator %s option %q must be a %s", spec.Name, name, opt.Type)
+		}
+	}
+	return nil
+}
+
+// optionHasType reports whether a raw JSON value is of the declared type.
+func optionHasType(value json.RawMessage, optionType string) bool {
+	var v any
+	if err := json.Unmarshal(value, &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case string:
+		return optionType == OptionString
+	case float64:
+		return optionType == OptionNumber
+	case bool:
+		return optionType == OptionBool
+	case []any:
+		return optionType == OptionArray
+	case map[string]any:
+		return optionType == OptionObject
+	default:
+		return false
+	}
+}
+
+// newDefaultGenerators registers the built-in generators.
+func newDefaultGenerators() *GeneratorRegistry {
+	r := NewGeneratorRegistry()
+	builtins := []GeneratorSpec{
+		{
+			Name:        "gardenMonitor",
+			Description: "Garden monitor readings with a drifting battery, temperature, humidity and soil moisture.",
+			New: func(json.RawMessage) (loadgen.PayloadGenerator, error) {
+				return NewGardenMonitorPayloadGenerator(), nil
+			},
+		},
+		{
+			Name:        "replay",
+			Description: "Replays the given payloads, or those of a broker traffic recording, in order.",
+			Options: []GeneratorOption{
+				{Name: "messages", Type: OptionArray, Description: "Payloads to replay, base64 encoded."},
+				{Name: "recording", Type: OptionString, Description: "A recording file, or a directory of them, written by the broker's traffic recorder, relative to the server's recordings directory."},
+				{Name: "topic_filter", Type: OptionString, Description: "Only replay recorded messages on topics matching this MQTT filter."},
+				{Name: "client_id", Type: OptionString, Description: "Only replay recorded messages from this client."},
+			},
+			New: func(options json.RawMessage) (loadgen.PayloadGenerator, error) {
+				var opts struct {
+					Messages    [][]byte `json:"messages"`
+					Recording   string   `json:"recording"`
+					TopicFilter string   `json:"topic_filter"`
+					ClientID    string   `json:"client_id"`
+				}
+				if len(bytes.TrimSpace(options)) > 0 {
+					if err := json.Unmarshal(options, &opts); err != nil {
+						return nil, fmt.Errorf("invalid replay options: %w", err)
+					}
+				}
+				switch {
+				case opts.Recording == "" && len(opts.Messages) == 0:
+					return nil, fmt.Errorf("payload generator 'replay' requires either non-empty 'messages' or a 'recording'")
+				case opts.Recording != "" && len(opts.Messages) > 0:
+					return nil, fmt.Errorf("payload generator 'replay' takes either 'messages' or 'recording', not both")
+				case opts.Recording == "":
+					return loadgen.NewReplayPayloadGenerator(opts.Messages), nil
+				}
+				recorded, err := recordings.load(opts.Recording)
+				if err != nil {
+					return nil, err
+				}
+				messages := RecordedPayloads(FilterRecording(recorded, opts.TopicFilter, opts.ClientID))
+				if len(messages) == 0 {
+					return nil, fmt.Errorf("recording %s has no messages to replay", opts.Recording)
+				}
+				return loadgen.NewReplayPayloadGenerator(messages), nil
+			},
+		},
+		{
+			Name:        "template",
+			Description: "Fills a JSON template's placeholders: {{device_id}}, {{seq}}, {{timestamp}}, {{timestamp_ms}}, {{walk:min:max:step}} and {{choice:a|b|c}}.",
+			Options: []GeneratorOption{
+				{Name: "template", Type: OptionObject, Required: true, Description: "The JSON payload with placeholders in its string values."},
+			},
+			New: func(options json.RawMessage) (loadgen.PayloadGenerator, error) {
+				var opts struct {
+					Template json.RawMessage `json:"template"`
+				}
+				if err := json.Unmarshal(options, &opts); err != nil {
+					return nil, fmt.Errorf("invalid template options: %w", err)
+				}
+				return NewTemplatePayloadGenerator(opts.Template)
+			},
+		},
+	}
+	for _, spec := range builtins {
+		if err := r.Register(spec); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedGenerator always returns the same payload.
+type fixedGenerator struct{ payload []byte }
+
+func (g *fixedGenerator) GeneratePayload(*loadgen.Device) ([]byte, error) { return g.payload, nil }
+
+// TestGeneratorRegistryChecksOptions verifies registered generators get only
+// options that match their schema.
+func TestGeneratorRegistryChecksOptions(t *testing.T) {
+	// --- Arrange ---
+	registry := NewGeneratorRegistry()
+	require.NoError(t, registry.Register(GeneratorSpec{
+		Name:    "fixed",
+		Options: []GeneratorOption{{Name: "payload", Type: OptionString, Required: true}},
+		New: func(options json.RawMessage) (loadgen.PayloadGenerator, error) {
+			var opts struct {
+				Payload string `json:"payload"`
+			}
+			if err := json.Unmarshal(options, &opts); err != nil {
+				return nil, err
+			}
+			return &fixedGenerator{payload: []byte(opts.Payload)}, nil
+		},
+	}))
+
+	// --- Act ---
+	generator, err := registry.New("fixed", json.RawMessage(`{"payload": "hello"}`))
+	_, missingErr := registry.New("fixed", nil)
+	_, typeErr := registry.New("fixed", json.RawMessage(`{"payload": 42}`))
+	_, unknownErr := registry.New("fixed", json.RawMessage(`{"payload": "hello", "extra": true}`))
+	_, nameErr := registry.New("missing", nil)
+	duplicateErr := registry.Register(GeneratorSpec{Name: "fixed", New: func(json.RawMessage) (loadgen.PayloadGenerator, error) { return nil, nil }})
+
+	// --- Assert ---
+	require.NoError(t, err)
+	payload, err := generator.GeneratePayload(&loadgen.Device{ID: "device-0001"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(payload))
+	assert.ErrorContains(t, missingErr, "requires option")
+	assert.ErrorContains(t, typeErr, "must be a string")
+	assert.ErrorContains(t, unknownErr, `no option "extra"`)
+	assert.ErrorContains(t, nameErr, "unknown payload generator")
+	assert.ErrorContains(t, duplicateErr, "already registered")
+}
+
+// TestDefaultGeneratorsListed verifies GET /generators describes the built-ins.
+func TestDefaultGeneratorsListed(t *testing.T) {
+	// --- Arrange ---
+	rec := httptest.NewRecorder()
+
+	// --- Act ---
+	DefaultGenerators.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/generators", nil))
+
+	// --- Assert ---
+	require.Equal(t, http.StatusOK, rec.Code)
+	var infos []GeneratorInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	assert.Equal(t, []string{"gardenMonitor", "replay", "template"}, names)
+}
+
+// TestTemplatePayloadGenerator verifies each placeholder renders and that
+// random walks stay within their range.
+func TestTemplatePayloadGenerator(t *testing.T) {
+	// --- Arrange ---
+	options := json.RawMessage(`{"template": {
+		"id": "{{device_id}}",
+		"sim": "SIM_{{device_id}}_{{seq}}",
+		"seq": "{{seq}}",
+		"ts": "{{timestamp}}",
+		"ts_ms": "{{timestamp_ms}}",
+		"temp": "{{walk:10:30:2}}",
+		"ph": "{{walk:5.5:7.5:0.1}}",
+		"mode": "{{choice:eco|boost}}",
+		"fixed": [1, true, "plain"]
+	}}`)
+	generator, err := DefaultGenerators.New("template", options)
+	require.NoError(t, err)
+	device := &loadgen.Device{ID: "meter-7"}
+
+	// --- Act ---
+	var messages []map[string]any
+	for i := 0; i < 50; i++ {
+		payload, err := generator.GeneratePayload(device)
+		require.NoError(t, err)
+		var msg map[string]any
+		require.NoError(t, json.Unmarshal(payload, &msg))
+		messages = append(messages, msg)
+	}
+
+	// --- Assert ---
+	first, last := messages[0], messages[49]
+	assert.Equal(t, "meter-7", first["id"])
+	assert.Equal(t, "SIM_meter-7_1", first["sim"])
+	assert.Equal(t, 1.0, first["seq"])
+	assert.Equal(t, 50.0, last["seq"])
+	assert.IsType(t, "", first["ts"])
+	assert.IsType(t, 0.0, first["ts_ms"])
+	assert.Equal(t, []any{1.0, true, "plain"}, first["fixed"])
+	for _, msg := range messages {
+		assert.GreaterOrEqual(t, msg["temp"], 10.0)
+		assert.LessOrEqual(t, msg["temp"], 30.0)
+		assert.GreaterOrEqual(t, msg["ph"], 5.5)
+		assert.LessOrEqual(t, msg["ph"], 7.5)
+		assert.Contains(t, []any{"eco", "boost"}, msg["mode"])
+	}
+}
+
+// TestTemplatePayloadGeneratorRejectsBadPlaceholders verifies template errors
+// are reported when the generator is created.
+func TestTemplatePayloadGeneratorRejectsBadPlaceholders(t *testing.T) {
+	for _, template := range []string{
+		`{"x": "{{colour}}"}`,
+		`{"x": "{{walk:10:1:2}}"}`,
+		`{"x": "{{walk:1:2}}"}`,
+		`{"x": "{{choice}}"}`,
+		`{"x": `,
+	} {
+		_, err := NewTemplatePayloadGenerator(json.RawMessage(template))
+		assert.Error(t, err, template)
+	}
+}
+
+// TestReplayGeneratorNeedsMessagesOrRecording verifies the replay generator
+// says what it is missing when given neither messages nor a recording.
+func TestReplayGeneratorNeedsMessagesOrRecording(t *testing.T) {
+	for _, options := range []string{``, `null`, `{}`, `{"messages": []}`, `{"topic_filter": "devices/#"}`} {
+		_, err := DefaultGenerators.New("replay", json.RawMessage(options))
+		assert.ErrorContains(t, err, "requires either non-empty 'messages' or a 'recording'", options)
+	}
+}
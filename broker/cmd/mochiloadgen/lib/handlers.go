@@ -3,23 +3,107 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog"
+	"math/rand"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"cloud.google.com/go/pubsub/v2"
 	"github.com/illmade-knight/go-test/loadgen" // Assuming this is your loadgen package path
 	mqtt "github.com/mochi-mqtt/server/v2"
 )
 
+// DefaultMaxBodyBytes is the largest request body the handlers read unless
+// SetMaxBodyBytes changes it. Pub/Sub push envelopes carry the message base64
+// encoded, so passthrough of large messages may need more.
+const DefaultMaxBodyBytes int64 = 1 << 20
+
+// SecretFunc fetches a secret's value by its resource name.
+type SecretFunc func(ctx context.Context, name string) (string, error)
+
 // Handler holds dependencies for the HTTP handlers, like a reference to the Mochi server.
 type Handler struct {
-	server *mqtt.Server
-	logger zerolog.Logger
+	server      *mqtt.Server
+	logger      zerolog.Logger
+	jobs        *JobManager
+	topicFilter string
+	limits      RequestLimits
+
+	// Network client requests may name one of allowedSecrets, read through secrets.
+	secrets        SecretFunc
+	allowedSecrets []string
+
+	// maxBodyBytes caps the request bodies the handlers decode.
+	maxBodyBytes int64
+
+	// Push passthrough requests must pass pushAuth and publish under topicPrefixes.
+	// passthroughDropped counts push messages acknowledged without publishing.
+	pushAuth           Authenticator
+	topicPrefixes      []string
+	passthroughDropped atomic.Int64
 }
 
 // NewHandler creates a new Handler.
 func NewHandler(server *mqtt.Server) *Handler {
-	return &Handler{server: server}
+	return &Handler{server: server, jobs: NewJobManager(defaultMaxJobs), maxBodyBytes: DefaultMaxBodyBytes}
+}
+
+// SetSecretResolver lets network client requests name one of the allowed
+// password secrets. The password goes to whatever broker the request names,
+// so only secrets meant for load test brokers should be allowed.
+func (h *Handler) SetSecretResolver(secrets SecretFunc, allowed []string) {
+	h.secrets = secrets
+	h.allowedSecrets = allowed
+}
+
+// SetTopicFilter sets the subscription filter load test topics are checked
+// against when a request does not give its own, normally the filter the
+// ingestion service subscribes to.
+func (h *Handler) SetTopicFilter(filter string) {
+	h.topicFilter = filter
+}
+
+// SetPassthroughPolicy makes the push passthrough endpoint require requests
+// auth accepts, such as Pub/Sub's OIDC push tokens, and only publish to topics
+// at or below one of topicPrefixes. A nil auth or no prefixes leaves that
+// part open.
+func (h *Handler) SetPassthroughPolicy(auth Authenticator, topicPrefixes []string) {
+	h.pushAuth = auth
+	h.topicPrefixes = topicPrefixes
+}
+
+// PassthroughDropped returns how many push messages were dropped because they
+// could never be published.
+func (h *Handler) PassthroughDropped() int64 {
+	return h.passthroughDropped.Load()
+}
+
+// SetLimits caps the devices, total rate and duration of each load test.
+func (h *Handler) SetLimits(limits RequestLimits) {
+	h.limits = limits
+}
+
+// SetMaxBodyBytes caps the size of load test and passthrough request bodies;
+// larger ones are refused with 413 Request Entity Too Large.
+func (h *Handler) SetMaxBodyBytes(n int64) {
+	h.maxBodyBytes = n
+}
+
+// decodeBody decodes the JSON request body into v, reading no more than
+// maxBodyBytes of it.
+func (h *Handler) decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBodyBytes)).Decode(v)
+}
+
+// bodyTooLarge reports whether err is decodeBody hitting the size cap.
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
 }
 
 // --- Request/Response Structs ---
@@ -29,6 +113,18 @@ type LoadTestRequest struct {
 	TopicPattern    string          `json:"topic_pattern"`
 	QoS             byte            `json:"qos"`
 	Devices         []DeviceRequest `json:"devices"`
+	Fleets          []FleetRequest  `json:"fleets,omitempty"`
+	// Optional: a time-varying rate for all devices, replacing message_rate_hz.
+	Profile *RateProfile `json:"profile,omitempty"`
+	// Optional: measure end-to-end latency by stamping and matching payloads.
+	Latency *LatencyRequest `json:"latency,omitempty"`
+	// Optional: publish over real MQTT connections instead of in-process.
+	Client *ClientRequest `json:"client,omitempty"`
+	// Optional: the filter the pipeline subscribes to; every topic must match it.
+	TopicFilter string `json:"topic_filter,omitempty"`
+	// Optional: replay a broker recording with its original timing instead of
+	// running devices and fleets.
+	Replay *ReplayRequest `json:"replay,omitempty"`
 }
 
 type DeviceRequest struct {
@@ -37,6 +133,22 @@ type DeviceRequest struct {
 	PayloadGenerator string  `json:"payload_generator"`
 	// Optional: For replay generator
 	Messages [][]byte `json:"messages,omitempty"`
+	// Optional: options for the payload generator, checked against its schema.
+	GeneratorOptions json.RawMessage `json:"generator_options,omitempty"`
+	// Optional: values for topic placeholders, and per-device publish settings.
+	Fleet    string            `json:"fleet,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	QoS      *byte             `json:"qos,omitempty"`
+	Retain   bool              `json:"retain,omitempty"`
+}
+
+// newGenerator creates the device's payload generator. The older top-level
+// messages field is still accepted for the replay generator.
+func (d *DeviceRequest) newGenerator() (loadgen.PayloadGenerator, error) {
+	if len(d.GeneratorOptions) > 0 {
+		return DefaultGenerators.New(d.PayloadGenerator, d.GeneratorOptions)
+	}
+	return NewPayloadGenerator(d.PayloadGenerator, d.Messages)
 }
 
 // PubSubMessage is the structure of a message from a Pub/Sub push subscription.
@@ -51,80 +163,365 @@ type PubSubMessage struct {
 
 // --- HTTP Handlers ---
 
-// HandleLoadTest triggers a load test using the in-process loadgen library.
+// HandleLoadTest starts a load test job on POST and lists recent jobs on GET.
 func (h *Handler) HandleLoadTest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	switch r.Method {
+	case http.MethodPost:
+		h.startLoadTest(w, r)
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.jobs.List())
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleLoadTestJob returns a job's status on GET /load-test/{id} and cancels
+// it on DELETE /load-test/{id}.
+func (h *Handler) HandleLoadTestJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/load-test/")
+	if id == "" {
+		http.Error(w, "Bad request: job ID missing", http.StatusBadRequest)
+		return
+	}
+
+	var status JobStatus
+	var ok bool
+	switch r.Method {
+	case http.MethodGet:
+		status, ok = h.jobs.Get(id)
+	case http.MethodDelete:
+		status, ok = h.jobs.Cancel(id)
+	default:
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if !ok {
+		http.Error(w, "Load test job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// startLoadTest triggers a load test using the in-process loadgen library.
+func (h *Handler) startLoadTest(w http.ResponseWriter, r *http.Request) {
 	var req LoadTestRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := h.decodeBody(w, r, &req); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request entity too large: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Basic validation
-	if req.DurationSeconds <= 0 || req.TopicPattern == "" || len(req.Devices) == 0 {
-		http.Error(w, "Bad request: duration, topic, and at least one device are required", http.StatusBadRequest)
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if req.Profile != nil {
+		if err := req.Profile.Validate(); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A step profile runs for the length of its stages unless told otherwise.
+		if duration <= 0 {
+			duration = req.Profile.StagesDuration()
+		}
+	}
+	if req.Latency != nil {
+		if err := req.Latency.Validate(); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Client != nil {
+		if err := req.Client.Validate(); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var timed *TimedReplay
+	if req.Replay != nil {
+		var err error
+		if timed, err = h.newTimedReplay(&req); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The replay runs for as long as the recording takes at its speed unless told otherwise.
+		if duration <= 0 {
+			duration = timed.Duration()
+		}
+	}
+	if timed == nil && (req.TopicPattern == "" || duration <= 0 || (len(req.Devices) == 0 && len(req.Fleets) == 0)) {
+		http.Error(w, "Bad request: duration, topic, and at least one device or fleet are required", http.StatusBadRequest)
 		return
 	}
 
-	// Create the in-process client
-	client := NewInProcessClient(h.server, req.TopicPattern, req.QoS)
+	// A replay keeps its recorded topics unless it is rerouted through the pattern.
+	var template *TopicTemplate
+	var err error
+	if req.TopicPattern != "" {
+		if template, err = ParseTopicTemplate(req.TopicPattern); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Build the list of devices for the load generator
+	// Build the list of devices for the load generator, expanding any fleets.
+	faults := &FaultCounters{}
 	var devices []*loadgen.Device
-	for _, devReq := range req.Devices {
-		generator, err := NewPayloadGenerator(devReq.PayloadGenerator, devReq.Messages)
+	var settings map[string]DeviceSettings
+	rate := 0.0
+	if timed != nil {
+		devices = timed.Devices()
+		rate = timed.RateHz()
+	} else {
+		devices, settings, err = BuildDevices(&req, rand.New(rand.NewSource(time.Now().UnixNano())), faults)
 		if err != nil {
 			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		devices = append(devices, &loadgen.Device{
-			ID:               devReq.ID,
-			MessageRate:      devReq.MessageRateHz,
-			PayloadGenerator: generator,
-		})
+		rate = peakRate(devices, req.Profile)
+	}
+	if err := h.limits.Check(len(devices), rate, duration); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Run the load generator in a separate goroutine to avoid blocking the HTTP response.
-	go func() {
-		lg := loadgen.NewLoadGenerator(client, devices, h.logger)
-		duration := time.Duration(req.DurationSeconds) * time.Second
+	// Check every device's topic against the ingestion filter before starting,
+	// so a mismatch is reported instead of silently dropped by the pipeline.
+	filter := req.TopicFilter
+	if filter == "" {
+		filter = h.topicFilter
+	}
+	router := NewTopicRouter(template, req.QoS, filter, settings)
+	if timed != nil && !req.Replay.Reroute {
+		router.SetRecordedTopics(timed.Topics())
+	}
+	if err := router.Validate(devices); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var reporters []StatusReporter
+	if req.InjectsFaults() {
+		reporters = append(reporters, faults)
+	}
+
+	// Create the client: in-process by default, or one MQTT connection per device.
+	var client loadgen.Client
+	var networkClient *NetworkClient
+	if req.Client.Network() {
+		networkClient, err = h.newNetworkClient(r.Context(), &req, router, devices)
+		if err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		client = networkClient
+		reporters = append(reporters, networkClient)
+	} else {
+		client = NewInProcessClientWithRouter(h.server, router)
+	}
+	var tracker *LatencyTracker
+	if req.Latency != nil {
+		tracker = NewLatencyTracker(faults)
+		StampDevices(devices, tracker)
+		reporters = append(reporters, tracker)
+	}
+
+	// Run the load generator as a background job so the caller can poll or cancel it.
+	status, err := h.jobs.Start(client, len(devices), duration, func(ctx context.Context, client loadgen.Client) (int, error) {
+		if networkClient != nil {
+			// Cancelling the job must also stop devices still waiting to connect.
+			networkClient.SetContext(ctx)
+		}
+		if tracker != nil {
+			stopReceiving, err := h.startLatencyReceiver(ctx, req.Latency, latencyFilter(req.TopicPattern, filter), tracker)
+			if err != nil {
+				h.logger.Error().Err(err).Msg("Failed to start latency receiver")
+				return 0, err
+			}
+			defer stopReceiving()
+		}
 
-		h.logger.Info().Dur("duration", duration).Int("devices", len(devices)).Msg("Starting load test")
-		count, err := lg.Run(context.Background(), duration)
+		var count int
+		var err error
+		if timed != nil {
+			h.logger.Info().Dur("duration", timed.Duration()).Int("devices", len(devices)).Int("messages", timed.Messages()).Msg("Starting timed replay")
+			// A replay sent as fast as possible has no length of its own, so the duration limit bounds it.
+			limit := time.Duration(req.DurationSeconds) * time.Second
+			if limit <= 0 {
+				limit = h.limits.MaxDuration
+			}
+			count, err = timed.Run(ctx, client, limit, h.logger)
+		} else if req.Profile != nil {
+			h.logger.Info().Dur("duration", duration).Int("devices", len(devices)).Str("profile", req.Profile.Type).Msg("Starting load test")
+			count, err = NewProfileRunner(client, devices, req.Profile, h.logger).Run(ctx, duration)
+		} else {
+			h.logger.Info().Dur("duration", duration).Int("devices", len(devices)).Msg("Starting load test")
+			count, err = loadgen.NewLoadGenerator(client, devices, h.logger).Run(ctx, duration)
+		}
 		if err != nil {
 			h.logger.Error().Err(err).Msg("Load test finished with error")
 		} else {
 			h.logger.Info().Int("published", count).Msg("Load test finished successfully")
 		}
-	}()
 
-	// Respond immediately to the caller.
-	w.WriteHeader(http.StatusAccepted)
-	_, _ = w.Write([]byte("Load test accepted and started in the background.\n"))
+		// Give messages still in the pipeline time to arrive before the receiver stops.
+		if tracker != nil && err == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(req.Latency.Drain()):
+			}
+		}
+		return count, err
+	}, reporters...)
+	if err != nil {
+		http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Respond immediately with the job so the caller can follow it.
+	w.Header().Set("Location", "/load-test/"+status.ID)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// newTimedReplay loads the request's recording and schedules it. A replay
+// brings its own devices, so it cannot be combined with devices, fleets or a
+// rate profile.
+func (h *Handler) newTimedReplay(req *LoadTestRequest) (*TimedReplay, error) {
+	if err := req.Replay.Validate(); err != nil {
+		return nil, err
+	}
+	if len(req.Devices) > 0 || len(req.Fleets) > 0 || req.Profile != nil {
+		return nil, fmt.Errorf("a replay takes its devices and timing from the recording; leave out devices, fleets and profile")
+	}
+	if req.Replay.Reroute != (req.TopicPattern != "") {
+		return nil, fmt.Errorf("a replay publishes on its recorded topics; give a topic_pattern only with reroute set, to publish through it instead")
+	}
+	recorded, err := recordings.load(req.Replay.Recording)
+	if err != nil {
+		return nil, err
+	}
+	timed, err := NewTimedReplay(FilterRecording(recorded, req.Replay.TopicFilter, req.Replay.ClientID), req.Replay.speed())
+	if err != nil {
+		return nil, fmt.Errorf("recording %s: %w", req.Replay.Recording, err)
+	}
+	if len(timed.Devices()) > MaxFleetDevices {
+		return nil, fmt.Errorf("recording has %d clients, more than the limit of %d", len(timed.Devices()), MaxFleetDevices)
+	}
+	return timed, nil
+}
+
+// newNetworkClient resolves the request's credentials and creates a network client.
+func (h *Handler) newNetworkClient(ctx context.Context, req *LoadTestRequest, router *TopicRouter, devices []*loadgen.Device) (*NetworkClient, error) {
+	password := req.Client.Password
+	if req.Client.PasswordSecret != "" {
+		if h.secrets == nil {
+			return nil, fmt.Errorf("password_secret is not supported by this server")
+		}
+		if !slices.Contains(h.allowedSecrets, req.Client.PasswordSecret) {
+			return nil, fmt.Errorf("password_secret %s is not one of the secrets this server allows load tests to use", req.Client.PasswordSecret)
+		}
+		secret, err := h.secrets(ctx, req.Client.PasswordSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch password secret: %w", err)
+		}
+		password = secret
+	}
+
+	return NewNetworkClient(NetworkOptions{
+		BrokerURL:      req.Client.BrokerURL,
+		Username:       req.Client.Username,
+		Password:       password,
+		ClientIDPrefix: req.Client.ClientIDPrefix,
+		Keepalive:      time.Duration(req.Client.KeepaliveSecs) * time.Second,
+		ConnectPerSec:  req.Client.ConnectPerSec,
+		Churn:          req.Client.Churn,
+		Router:         router,
+	}, devices), nil
+}
+
+// latencyFilter is the inline latency filter used when the request gives
+// none: the topic filter if there is one, otherwise the topic pattern with
+// each level holding a placeholder as a single-level wildcard. A replay on its
+// recorded topics has no pattern and may publish anywhere.
+func latencyFilter(topicPattern, topicFilter string) string {
+	if topicFilter != "" {
+		return topicFilter
+	}
+	if topicPattern == "" {
+		return "#"
+	}
+	levels := strings.Split(topicPattern, "/")
+	for i, level := range levels {
+		if placeholderPattern.MatchString(level) {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// startLatencyReceiver starts matching stamped payloads back, either through
+// an inline subscription or from the pipeline's Pub/Sub output. The returned
+// function stops the receiver.
+func (h *Handler) startLatencyReceiver(ctx context.Context, req *LatencyRequest, defaultFilter string, tracker *LatencyTracker) (func(), error) {
+	if req.Mode == LatencyInline {
+		filter := req.Filter
+		if filter == "" {
+			filter = defaultFilter
+		}
+		return SubscribeLatency(h.server, filter, tracker)
+	}
+
+	client, err := pubsub.NewClient(ctx, req.ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	receiveCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ReceiveLatency(receiveCtx, client, req.SubscriptionID, tracker); err != nil {
+			h.logger.Error().Err(err).Str("subscription_id", req.SubscriptionID).Msg("Latency receiver stopped with error")
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		_ = client.Close()
+	}, nil
 }
 
-// HandlePassthrough receives a Pub/Sub push message and publishes it directly to an MQTT topic.
+// HandlePassthrough receives a Pub/Sub push message and publishes it directly
+// to the MQTT topic in its mqttTopic attribute. Pub/Sub redelivers anything
+// not acknowledged with a 2xx, so a message that can never be published
+// (too large, malformed or for a forbidden topic) is logged, counted and
+// acknowledged with a 204. Only failures that may pass are left for
+// redelivery: a 401 for a request that fails authentication and a 503 when
+// the broker could not take the message.
 func (h *Handler) HandlePassthrough(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
+	if h.pushAuth != nil {
+		if err := h.pushAuth.Authenticate(r); err != nil {
+			h.logger.Warn().Err(err).Msg("Passthrough push request failed authentication")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="passthrough"`)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 
 	var msg PubSubMessage
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		http.Error(w, "Bad request: could not decode Pub/Sub message", http.StatusBadRequest)
-		h.logger.Error().Err(err).Msg("Failed to decode Pub/Sub message")
+	if err := h.decodeBody(w, r, &msg); err != nil {
+		h.dropPassthrough(w, fmt.Errorf("could not decode Pub/Sub message: %w", err), "")
 		return
 	}
 
-	// The target MQTT topic should be in the message attributes.
-	topic, ok := msg.Message.Attributes["mqttTopic"]
-	if !ok || topic == "" {
-		http.Error(w, "Bad request: 'mqttTopic' attribute missing from Pub/Sub message", http.StatusBadRequest)
+	pub, err := parsePassthrough(msg.Message.Attributes, h.topicPrefixes)
+	if err != nil {
+		h.dropPassthrough(w, err, msg.Message.MessageID)
 		return
 	}
 
@@ -134,12 +531,33 @@ func (h *Handler) HandlePassthrough(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Publish directly to the in-memory server.
-	if err := h.server.Publish(topic, payload, false, 0); err != nil {
-		h.logger.Error().Err(err).Str("topic", topic).Msg("Passthrough failed to publish to Mochi")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if err := h.server.Publish(pub.topic, payload, pub.retain, pub.qos); err != nil {
+		h.logger.Error().Err(err).Str("topic", pub.topic).Msg("Passthrough failed to publish to Mochi")
+		http.Error(w, "Service unavailable: failed to publish to MQTT", http.StatusServiceUnavailable)
 		return
 	}
 
-	h.logger.Info().Str("topic", topic).Msg("Passthrough message published")
+	h.logger.Info().Str("topic", pub.topic).Uint8("qos", pub.qos).Bool("retain", pub.retain).Msg("Passthrough message published")
 	w.WriteHeader(http.StatusOK)
 }
+
+// dropPassthrough acknowledges a push message that can never be published, so
+// Pub/Sub stops redelivering it, and counts it.
+func (h *Handler) dropPassthrough(w http.ResponseWriter, err error, messageID string) {
+	dropped := h.passthroughDropped.Add(1)
+	h.logger.Warn().Err(err).Str("message_id", messageID).Int64("dropped_total", dropped).Msg("Passthrough message dropped")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Shutdown stops new load tests and drains running ones until ctx is done,
+// cancelling any that are left. It returns the jobs that were cut short.
+func (h *Handler) Shutdown(ctx context.Context) []JobStatus {
+	return h.jobs.Shutdown(ctx)
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"strings"
 
 	"github.com/illmade-knight/go-test/loadgen" // Assuming this is your loadgen package path
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -14,18 +13,25 @@ import (
 // InProcessClient implements the loadgen.Client interface for direct,
 // in-memory communication with a Mochi server instance.
 type InProcessClient struct {
-	server       *mqtt.Server
-	topicPattern string
-	qos          byte
+	server *mqtt.Server
+	router *TopicRouter
+	err    error
 }
 
-// NewInProcessClient creates a new client that publishes directly to the server.
+// NewInProcessClient creates a new client that publishes directly to the
+// server, every message at qos. An invalid topic pattern is reported by Publish.
 func NewInProcessClient(server *mqtt.Server, topicPattern string, qos byte) loadgen.Client {
-	return &InProcessClient{
-		server:       server,
-		topicPattern: topicPattern,
-		qos:          qos,
+	template, err := ParseTopicTemplate(topicPattern)
+	if err != nil {
+		return &InProcessClient{server: server, err: err}
 	}
+	return NewInProcessClientWithRouter(server, NewTopicRouter(template, qos, "", nil))
+}
+
+// NewInProcessClientWithRouter creates a client that takes each message's
+// topic, QoS and retain flag from router.
+func NewInProcessClientWithRouter(server *mqtt.Server, router *TopicRouter) loadgen.Client {
+	return &InProcessClient{server: server, router: router}
 }
 
 // Connect is a no-op because no network connection is needed.
@@ -46,18 +52,26 @@ func (c *InProcessClient) Publish(ctx context.Context, device *loadgen.Device) (
 		return false, err
 	}
 
+	if c.err != nil {
+		return false, c.err
+	}
+
 	payloadBytes, err := device.PayloadGenerator.GeneratePayload(device)
 	if err != nil {
 		return false, fmt.Errorf("failed to generate payload for device %s: %w", device.ID, err)
 	}
 
-	topic := strings.Replace(c.topicPattern, "+", device.ID, 1)
+	topic, qos, retain, err := c.router.Route(device, payloadBytes)
+	if err != nil {
+		return false, err
+	}
 
 	// Create the MQTT packet to be published.
 	pk := packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
-			Qos:  c.qos,
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retain,
 		},
 		TopicName: topic,
 		Payload:   payloadBytes,
@@ -65,7 +79,7 @@ func (c *InProcessClient) Publish(ctx context.Context, device *loadgen.Device) (
 
 	// Publish directly to the server. This method bypasses the network stack.
 	// The server will distribute it to any subscribed clients (if any).
-	if err := c.server.Publish(pk.TopicName, pk.Payload, false, c.qos); err != nil {
+	if err := c.server.Publish(pk.TopicName, pk.Payload, pk.FixedHeader.Retain, pk.FixedHeader.Qos); err != nil {
 		slog.Error("InProcessClient: publish failed", "topic", pk.TopicName, "error", err)
 		return false, err
 	}
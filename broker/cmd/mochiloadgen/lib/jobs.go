@@ -0,0 +1,340 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// JobState is the lifecycle state of a load test job.
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// defaultMaxJobs is how many jobs the manager remembers, including running ones.
+const defaultMaxJobs = 50
+
+// ErrShuttingDown is returned by Start once the manager has begun shutting down.
+var ErrShuttingDown = errors.New("load generator is shutting down")
+
+// JobStatus is a snapshot of a load test job, as returned by the API.
+type JobStatus struct {
+	ID              string     `json:"id"`
+	State           JobState   `json:"state"`
+	Devices         int        `json:"devices"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	ElapsedSeconds  float64    `json:"elapsed_seconds"`
+	Published       int64      `json:"published"`
+	PublishErrors   int64      `json:"publish_errors"`
+	Error           string     `json:"error,omitempty"`
+
+	Latency *LatencyStats `json:"latency,omitempty"`
+	Faults  *FaultCounts  `json:"faults,omitempty"`
+
+	Connections *ConnectionStats `json:"connections,omitempty"`
+}
+
+// RunFunc runs a load test until it finishes or ctx is cancelled.
+type RunFunc func(ctx context.Context, client loadgen.Client) (int, error)
+
+// StatusReporter adds its own results to a job's status snapshot.
+type StatusReporter interface {
+	ReportStatus(status *JobStatus)
+}
+
+// job is the manager's record of a single load test.
+type job struct {
+	id        string
+	devices   int
+	duration  time.Duration
+	startedAt time.Time
+	cancel    context.CancelFunc
+	client    *CountingClient
+	reporters []StatusReporter
+
+	mu           sync.Mutex
+	state        JobState
+	finishedAt   time.Time
+	err          error
+	cancelled    bool
+	cancelReason string
+}
+
+// JobManager starts load tests as jobs and keeps their status for the API.
+// Only the most recent maxJobs finished jobs are kept.
+type JobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	order   []string
+	maxJobs int
+	closed  bool
+	running sync.WaitGroup
+}
+
+// NewJobManager creates a manager remembering up to maxJobs jobs.
+func NewJobManager(maxJobs int) *JobManager {
+	if maxJobs <= 0 {
+		maxJobs = defaultMaxJobs
+	}
+	return &JobManager{
+		jobs:    make(map[string]*job),
+		maxJobs: maxJobs,
+	}
+}
+
+// Start runs the load test in the background and returns its initial status.
+// The client is wrapped so the job can report live publish counts, and any
+// reporters add their results to every status. Once Shutdown has been called
+// it returns ErrShuttingDown.
+func (m *JobManager) Start(client loadgen.Client, devices int, duration time.Duration, run RunFunc, reporters ...StatusReporter) (JobStatus, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:        newJobID(),
+		devices:   devices,
+		duration:  duration,
+		startedAt: time.Now().UTC(),
+		cancel:    cancel,
+		client:    NewCountingClient(client),
+		reporters: reporters,
+		state:     JobRunning,
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		cancel()
+		return JobStatus{}, ErrShuttingDown
+	}
+	m.jobs[j.id] = j
+	m.order = append(m.order, j.id)
+	m.evictLocked()
+	m.running.Add(1)
+	m.mu.Unlock()
+
+	go func() {
+		defer m.running.Done()
+		defer cancel()
+		_, err := run(ctx, j.client)
+		j.finish(err)
+	}()
+
+	return j.status(), nil
+}
+
+// Get returns the status of a job.
+func (m *JobManager) Get(id string) (JobStatus, bool) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return JobStatus{}, false
+	}
+	return j.status(), true
+}
+
+// List returns the status of all remembered jobs, newest first.
+func (m *JobManager) List() []JobStatus {
+	m.mu.Lock()
+	jobs := make([]*job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.status())
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].StartedAt.After(statuses[k].StartedAt) })
+	return statuses
+}
+
+// Cancel stops a running job through its context. It reports false if there
+// is no such job; cancelling a finished job is a no-op.
+func (m *JobManager) Cancel(id string) (JobStatus, bool) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return JobStatus{}, false
+	}
+
+	j.requestCancel("cancelled by request")
+	return j.status(), true
+}
+
+// Shutdown stops new jobs from starting and waits for running jobs to finish.
+// Jobs still running when ctx is done are cancelled. It returns the jobs that
+// were cut short, once they have stopped.
+func (m *JobManager) Shutdown(ctx context.Context) []JobStatus {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	var cutShort []*job
+	for _, j := range m.jobs {
+		if j.requestCancel("cancelled by server shutdown") {
+			cutShort = append(cutShort, j)
+		}
+	}
+	m.mu.Unlock()
+	<-drained
+
+	statuses := make([]JobStatus, 0, len(cutShort))
+	for _, j := range cutShort {
+		statuses = append(statuses, j.status())
+	}
+	return statuses
+}
+
+// evictLocked drops the oldest finished jobs beyond maxJobs. Running jobs are
+// never evicted. The caller must hold m.mu.
+func (m *JobManager) evictLocked() {
+	for i := 0; len(m.order) > m.maxJobs && i < len(m.order); {
+		id := m.order[i]
+		if m.jobs[id].baseStatus().State == JobRunning {
+			i++
+			continue
+		}
+		delete(m.jobs, id)
+		m.order = append(m.order[:i], m.order[i+1:]...)
+	}
+}
+
+// requestCancel cancels the job's context, recording why. It reports whether
+// the job was still running.
+func (j *job) requestCancel(reason string) bool {
+	j.mu.Lock()
+	running := j.state == JobRunning
+	if running && !j.cancelled {
+		j.cancelled = true
+		j.cancelReason = reason
+	}
+	j.mu.Unlock()
+	j.cancel()
+	return running
+}
+
+// finish records the outcome of the run.
+func (j *job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now().UTC()
+	switch {
+	case j.cancelled:
+		j.state = JobCancelled
+	case err != nil && !errors.Is(err, context.Canceled):
+		j.state = JobFailed
+		j.err = err
+	default:
+		j.state = JobCompleted
+	}
+}
+
+// status returns a snapshot of the job.
+func (j *job) status() JobStatus {
+	status := j.baseStatus()
+	for _, reporter := range j.reporters {
+		reporter.ReportStatus(&status)
+	}
+	return status
+}
+
+// baseStatus returns the job's own part of the snapshot.
+func (j *job) baseStatus() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JobStatus{
+		ID:              j.id,
+		State:           j.state,
+		Devices:         j.devices,
+		DurationSeconds: j.duration.Seconds(),
+		StartedAt:       j.startedAt,
+		Published:       j.client.Published(),
+		PublishErrors:   j.client.Errors(),
+	}
+	end := time.Now().UTC()
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		status.FinishedAt = &finishedAt
+		end = finishedAt
+	}
+	status.ElapsedSeconds = end.Sub(j.startedAt).Seconds()
+	if j.err != nil {
+		status.Error = j.err.Error()
+	} else if j.state == JobCancelled {
+		status.Error = j.cancelReason
+	}
+	return status
+}
+
+// newJobID returns a random 16 character hex ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// CountingClient wraps a loadgen.Client and counts successful and failed publishes.
+type CountingClient struct {
+	loadgen.Client
+	published atomic.Int64
+	errors    atomic.Int64
+}
+
+// NewCountingClient wraps client.
+func NewCountingClient(client loadgen.Client) *CountingClient {
+	return &CountingClient{Client: client}
+}
+
+// Publish publishes through the wrapped client and counts the outcome.
+func (c *CountingClient) Publish(ctx context.Context, device *loadgen.Device) (bool, error) {
+	ok, err := c.Client.Publish(ctx, device)
+	switch {
+	case err != nil:
+		if ctx.Err() == nil {
+			c.errors.Add(1)
+		}
+	case ok:
+		c.published.Add(1)
+	}
+	return ok, err
+}
+
+// Published returns the number of successful publishes.
+func (c *CountingClient) Published() int64 {
+	return c.published.Load()
+}
+
+// Errors returns the number of failed publishes.
+func (c *CountingClient) Errors() int64 {
+	return c.errors.Load()
+}
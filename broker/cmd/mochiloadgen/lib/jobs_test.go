@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubClient is a loadgen.Client that succeeds unless failWith is set.
+type stubClient struct {
+	failWith error
+}
+
+func (c *stubClient) Connect() error { return nil }
+func (c *stubClient) Disconnect()    {}
+func (c *stubClient) Publish(ctx context.Context, device *loadgen.Device) (bool, error) {
+	if c.failWith != nil {
+		return false, c.failWith
+	}
+	return true, nil
+}
+
+// publishUntilCancelled publishes through the client until the context is cancelled.
+func publishUntilCancelled(ctx context.Context, client loadgen.Client) (int, error) {
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		if ok, _ := client.Publish(ctx, &loadgen.Device{ID: "device-0001"}); ok {
+			count++
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestJobManagerTracksCompletedJob verifies a finished job reports its counts.
+func TestJobManagerTracksCompletedJob(t *testing.T) {
+	// --- Arrange ---
+	jobs := NewJobManager(10)
+
+	// --- Act ---
+	started, err := jobs.Start(&stubClient{}, 1, time.Second, func(ctx context.Context, client loadgen.Client) (int, error) {
+		for i := 0; i < 3; i++ {
+			_, _ = client.Publish(ctx, &loadgen.Device{ID: "device-0001"})
+		}
+		return 3, nil
+	})
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, JobRunning, started.State)
+	require.Eventually(t, func() bool {
+		status, ok := jobs.Get(started.ID)
+		return ok && status.State == JobCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+	status, _ := jobs.Get(started.ID)
+	assert.Equal(t, int64(3), status.Published)
+	assert.Zero(t, status.PublishErrors)
+	assert.NotNil(t, status.FinishedAt)
+}
+
+// TestJobManagerCancelsRunningJob verifies DELETE semantics: the job's context
+// is cancelled and it ends in the cancelled state.
+func TestJobManagerCancelsRunningJob(t *testing.T) {
+	// --- Arrange ---
+	jobs := NewJobManager(10)
+	started, err := jobs.Start(&stubClient{}, 1, time.Hour, publishUntilCancelled)
+	require.NoError(t, err)
+
+	// --- Act ---
+	_, ok := jobs.Cancel(started.ID)
+
+	// --- Assert ---
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		status, _ := jobs.Get(started.ID)
+		return status.State == JobCancelled
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = jobs.Cancel("missing")
+	assert.False(t, ok)
+}
+
+// TestJobManagerRecordsFailuresAndEvictsOldJobs verifies failed jobs keep their
+// error and only maxJobs finished jobs are remembered.
+func TestJobManagerRecordsFailuresAndEvictsOldJobs(t *testing.T) {
+	// --- Arrange ---
+	jobs := NewJobManager(2)
+	failing := &stubClient{failWith: errors.New("broker unavailable")}
+	run := func(ctx context.Context, client loadgen.Client) (int, error) {
+		_, err := client.Publish(ctx, &loadgen.Device{ID: "device-0001"})
+		return 0, err
+	}
+
+	// --- Act ---
+	var ids []string
+	for i := 0; i < 3; i++ {
+		status, err := jobs.Start(failing, 1, time.Second, run)
+		require.NoError(t, err)
+		ids = append(ids, status.ID)
+		require.Eventually(t, func() bool {
+			s, _ := jobs.Get(status.ID)
+			return s.State == JobFailed
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	_, err := jobs.Start(failing, 1, time.Second, run)
+	require.NoError(t, err)
+
+	// --- Assert ---
+	_, ok := jobs.Get(ids[0])
+	assert.False(t, ok, "the oldest finished job should be evicted")
+	status, ok := jobs.Get(ids[2])
+	require.True(t, ok)
+	assert.Equal(t, "broker unavailable", status.Error)
+	assert.Equal(t, int64(1), status.PublishErrors)
+	assert.Len(t, jobs.List(), 2)
+}
+
+// TestJobManagerShutdownDrainsThenCancels verifies shutdown refuses new jobs,
+// lets short jobs finish and cancels jobs still running at the deadline.
+func TestJobManagerShutdownDrainsThenCancels(t *testing.T) {
+	// --- Arrange ---
+	jobs := NewJobManager(10)
+	release := make(chan struct{})
+	short, err := jobs.Start(&stubClient{}, 1, time.Second, func(ctx context.Context, client loadgen.Client) (int, error) {
+		<-release
+		return 0, nil
+	})
+	require.NoError(t, err)
+	long, err := jobs.Start(&stubClient{}, 1, time.Hour, publishUntilCancelled)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	close(release)
+
+	// --- Act ---
+	cutShort := jobs.Shutdown(ctx)
+	_, startErr := jobs.Start(&stubClient{}, 1, time.Second, publishUntilCancelled)
+
+	// --- Assert ---
+	require.Len(t, cutShort, 1)
+	assert.Equal(t, long.ID, cutShort[0].ID)
+	assert.Equal(t, JobCancelled, cutShort[0].State)
+	assert.Equal(t, "cancelled by server shutdown", cutShort[0].Error)
+	status, _ := jobs.Get(short.ID)
+	assert.Equal(t, JobCompleted, status.State)
+	assert.ErrorIs(t, startErr, ErrShuttingDown)
+}
@@ -0,0 +1,311 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/illmade-knight/go-test/loadgen"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// StampField is the JSON field added to each payload when latency is measured.
+const StampField = "loadgen_stamp"
+
+// Latency receiver modes.
+const (
+	LatencyInline = "inline"
+	LatencyPubSub = "pubsub"
+)
+
+// maxLatencySamples bounds the memory used for percentiles; beyond it the
+// samples are a uniform reservoir of everything received.
+const maxLatencySamples = 100000
+
+// latencySeqWindow is how many of the most recent sequence numbers are
+// remembered to spot duplicates, in a ring of bits (128 KiB).
+const latencySeqWindow = 1 << 20
+
+// defaultLatencyDrain is how long the receiver keeps listening after the
+// last publish, so messages still in flight are not counted as lost.
+const defaultLatencyDrain = 5 * time.Second
+
+// inlineSubscriptionID is the first inline subscription ID used for latency receivers.
+var inlineSubscriptionID atomic.Int64
+
+// LatencyRequest turns on end-to-end latency measurement for a load test.
+// Payloads are stamped with a sequence number and send time and matched back
+// when they arrive on the MQTT filter (inline) or a Pub/Sub subscription on
+// the pipeline's output (pubsub). The pipeline must keep the stamp field.
+type LatencyRequest struct {
+	Mode           string  `json:"mode"`
+	Filter         string  `json:"filter,omitempty"`
+	ProjectID      string  `json:"project_id,omitempty"`
+	SubscriptionID string  `json:"subscription_id,omitempty"`
+	DrainSeconds   float64 `json:"drain_seconds,omitempty"`
+}
+
+// Validate checks the receiver has what it needs.
+func (l *LatencyRequest) Validate() error {
+	switch l.Mode {
+	case LatencyInline:
+	case LatencyPubSub:
+		if l.ProjectID == "" || l.SubscriptionID == "" {
+			return fmt.Errorf("pubsub latency measurement needs project_id and subscription_id")
+		}
+	default:
+		return fmt.Errorf("unknown latency mode %q (supported: %s, %s)", l.Mode, LatencyInline, LatencyPubSub)
+	}
+	if l.DrainSeconds < 0 {
+		return fmt.Errorf("latency drain_seconds must not be negative")
+	}
+	return nil
+}
+
+// Drain returns how long to keep receiving after the load test ends.
+func (l *LatencyRequest) Drain() time.Duration {
+	if l.DrainSeconds == 0 {
+		return defaultLatencyDrain
+	}
+	return time.Duration(l.DrainSeconds * float64(time.Second))
+}
+
+// LatencyStats is the latency section of a job's status. Lost is stamped
+// messages not (yet) received, so it only settles once the job has finished.
+// Injected duplicates carry no new stamp and Corrupted messages (malformed or
+// truncated by fault injection) cannot be matched, so neither counts as lost.
+type LatencyStats struct {
+	Received   int64   `json:"received"`
+	Lost       int64   `json:"lost"`
+	LossRatio  float64 `json:"loss_ratio"`
+	Duplicates int64   `json:"duplicates"`
+	Unstamped  int64   `json:"unstamped"`
+	Corrupted  int64   `json:"corrupted"`
+	P50Ms      float64 `json:"p50_ms"`
+	P95Ms      float64 `json:"p95_ms"`
+	P99Ms      float64 `json:"p99_ms"`
+	MaxMs      float64 `json:"max_ms"`
+}
+
+// payloadStamp is the value stored under StampField.
+type payloadStamp struct {
+	Seq          int64 `json:"seq"`
+	SentUnixNano int64 `json:"sent_unix_nano"`
+}
+
+// LatencyTracker stamps outgoing payloads and matches received ones back.
+type LatencyTracker struct {
+	seq    atomic.Int64
+	faults *FaultCounters
+
+	mu         sync.Mutex
+	seen       seqWindow
+	samples    []time.Duration
+	observed   int64
+	max        time.Duration
+	duplicates int64
+	unstamped  int64
+	rng        *rand.Rand
+}
+
+// NewLatencyTracker creates an empty tracker. faults, if not nil, are the
+// job's fault counters, used to keep injected faults out of the loss count.
+func NewLatencyTracker(faults *FaultCounters) *LatencyTracker {
+	return &LatencyTracker{
+		faults: faults,
+		seen:   newSeqWindow(latencySeqWindow),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Stamp adds the next sequence number and the current time to a JSON object payload.
+func (t *LatencyTracker) Stamp(payload []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("latency measurement needs JSON object payloads")
+	}
+	stamp, err := json.Marshal(payloadStamp{Seq: t.seq.Add(1), SentUnixNano: time.Now().UnixNano()})
+	if err != nil {
+		return nil, err
+	}
+	fields[StampField] = stamp
+	return json.Marshal(fields)
+}
+
+// Observe records a received payload. Payloads without a stamp are counted
+// but otherwise ignored.
+func (t *LatencyTracker) Observe(payload []byte, receivedAt time.Time) {
+	var msg struct {
+		Stamp *payloadStamp `json:"loadgen_stamp"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Stamp == nil {
+		t.mu.Lock()
+		t.unstamped++
+		t.mu.Unlock()
+		return
+	}
+	latency := receivedAt.Sub(time.Unix(0, msg.Stamp.SentUnixNano))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen.add(msg.Stamp.Seq) {
+		t.duplicates++
+		return
+	}
+	t.observed++
+	if latency > t.max {
+		t.max = latency
+	}
+	if len(t.samples) < maxLatencySamples {
+		t.samples = append(t.samples, latency)
+	} else if i := t.rng.Int63n(t.observed); i < maxLatencySamples {
+		t.samples[i] = latency
+	}
+}
+
+// Stats summarises what has been received against the published count.
+func (t *LatencyTracker) Stats(published int64) LatencyStats {
+	t.mu.Lock()
+	samples := append([]time.Duration(nil), t.samples...)
+	stats := LatencyStats{
+		Received:   t.observed,
+		Duplicates: t.duplicates,
+		Unstamped:  t.unstamped,
+		MaxMs:      milliseconds(t.max),
+	}
+	t.mu.Unlock()
+
+	expected := published
+	if t.faults != nil {
+		counts := t.faults.Counts()
+		stats.Corrupted = counts.Malformed + counts.Truncated
+		expected -= counts.Duplicated + stats.Corrupted
+	}
+	if lost := expected - stats.Received; lost > 0 {
+		stats.Lost = lost
+		stats.LossRatio = float64(lost) / float64(expected)
+	}
+	sort.Slice(samples, func(i, k int) bool { return samples[i] < samples[k] })
+	stats.P50Ms = milliseconds(percentile(samples, 0.50))
+	stats.P95Ms = milliseconds(percentile(samples, 0.95))
+	stats.P99Ms = milliseconds(percentile(samples, 0.99))
+	return stats
+}
+
+// ReportStatus adds the latency stats to a job's status.
+func (t *LatencyTracker) ReportStatus(status *JobStatus) {
+	stats := t.Stats(status.Published)
+	status.Latency = &stats
+}
+
+// seqWindow remembers which of the most recent sequence numbers have been
+// seen, in a fixed ring of bits that slides forward with the highest one.
+type seqWindow struct {
+	bits    []uint64
+	highest int64
+}
+
+// newSeqWindow creates a window of size sequence numbers, a multiple of 64.
+func newSeqWindow(size int) seqWindow {
+	return seqWindow{bits: make([]uint64, size/64)}
+}
+
+// add records seq and reports whether it had already been seen. A sequence
+// number that has fallen out of the window cannot be checked and counts as new.
+func (w *seqWindow) add(seq int64) bool {
+	size := int64(len(w.bits) * 64)
+	switch {
+	case seq > w.highest:
+		// Forget the slots the window slides over before reusing them.
+		from := max(w.highest+1, seq-size+1)
+		for s := range seq - from + 1 {
+			i := uint64(from+s) % uint64(size)
+			w.bits[i/64] &^= 1 << (i % 64)
+		}
+		w.highest = seq
+	case seq <= w.highest-size:
+		return false
+	}
+	i := uint64(seq) % uint64(size)
+	word, bit := i/64, uint64(1)<<(i%64)
+	if w.bits[word]&bit != 0 {
+		return true
+	}
+	w.bits[word] |= bit
+	return false
+}
+
+// percentile returns the nearest-rank percentile of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// milliseconds converts d to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// stampingGenerator stamps the payloads of the generator it wraps.
+type stampingGenerator struct {
+	loadgen.PayloadGenerator
+	tracker *LatencyTracker
+}
+
+// GeneratePayload generates the wrapped payload and stamps it.
+func (g *stampingGenerator) GeneratePayload(device *loadgen.Device) ([]byte, error) {
+	payload, err := g.PayloadGenerator.GeneratePayload(device)
+	if err != nil {
+		return nil, err
+	}
+	return g.tracker.Stamp(payload)
+}
+
+// StampDevices wraps every device's payload generator so its payloads are
+// stamped. Stamps go beneath any fault injection, so a duplicated message
+// keeps its original stamp and is counted as a duplicate.
+func StampDevices(devices []*loadgen.Device, tracker *LatencyTracker) {
+	for _, device := range devices {
+		if faulty, ok := device.PayloadGenerator.(*faultGenerator); ok {
+			faulty.inner = &stampingGenerator{PayloadGenerator: faulty.inner, tracker: tracker}
+			continue
+		}
+		device.PayloadGenerator = &stampingGenerator{PayloadGenerator: device.PayloadGenerator, tracker: tracker}
+	}
+}
+
+// SubscribeLatency observes publishes matching filter through an inline
+// subscription. The returned function removes the subscription.
+func SubscribeLatency(server *mqtt.Server, filter string, tracker *LatencyTracker) (func(), error) {
+	id := int(inlineSubscriptionID.Add(1))
+	err := server.Subscribe(filter, id, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		tracker.Observe(pk.Payload, time.Now())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s for latency measurement: %w", filter, err)
+	}
+	return func() { _ = server.Unsubscribe(filter, id) }, nil
+}
+
+// ReceiveLatency observes messages from a Pub/Sub subscription until ctx is cancelled.
+func ReceiveLatency(ctx context.Context, client *pubsub.Client, subID string, tracker *LatencyTracker) error {
+	qualifiedSubName := fmt.Sprintf("projects/%s/subscriptions/%s", client.Project(), subID)
+	return client.Subscriber(qualifiedSubName).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		tracker.Observe(msg.Data, time.Now())
+		msg.Ack()
+	})
+}
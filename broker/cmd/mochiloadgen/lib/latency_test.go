@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLatencyTrackerStats verifies stamped payloads are matched back with
+// duplicates, unstamped messages and losses counted separately.
+func TestLatencyTrackerStats(t *testing.T) {
+	// --- Arrange ---
+	tracker := NewLatencyTracker(nil)
+	var stamped [][]byte
+	for i := 0; i < 4; i++ {
+		payload, err := tracker.Stamp([]byte(`{"de":"garden-00001"}`))
+		require.NoError(t, err)
+		stamped = append(stamped, payload)
+	}
+	_, err := tracker.Stamp([]byte("not json"))
+	require.Error(t, err)
+
+	// --- Act ---
+	now := time.Now()
+	tracker.Observe(stamped[0], now.Add(10*time.Millisecond))
+	tracker.Observe(stamped[1], now.Add(20*time.Millisecond))
+	tracker.Observe(stamped[2], now.Add(30*time.Millisecond))
+	tracker.Observe(stamped[2], now.Add(40*time.Millisecond))
+	tracker.Observe([]byte(`{"de":"garden-00001"}`), now)
+	stats := tracker.Stats(4)
+
+	// --- Assert ---
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(stamped[0], &fields))
+	assert.Contains(t, fields, "de")
+	assert.Contains(t, fields, StampField)
+
+	assert.Equal(t, int64(3), stats.Received)
+	assert.Equal(t, int64(1), stats.Duplicates)
+	assert.Equal(t, int64(1), stats.Unstamped)
+	assert.Equal(t, int64(1), stats.Lost)
+	assert.InDelta(t, 0.25, stats.LossRatio, 0.001)
+	assert.Greater(t, stats.P50Ms, 10.0)
+	assert.GreaterOrEqual(t, stats.P99Ms, stats.P95Ms)
+	assert.GreaterOrEqual(t, stats.P95Ms, stats.P50Ms)
+	assert.Equal(t, stats.P99Ms, stats.MaxMs)
+}
+
+// TestLatencyTrackerExcludesInjectedFaults verifies injected duplicates and
+// corrupted payloads are reported but not counted as lost.
+func TestLatencyTrackerExcludesInjectedFaults(t *testing.T) {
+	// --- Arrange ---
+	faults := &FaultCounters{}
+	tracker := NewLatencyTracker(faults)
+	var stamped [][]byte
+	for i := 0; i < 8; i++ {
+		payload, err := tracker.Stamp([]byte(`{"de":"garden-00001"}`))
+		require.NoError(t, err)
+		stamped = append(stamped, payload)
+	}
+	// Of 10 publishes: 2 are duplicates of earlier payloads and 2 of the 8
+	// stamped payloads are corrupted, leaving 6 that can be matched.
+	faults.duplicated.Add(2)
+	faults.malformed.Add(1)
+	faults.truncated.Add(1)
+
+	// --- Act ---
+	now := time.Now()
+	for _, payload := range stamped[:5] {
+		tracker.Observe(payload, now)
+	}
+	tracker.Observe(stamped[0], now)
+	tracker.Observe([]byte(`{"de":`), now)
+	stats := tracker.Stats(10)
+
+	// --- Assert ---
+	assert.Equal(t, int64(5), stats.Received)
+	assert.Equal(t, int64(1), stats.Duplicates)
+	assert.Equal(t, int64(1), stats.Unstamped)
+	assert.Equal(t, int64(2), stats.Corrupted)
+	assert.Equal(t, int64(1), stats.Lost)
+	assert.InDelta(t, 1.0/6, stats.LossRatio, 0.001)
+}
+
+// TestSeqWindow verifies duplicates are spotted within the window and that
+// the window slides forward without growing.
+func TestSeqWindow(t *testing.T) {
+	testCases := []struct {
+		name string
+		seqs []int64
+		dup  bool
+	}{
+		{"first sighting", []int64{1}, false},
+		{"repeat", []int64{1, 1}, true},
+		{"late arrival within the window", []int64{3, 1, 2, 1}, true},
+		{"slot reused after sliding", []int64{1, 129}, false},
+		{"repeat after sliding", []int64{1, 129, 129}, true},
+		{"fallen out of the window", []int64{1, 200, 1}, false},
+		{"large jump", []int64{5, 1 << 40, 5}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			window := newSeqWindow(128)
+			last := len(tc.seqs) - 1
+			for _, seq := range tc.seqs[:last] {
+				window.add(seq)
+			}
+
+			// --- Act ---
+			dup := window.add(tc.seqs[last])
+
+			// --- Assert ---
+			assert.Equal(t, tc.dup, dup)
+			assert.Len(t, window.bits, 2)
+		})
+	}
+}
+
+// TestInlineLatencyMeasurement runs stamped publishes through an in-memory
+// broker and checks the job status reports them as received.
+func TestInlineLatencyMeasurement(t *testing.T) {
+	// --- Arrange ---
+	server, _ := newInlineServer(t, "unused/#")
+	tracker := NewLatencyTracker(nil)
+	stop, err := SubscribeLatency(server, "devices/+/data", tracker)
+	require.NoError(t, err)
+	defer stop()
+
+	devices := []*loadgen.Device{{ID: "garden-00001", PayloadGenerator: NewGardenMonitorPayloadGenerator()}}
+	StampDevices(devices, tracker)
+	client := NewCountingClient(NewInProcessClient(server, "devices/+/data", 0))
+
+	// --- Act ---
+	for i := 0; i < 5; i++ {
+		_, err := client.Publish(context.Background(), devices[0])
+		require.NoError(t, err)
+	}
+
+	// --- Assert ---
+	require.Eventually(t, func() bool {
+		return tracker.Stats(client.Published()).Received == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	status := JobStatus{Published: client.Published()}
+	tracker.ReportStatus(&status)
+	require.NotNil(t, status.Latency)
+	assert.Zero(t, status.Latency.Lost)
+	assert.Zero(t, status.Latency.Duplicates)
+}
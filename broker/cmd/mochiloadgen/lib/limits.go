@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// RequestLimits caps what a single load test request may ask for. A zero
+// field is not limited.
+type RequestLimits struct {
+	// MaxDevices is the most devices a request may run, after fleets expand.
+	MaxDevices int
+	// MaxRateHz is the most messages per second a request may publish across
+	// all its devices, at the peak of any rate profile.
+	MaxRateHz float64
+	// MaxDuration is the longest a request may run.
+	MaxDuration time.Duration
+}
+
+// Check returns an error naming the first limit the request would exceed.
+// rateHz is the request's peak total rate and duration how long it runs.
+func (l RequestLimits) Check(devices int, rateHz float64, duration time.Duration) error {
+	if l.MaxDevices > 0 && devices > l.MaxDevices {
+		return fmt.Errorf("request runs %d devices, more than the limit of %d", devices, l.MaxDevices)
+	}
+	if l.MaxRateHz > 0 && rateHz > l.MaxRateHz {
+		if math.IsInf(rateHz, 1) {
+			return fmt.Errorf("request has no rate bound, but rates are limited to %g Hz", l.MaxRateHz)
+		}
+		return fmt.Errorf("request publishes at up to %g Hz, more than the limit of %g Hz", rateHz, l.MaxRateHz)
+	}
+	if l.MaxDuration > 0 && duration > l.MaxDuration {
+		return fmt.Errorf("request runs for %s, more than the limit of %s", duration, l.MaxDuration)
+	}
+	return nil
+}
+
+// peakRate is the most messages per second devices publish in total: the
+// profile's peak rate for every device, or the sum of their own rates.
+func peakRate(devices []*loadgen.Device, profile *RateProfile) float64 {
+	if profile != nil {
+		return profile.PeakRate() * float64(len(devices))
+	}
+	var total float64
+	for _, device := range devices {
+		total += device.MessageRate
+	}
+	return total
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRequestLimitsCheck verifies each limit is enforced only when set.
+func TestRequestLimitsCheck(t *testing.T) {
+	limits := RequestLimits{MaxDevices: 100, MaxRateHz: 50, MaxDuration: 10 * time.Minute}
+
+	testCases := []struct {
+		name     string
+		limits   RequestLimits
+		devices  int
+		rateHz   float64
+		duration time.Duration
+		wantErr  string
+	}{
+		{name: "within limits", limits: limits, devices: 100, rateHz: 50, duration: 10 * time.Minute},
+		{name: "too many devices", limits: limits, devices: 101, rateHz: 1, duration: time.Minute, wantErr: "101 devices"},
+		{name: "rate too high", limits: limits, devices: 10, rateHz: 60, duration: time.Minute, wantErr: "60 Hz"},
+		{name: "unbounded rate", limits: limits, devices: 10, rateHz: math.Inf(1), duration: 0, wantErr: "no rate bound"},
+		{name: "too long", limits: limits, devices: 10, rateHz: 1, duration: time.Hour, wantErr: "1h0m0s"},
+		{name: "no limits", devices: 50000, rateHz: math.Inf(1), duration: 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			err := tc.limits.Check(tc.devices, tc.rateHz, tc.duration)
+
+			// --- Assert ---
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestPeakRate verifies a profile's peak applies to every device, and that
+// devices otherwise add up their own rates.
+func TestPeakRate(t *testing.T) {
+	devices := []*loadgen.Device{{MessageRate: 2}, {MessageRate: 3}}
+
+	assert.Equal(t, 5.0, peakRate(devices, nil))
+	assert.Equal(t, 80.0, peakRate(devices, &RateProfile{Type: ProfileSpike, BaseRateHz: 2, SpikeRateHz: 40}))
+	assert.Equal(t, 40.0, peakRate(devices, &RateProfile{Type: ProfileStep, Stages: []ProfileStage{{RateHz: 20}, {RateHz: 5}}}))
+}
+
+// TestHandleLoadTestRejectsRequestsOverLimits verifies the handler refuses a
+// request over its limits before starting a job.
+func TestHandleLoadTestRejectsRequestsOverLimits(t *testing.T) {
+	// --- Arrange ---
+	server, _ := newInlineServer(t, "devices/+/data")
+	handler := NewHandler(server)
+	handler.SetLimits(RequestLimits{MaxDevices: 10, MaxRateHz: 100, MaxDuration: time.Minute})
+
+	testCases := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name:    "fleet too large",
+			body:    `{"duration_seconds": 10, "topic_pattern": "devices/+/data", "fleets": [{"count": 11, "id_pattern": "garden-{03d}", "rate_hz": 1, "payload_generator": "gardenMonitor"}]}`,
+			wantErr: "11 devices",
+		},
+		{
+			name:    "profile peak too high",
+			body:    `{"duration_seconds": 10, "topic_pattern": "devices/+/data", "profile": {"type": "ramp", "start_rate_hz": 1, "end_rate_hz": 20}, "fleets": [{"count": 10, "id_pattern": "garden-{03d}", "rate_hz": 1, "payload_generator": "gardenMonitor"}]}`,
+			wantErr: "200 Hz",
+		},
+		{
+			name:    "too long",
+			body:    `{"duration_seconds": 3600, "topic_pattern": "devices/+/data", "devices": [{"id": "garden-001", "message_rate_hz": 1, "payload_generator": "gardenMonitor"}]}`,
+			wantErr: "1h0m0s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			handler.HandleLoadTest(rec, httptest.NewRequest(http.MethodPost, "/load-test", strings.NewReader(tc.body)))
+
+			// --- Assert ---
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), tc.wantErr)
+		})
+	}
+	assert.Empty(t, handler.jobs.List(), "no job should have started")
+}
+
+// TestHandlersRejectOversizedBodies verifies the load test and passthrough
+// handlers stop reading at the body cap. A load test gets a 413; a push
+// message is dropped, as redelivering it cannot help.
+func TestHandlersRejectOversizedBodies(t *testing.T) {
+	// --- Arrange ---
+	server, _ := newInlineServer(t, "#")
+	handler := NewHandler(server)
+	handler.SetMaxBodyBytes(64)
+	body := `{"duration_seconds": 10, "topic_pattern": "devices/+/data", "padding": "` + strings.Repeat("x", 64) + `"}`
+
+	testCases := []struct {
+		name       string
+		handle     http.HandlerFunc
+		path       string
+		wantStatus int
+	}{
+		{name: "load test", handle: handler.HandleLoadTest, path: "/load-test", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "passthrough", handle: handler.HandlePassthrough, path: "/passthrough", wantStatus: http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			tc.handle(rec, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body)))
+
+			// --- Assert ---
+			assert.Equal(t, tc.wantStatus, rec.Code)
+		})
+	}
+	assert.Empty(t, handler.jobs.List(), "no job should have started")
+	assert.Equal(t, int64(1), handler.PassthroughDropped())
+}
@@ -0,0 +1,383 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// Load test client modes.
+const (
+	ClientInProcess = "inprocess"
+	ClientNetwork   = "network"
+)
+
+// Defaults for the network client.
+const (
+	defaultKeepalive          = 30 * time.Second
+	defaultConnectTimeout     = 10 * time.Second
+	defaultConnectConcurrency = 50
+)
+
+// errDeviceNotConnected is returned when publishing for a device whose
+// connection failed and has not been re-established.
+var errDeviceNotConnected = errors.New("device is not connected")
+
+// ClientRequest selects the client a load test publishes through. The default
+// in-process client bypasses the network; the network client opens one MQTT
+// connection per device to BrokerURL.
+type ClientRequest struct {
+	Mode           string  `json:"mode"`
+	BrokerURL      string  `json:"broker_url,omitempty"`
+	Username       string  `json:"username,omitempty"`
+	Password       string  `json:"password,omitempty"`
+	PasswordSecret string  `json:"password_secret,omitempty"`
+	ClientIDPrefix string  `json:"client_id_prefix,omitempty"`
+	KeepaliveSecs  int     `json:"keepalive_seconds,omitempty"`
+	Churn          *Churn  `json:"churn,omitempty"`
+	ConnectPerSec  float64 `json:"connect_rate_per_second,omitempty"`
+}
+
+// Churn makes devices drop their connection and come back. Across the whole
+// fleet, DisconnectsPerMinute random connected devices disconnect each
+// minute and reconnect after OfflineSeconds.
+type Churn struct {
+	DisconnectsPerMinute float64 `json:"disconnects_per_minute"`
+	OfflineSeconds       float64 `json:"offline_seconds"`
+}
+
+// Validate checks the request has what the chosen mode needs.
+func (c *ClientRequest) Validate() error {
+	switch c.Mode {
+	case "", ClientInProcess:
+		if c.Churn != nil {
+			return fmt.Errorf("connection churn needs the network client")
+		}
+		return nil
+	case ClientNetwork:
+	default:
+		return fmt.Errorf("unknown client mode %q (supported: %s, %s)", c.Mode, ClientInProcess, ClientNetwork)
+	}
+	if !strings.Contains(c.BrokerURL, "://") {
+		return fmt.Errorf("network client needs a broker_url such as tcp://localhost:1883")
+	}
+	if c.Password != "" && c.PasswordSecret != "" {
+		return fmt.Errorf("set only one of password and password_secret")
+	}
+	if c.KeepaliveSecs < 0 || c.ConnectPerSec < 0 {
+		return fmt.Errorf("keepalive_seconds and connect_rate_per_second must not be negative")
+	}
+	if c.Churn != nil && (c.Churn.DisconnectsPerMinute <= 0 || c.Churn.OfflineSeconds < 0) {
+		return fmt.Errorf("churn needs a positive disconnects_per_minute and a non-negative offline_seconds")
+	}
+	return nil
+}
+
+// Network reports whether the request selects the network client.
+func (c *ClientRequest) Network() bool {
+	return c != nil && c.Mode == ClientNetwork
+}
+
+// ConnectionStats is the connections section of a job's status.
+type ConnectionStats struct {
+	Connected        int64 `json:"connected"`
+	Connects         int64 `json:"connects"`
+	ConnectFailures  int64 `json:"connect_failures"`
+	ChurnDisconnects int64 `json:"churn_disconnects"`
+	ConnectionsLost  int64 `json:"connections_lost"`
+	OfflineSkips     int64 `json:"offline_skips"`
+}
+
+// NetworkOptions configures a NetworkClient.
+type NetworkOptions struct {
+	BrokerURL      string
+	Username       string
+	Password       string
+	ClientIDPrefix string
+	Keepalive      time.Duration
+	ConnectPerSec  float64
+	Churn          *Churn
+	Router         *TopicRouter
+}
+
+// networkDevice is one simulated device's MQTT connection.
+type networkDevice struct {
+	id     string
+	client paho.Client
+
+	mu      sync.Mutex
+	offline bool // disconnected on purpose by churn
+}
+
+// NetworkClient implements loadgen.Client with a real MQTT connection per
+// device, so load tests exercise connection handling and authentication.
+type NetworkClient struct {
+	opts    NetworkOptions
+	devices map[string]*networkDevice
+	order   []*networkDevice
+
+	// ctx bounds Connect and the churn loop; loadgen.Client's Connect takes no context.
+	ctx context.Context
+
+	stopChurn context.CancelFunc
+	churnDone chan struct{}
+
+	connects         atomic.Int64
+	connectFailures  atomic.Int64
+	churnDisconnects atomic.Int64
+	connectionsLost  atomic.Int64
+	offlineSkips     atomic.Int64
+}
+
+// NewNetworkClient creates a client for devices. Nothing connects until Connect.
+func NewNetworkClient(opts NetworkOptions, devices []*loadgen.Device) *NetworkClient {
+	if opts.Keepalive <= 0 {
+		opts.Keepalive = defaultKeepalive
+	}
+	if opts.ClientIDPrefix == "" {
+		opts.ClientIDPrefix = "loadgen-"
+	}
+
+	c := &NetworkClient{opts: opts, devices: make(map[string]*networkDevice, len(devices)), ctx: context.Background()}
+	for _, device := range devices {
+		d := &networkDevice{id: device.ID}
+		d.client = paho.NewClient(c.clientOptions(d))
+		c.devices[device.ID] = d
+		c.order = append(c.order, d)
+	}
+	return c
+}
+
+// clientOptions builds the paho options for one device. Reconnection is left
+// to the churn loop so dropped connections are visible in the stats.
+func (c *NetworkClient) clientOptions(d *networkDevice) *paho.ClientOptions {
+	opts := paho.NewClientOptions()
+	opts.AddBroker(c.opts.BrokerURL)
+	opts.SetClientID(c.opts.ClientIDPrefix + d.id)
+	opts.SetUsername(c.opts.Username)
+	opts.SetPassword(c.opts.Password)
+	opts.SetKeepAlive(c.opts.Keepalive)
+	opts.SetConnectTimeout(defaultConnectTimeout)
+	opts.SetAutoReconnect(false)
+	opts.SetCleanSession(true)
+	opts.SetConnectionLostHandler(func(paho.Client, error) {
+		c.connectionsLost.Add(1)
+	})
+	return opts
+}
+
+// SetContext ties the client to ctx, normally its job's: once ctx is done,
+// Connect stops dialing and churn stops. Call it before Connect.
+func (c *NetworkClient) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// Connect opens every device's connection, paced by the connect rate. It
+// fails only if no device could connect, or if the client's context is done
+// before every device has been dialed; individual failures are counted.
+func (c *NetworkClient) Connect() error {
+	var pace <-chan time.Time
+	if c.opts.ConnectPerSec > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / c.opts.ConnectPerSec))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	sem := make(chan struct{}, defaultConnectConcurrency)
+	var wg sync.WaitGroup
+	var lastErr atomic.Value
+dial:
+	for _, d := range c.order {
+		if pace != nil {
+			select {
+			case <-c.ctx.Done():
+				break dial
+			case <-pace:
+			}
+		}
+		select {
+		case <-c.ctx.Done():
+			break dial
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(d *networkDevice) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := c.connect(d); err != nil {
+				lastErr.Store(err)
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if err := c.ctx.Err(); err != nil {
+		c.Disconnect()
+		return fmt.Errorf("connecting devices stopped after %d connects: %w", c.connects.Load(), err)
+	}
+	if len(c.order) > 0 && c.connects.Load() == 0 {
+		err, _ := lastErr.Load().(error)
+		return fmt.Errorf("no device could connect to %s: %w", c.opts.BrokerURL, err)
+	}
+	slog.Info("NetworkClient: devices connected", "connected", c.connects.Load(), "failed", c.connectFailures.Load())
+
+	if c.opts.Churn != nil {
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.stopChurn = cancel
+		c.churnDone = make(chan struct{})
+		go c.churn(ctx)
+	}
+	return nil
+}
+
+// connect opens one device's connection.
+func (c *NetworkClient) connect(d *networkDevice) error {
+	token := d.client.Connect()
+	if !token.WaitTimeout(defaultConnectTimeout) {
+		c.connectFailures.Add(1)
+		return fmt.Errorf("device %s: connect timed out", d.id)
+	}
+	if err := token.Error(); err != nil {
+		c.connectFailures.Add(1)
+		return fmt.Errorf("device %s: %w", d.id, err)
+	}
+	c.connects.Add(1)
+	return nil
+}
+
+// churn disconnects random connected devices at the configured rate and
+// reconnects each after the offline period.
+func (c *NetworkClient) churn(ctx context.Context) {
+	defer close(c.churnDone)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	mean := time.Duration(float64(time.Minute) / c.opts.Churn.DisconnectsPerMinute)
+	offline := time.Duration(c.opts.Churn.OfflineSeconds * float64(time.Second))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		// Exponential gaps make the disconnects a Poisson process.
+		wait := time.Duration(rng.ExpFloat64() * float64(mean))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		d := c.order[rng.Intn(len(c.order))]
+		d.mu.Lock()
+		if d.offline || !d.client.IsConnected() {
+			d.mu.Unlock()
+			continue
+		}
+		d.offline = true
+		d.mu.Unlock()
+
+		d.client.Disconnect(0)
+		c.churnDisconnects.Add(1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(offline):
+			}
+			if err := c.connect(d); err != nil {
+				slog.Debug("NetworkClient: churned device failed to reconnect", "device_id", d.id, "error", err)
+			}
+			d.mu.Lock()
+			d.offline = false
+			d.mu.Unlock()
+		}()
+	}
+}
+
+// Disconnect stops churn and closes every connection.
+func (c *NetworkClient) Disconnect() {
+	if c.stopChurn != nil {
+		c.stopChurn()
+		<-c.churnDone
+	}
+	for _, d := range c.order {
+		if d.client.IsConnected() {
+			d.client.Disconnect(250)
+		}
+	}
+}
+
+// Publish generates a payload and publishes it on the device's own connection.
+// A device taken offline by churn skips its message without an error.
+func (c *NetworkClient) Publish(ctx context.Context, device *loadgen.Device) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	d, ok := c.devices[device.ID]
+	if !ok {
+		return false, fmt.Errorf("device %s has no connection", device.ID)
+	}
+
+	d.mu.Lock()
+	offline := d.offline
+	d.mu.Unlock()
+	if offline {
+		c.offlineSkips.Add(1)
+		return false, nil
+	}
+	if !d.client.IsConnected() {
+		return false, fmt.Errorf("device %s: %w", device.ID, errDeviceNotConnected)
+	}
+
+	payload, err := device.PayloadGenerator.GeneratePayload(device)
+	if err != nil {
+		return false, fmt.Errorf("failed to generate payload for device %s: %w", device.ID, err)
+	}
+
+	topic, qos, retain, err := c.opts.Router.Route(device, payload)
+	if err != nil {
+		return false, err
+	}
+	token := d.client.Publish(topic, qos, retain, payload)
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-token.Done():
+	}
+	if err := token.Error(); err != nil {
+		return false, fmt.Errorf("device %s: publish failed: %w", device.ID, err)
+	}
+	return true, nil
+}
+
+// Stats returns a snapshot of the connection counters.
+func (c *NetworkClient) Stats() ConnectionStats {
+	stats := ConnectionStats{
+		Connects:         c.connects.Load(),
+		ConnectFailures:  c.connectFailures.Load(),
+		ChurnDisconnects: c.churnDisconnects.Load(),
+		ConnectionsLost:  c.connectionsLost.Load(),
+		OfflineSkips:     c.offlineSkips.Load(),
+	}
+	for _, d := range c.order {
+		if d.client.IsConnected() {
+			stats.Connected++
+		}
+	}
+	return stats
+}
+
+// ReportStatus adds the connection stats to a job's status.
+func (c *NetworkClient) ReportStatus(status *JobStatus) {
+	stats := c.Stats()
+	status.Connections = &stats
+}
@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTCPServer starts a Mochi server with a TCP listener that only accepts
+// the given credentials, and returns its broker URL and the inline-subscribed
+// packets matching filter.
+func newTCPServer(t *testing.T, username, password, filter string) (string, chan packets.Packet) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.Hook), &auth.Options{
+		Ledger: &auth.Ledger{Auth: auth.AuthRules{{Username: auth.RString(username), Password: auth.RString(password), Allow: true}}},
+	}))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp-test", Address: address})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	received := make(chan packets.Packet, 100)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return "tcp://" + address, received
+}
+
+// networkTestDevices returns n garden monitor devices.
+func networkTestDevices(n int) []*loadgen.Device {
+	var devices []*loadgen.Device
+	for i := 0; i < n; i++ {
+		devices = append(devices, &loadgen.Device{ID: fmt.Sprintf("garden-%05d", i+1), PayloadGenerator: NewGardenMonitorPayloadGenerator()})
+	}
+	return devices
+}
+
+// TestNetworkClientPublishesPerDevice verifies each device gets its own
+// authenticated connection and its messages reach the broker.
+func TestNetworkClientPublishesPerDevice(t *testing.T) {
+	// --- Arrange ---
+	brokerURL, received := newTCPServer(t, "loadgen", "secret", "devices/+/data")
+	devices := networkTestDevices(3)
+	client := NewNetworkClient(NetworkOptions{
+		BrokerURL: brokerURL, Username: "loadgen", Password: "secret", Router: legacyRouter(t, "devices/+/data", 1),
+	}, devices)
+
+	// --- Act ---
+	require.NoError(t, client.Connect())
+	defer client.Disconnect()
+	for _, device := range devices {
+		ok, err := client.Publish(context.Background(), device)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// --- Assert ---
+	origins := map[string]string{}
+	for range devices {
+		select {
+		case pk := <-received:
+			origins[pk.TopicName] = pk.Origin
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for published messages")
+		}
+	}
+	assert.Equal(t, "loadgen-garden-00001", origins["devices/garden-00001/data"])
+	assert.Equal(t, "loadgen-garden-00003", origins["devices/garden-00003/data"])
+	stats := client.Stats()
+	assert.Equal(t, int64(3), stats.Connected)
+	assert.Equal(t, int64(3), stats.Connects)
+}
+
+// TestNetworkClientRejectsBadCredentials verifies Connect fails when no device can log in.
+func TestNetworkClientRejectsBadCredentials(t *testing.T) {
+	// --- Arrange ---
+	brokerURL, _ := newTCPServer(t, "loadgen", "secret", "devices/#")
+	client := NewNetworkClient(NetworkOptions{
+		BrokerURL: brokerURL, Username: "loadgen", Password: "wrong", Router: legacyRouter(t, "devices/+/data", 0),
+	}, networkTestDevices(2))
+
+	// --- Act ---
+	err := client.Connect()
+
+	// --- Assert ---
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), client.Stats().ConnectFailures)
+}
+
+// TestNetworkClientConnectStopsWhenCancelled verifies a paced Connect stops
+// dialing once its context is cancelled and closes what it had opened.
+func TestNetworkClientConnectStopsWhenCancelled(t *testing.T) {
+	// --- Arrange ---
+	brokerURL, _ := newTCPServer(t, "loadgen", "secret", "devices/#")
+	client := NewNetworkClient(NetworkOptions{
+		BrokerURL: brokerURL, Username: "loadgen", Password: "secret", Router: legacyRouter(t, "devices/+/data", 0),
+		ConnectPerSec: 10,
+	}, networkTestDevices(100))
+	ctx, cancel := context.WithCancel(context.Background())
+	client.SetContext(ctx)
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	// --- Act ---
+	start := time.Now()
+	err := client.Connect()
+
+	// --- Assert ---
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 2*time.Second, "Connect should not pace through every device")
+	stats := client.Stats()
+	assert.Less(t, stats.Connects, int64(10))
+	assert.Zero(t, stats.Connected)
+}
+
+// TestNetworkClientChurn verifies churned devices disconnect, skip their
+// messages while offline and reconnect.
+func TestNetworkClientChurn(t *testing.T) {
+	// --- Arrange ---
+	brokerURL, _ := newTCPServer(t, "loadgen", "secret", "devices/#")
+	devices := networkTestDevices(2)
+	client := NewNetworkClient(NetworkOptions{
+		BrokerURL: brokerURL, Username: "loadgen", Password: "secret", Router: legacyRouter(t, "devices/+/data", 0),
+		Churn: &Churn{DisconnectsPerMinute: 1200, OfflineSeconds: 0.05},
+	}, devices)
+
+	// --- Act ---
+	require.NoError(t, client.Connect())
+	require.Eventually(t, func() bool {
+		return client.Stats().ChurnDisconnects >= 3 && client.Stats().Connects >= 4
+	}, 10*time.Second, 10*time.Millisecond)
+	client.Disconnect()
+
+	// --- Assert ---
+	stats := client.Stats()
+	assert.Zero(t, stats.Connected)
+	assert.Zero(t, stats.ConnectionsLost)
+}
+
+// TestClientRequestValidate verifies incomplete client requests are rejected.
+func TestClientRequestValidate(t *testing.T) {
+	for _, req := range []ClientRequest{
+		{Mode: "carrier-pigeon"},
+		{Mode: ClientNetwork},
+		{Mode: ClientNetwork, BrokerURL: "tcp://localhost:1883", Password: "p", PasswordSecret: "projects/p/secrets/s/versions/latest"},
+		{Mode: ClientNetwork, BrokerURL: "tcp://localhost:1883", Churn: &Churn{}},
+		{Churn: &Churn{DisconnectsPerMinute: 1}},
+	} {
+		assert.Error(t, req.Validate(), "%+v", req)
+	}
+	assert.NoError(t, (&ClientRequest{Mode: ClientNetwork, BrokerURL: "tcp://localhost:1883"}).Validate())
+}
+
+// TestHandleLoadTestRejectsUnlistedPasswordSecret verifies a request cannot
+// have the server read a secret it does not allow and send it to a broker of
+// the caller's choosing.
+func TestHandleLoadTestRejectsUnlistedPasswordSecret(t *testing.T) {
+	// --- Arrange ---
+	server, _ := newInlineServer(t, "devices/+/data")
+	allowed := "projects/p/secrets/loadtest-pass/versions/latest"
+	var fetched []string
+	resolver := func(ctx context.Context, name string) (string, error) {
+		fetched = append(fetched, name)
+		return "secret", nil
+	}
+
+	testCases := []struct {
+		name    string
+		allowed []string
+		secret  string
+	}{
+		{name: "unknown secret", allowed: []string{allowed}, secret: "projects/p/secrets/db-admin-pass/versions/latest"},
+		{name: "no secrets allowed", secret: allowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewHandler(server)
+			handler.SetSecretResolver(resolver, tc.allowed)
+			body := fmt.Sprintf(`{"duration_seconds": 1, "topic_pattern": "devices/+/data",
+				"devices": [{"id": "garden-001", "message_rate_hz": 1, "payload_generator": "gardenMonitor"}],
+				"client": {"mode": "network", "broker_url": "tcp://collector.example:1883", "username": "u", "password_secret": %q}}`, tc.secret)
+
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			handler.HandleLoadTest(rec, httptest.NewRequest(http.MethodPost, "/load-test", strings.NewReader(body)))
+
+			// --- Assert ---
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), "not one of the secrets")
+			assert.Empty(t, fetched, "the secret should not be read")
+			assert.Empty(t, handler.jobs.List())
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pub/Sub message attributes that say how a passthrough message is published.
+const (
+	AttrMQTTTopic  = "mqttTopic"
+	AttrMQTTQoS    = "mqttQos"
+	AttrMQTTRetain = "mqttRetain"
+)
+
+// passthroughPublish is where and how a Pub/Sub message is published to MQTT.
+type passthroughPublish struct {
+	topic  string
+	qos    byte
+	retain bool
+}
+
+// parsePassthrough reads the MQTT publish from a message's attributes. The
+// topic must be under one of prefixes, unless there are none, and may not
+// contain wildcards; mqttQos (0, 1 or 2) and mqttRetain (a bool) are optional.
+// Errors are permanent: redelivering the message cannot fix them.
+func parsePassthrough(attributes map[string]string, prefixes []string) (passthroughPublish, error) {
+	pub := passthroughPublish{topic: attributes[AttrMQTTTopic]}
+	if pub.topic == "" {
+		return pub, fmt.Errorf("'%s' attribute missing from Pub/Sub message", AttrMQTTTopic)
+	}
+	if strings.ContainsAny(pub.topic, "+#") {
+		return pub, fmt.Errorf("'%s' %q must not contain wildcards", AttrMQTTTopic, pub.topic)
+	}
+	if !topicAllowed(pub.topic, prefixes) {
+		return pub, fmt.Errorf("%w: %q is outside %s", ErrTopicNotAllowed, pub.topic, strings.Join(prefixes, ", "))
+	}
+
+	if v, ok := attributes[AttrMQTTQoS]; ok {
+		qos, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || qos > 2 {
+			return pub, fmt.Errorf("'%s' must be 0, 1 or 2, got %q", AttrMQTTQoS, v)
+		}
+		pub.qos = byte(qos)
+	}
+	if v, ok := attributes[AttrMQTTRetain]; ok {
+		retain, err := strconv.ParseBool(v)
+		if err != nil {
+			return pub, fmt.Errorf("'%s' must be true or false, got %q", AttrMQTTRetain, v)
+		}
+		pub.retain = retain
+	}
+	return pub, nil
+}
+
+// ErrTopicNotAllowed is returned for passthrough topics outside the configured prefixes.
+var ErrTopicNotAllowed = errors.New("topic not allowed")
+
+// topicAllowed reports whether topic is one of prefixes or below one of them,
+// or whether there are no prefixes to restrict it. Prefixes match whole topic
+// levels, so devices/a allows devices/a/x but not devices/abc/x; a trailing /
+// on a prefix is ignored.
+func topicAllowed(topic string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if topic == prefix || strings.HasPrefix(topic, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
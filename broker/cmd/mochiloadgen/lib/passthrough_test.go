@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newInlineServer starts an in-memory Mochi server and subscribes to filter,
+// returning the channel the matching packets arrive on.
+func newInlineServer(t *testing.T, filter string) (*mqtt.Server, chan packets.Packet) {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { _ = server.Close() })
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return server, received
+}
+
+// TestPassthroughSubscriberDeliversToMQTT pulls a message from a Pub/Sub fake
+// and checks it is published to the MQTT topic named by its mqttTopic attribute.
+func TestPassthroughSubscriberDeliversToMQTT(t *testing.T) {
+	// --- Arrange ---
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	srv := pstest.NewServer()
+	t.Cleanup(func() { _ = srv.Close() })
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	topicName := "projects/test-project/topics/mqtt-commands"
+	subName := "projects/test-project/subscriptions/mqtt-passthrough"
+	_, err = client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: topicName})
+	require.NoError(t, err)
+	_, err = client.SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{Name: subName, Topic: topicName})
+	require.NoError(t, err)
+
+	server, received := newInlineServer(t, "devices/+/commands")
+	subscriber := NewPassthroughSubscriberWithClient(client, "mqtt-passthrough", server)
+	subCtx, stopSubscriber := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscriber.Start(subCtx)
+	}()
+
+	// --- Act ---
+	publisher := client.Publisher(topicName)
+	defer publisher.Stop()
+	_, err = publisher.Publish(ctx, &pubsub.Message{
+		Data:       []byte(`{"command":"water"}`),
+		Attributes: map[string]string{"mqttTopic": "devices/garden-monitor-001/commands"},
+	}).Get(ctx)
+	require.NoError(t, err)
+
+	// --- Assert ---
+	select {
+	case pk := <-received:
+		assert.Equal(t, "devices/garden-monitor-001/commands", pk.TopicName)
+		assert.Equal(t, []byte(`{"command":"water"}`), pk.Payload)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the passthrough message")
+	}
+
+	stopSubscriber()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("subscriber did not stop when its context was cancelled")
+	}
+	assert.NoError(t, subscriber.Close())
+}
+
+// TestHandlePassthroughPublishesPushMessage posts a push-subscription envelope
+// to the handler and checks the MQTT subscriber receives it.
+func TestHandlePassthroughPublishesPushMessage(t *testing.T) {
+	// --- Arrange ---
+	server, received := newInlineServer(t, "devices/+/commands")
+	handler := NewHandler(server)
+
+	var envelope PubSubMessage
+	envelope.Message.Data = []byte(`{"command":"water"}`)
+	envelope.Message.Attributes = map[string]string{"mqttTopic": "devices/garden-monitor-001/commands"}
+	envelope.Message.MessageID = "1"
+	body, err := json.Marshal(envelope)
+	require.NoError(t, err)
+
+	// --- Act ---
+	rec := httptest.NewRecorder()
+	handler.HandlePassthrough(rec, httptest.NewRequest(http.MethodPost, "/passthrough", bytes.NewReader(body)))
+
+	// --- Assert ---
+	assert.Equal(t, http.StatusOK, rec.Code)
+	select {
+	case pk := <-received:
+		assert.Equal(t, "devices/garden-monitor-001/commands", pk.TopicName)
+		assert.Equal(t, []byte(`{"command":"water"}`), pk.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the passthrough message")
+	}
+}
+
+// TestHandlePassthroughDropsUndeliverableMessages verifies messages that can
+// never be published are acknowledged, so Pub/Sub does not redeliver them,
+// and counted.
+func TestHandlePassthroughDropsUndeliverableMessages(t *testing.T) {
+	// --- Arrange ---
+	server, received := newInlineServer(t, "#")
+	handler := NewHandler(server)
+
+	bodies := []string{
+		`{"message":{"data":"e30="}}`,
+		`{"message":`,
+	}
+
+	for _, body := range bodies {
+		// --- Act ---
+		rec := httptest.NewRecorder()
+		handler.HandlePassthrough(rec, httptest.NewRequest(http.MethodPost, "/passthrough", strings.NewReader(body)))
+
+		// --- Assert ---
+		assert.Equal(t, http.StatusNoContent, rec.Code, body)
+	}
+	assert.Equal(t, int64(len(bodies)), handler.PassthroughDropped())
+	assert.Empty(t, received, "nothing should be published")
+}
+
+// pushRequest builds a push-subscription request for a message with
+// attributes, carrying token as its bearer token when set.
+func pushRequest(t *testing.T, attributes map[string]string, token string) *http.Request {
+	t.Helper()
+	var envelope PubSubMessage
+	envelope.Message.Data = []byte(`{"command":"water"}`)
+	envelope.Message.Attributes = attributes
+	envelope.Message.MessageID = "1"
+	body, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/passthrough", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// TestHandlePassthroughVerifiesPushRequests checks push tokens and topic
+// prefixes are enforced, and that only failures that may pass later are left
+// for Pub/Sub to retry.
+func TestHandlePassthroughVerifiesPushRequests(t *testing.T) {
+	// --- Arrange ---
+	issuer := newTestIssuer(t)
+	const aud = "https://loadgen.example.com/passthrough"
+	verifier, err := NewOIDCVerifier(OIDCOptions{
+		Audience:      aud,
+		AllowedEmails: []string{"scheduler@project.iam.gserviceaccount.com"},
+		CertsURL:      issuer.url,
+	})
+	require.NoError(t, err)
+	valid := issuer.sign(t, issuer.kid, issuer.claims(aud))
+	otherAccount := issuer.claims(aud)
+	otherAccount["email"] = "someone@project.iam.gserviceaccount.com"
+
+	server, _ := newInlineServer(t, "#")
+	handler := NewHandler(server)
+	handler.SetPassthroughPolicy(verifier, []string{"devices/"})
+
+	// A server without an inline client fails every publish.
+	broken := NewHandler(mqtt.New(&mqtt.Options{}))
+	broken.SetPassthroughPolicy(verifier, []string{"devices/"})
+
+	testCases := []struct {
+		name       string
+		handler    *Handler
+		attributes map[string]string
+		token      string
+		wantStatus int
+	}{
+		{name: "valid", handler: handler, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands"}, token: valid, wantStatus: http.StatusOK},
+		{name: "no token", handler: handler, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands"}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong audience", handler: handler, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands"}, token: issuer.sign(t, issuer.kid, issuer.claims("https://elsewhere")), wantStatus: http.StatusUnauthorized},
+		{name: "wrong service account", handler: handler, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands"}, token: issuer.sign(t, issuer.kid, otherAccount), wantStatus: http.StatusUnauthorized},
+		{name: "topic outside prefixes", handler: handler, attributes: map[string]string{AttrMQTTTopic: "$SYS/broker"}, token: valid, wantStatus: http.StatusNoContent},
+		{name: "bad qos", handler: handler, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands", AttrMQTTQoS: "3"}, token: valid, wantStatus: http.StatusNoContent},
+		{name: "publish fails", handler: broken, attributes: map[string]string{AttrMQTTTopic: "devices/d1/commands"}, token: valid, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			tc.handler.HandlePassthrough(rec, pushRequest(t, tc.attributes, tc.token))
+
+			// --- Assert ---
+			assert.Equal(t, tc.wantStatus, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+// TestHandlePassthroughHonoursQoSAndRetain verifies the mqttQos and
+// mqttRetain attributes are used for the publish.
+func TestHandlePassthroughHonoursQoSAndRetain(t *testing.T) {
+	// --- Arrange ---
+	server, received := newInlineServer(t, "devices/+/config")
+	handler := NewHandler(server)
+
+	// --- Act ---
+	rec := httptest.NewRecorder()
+	handler.HandlePassthrough(rec, pushRequest(t, map[string]string{
+		AttrMQTTTopic:  "devices/d1/config",
+		AttrMQTTQoS:    "1",
+		AttrMQTTRetain: "true",
+	}, ""))
+
+	// --- Assert ---
+	require.Equal(t, http.StatusOK, rec.Code)
+	select {
+	case pk := <-received:
+		assert.Equal(t, byte(1), pk.FixedHeader.Qos)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the passthrough message")
+	}
+	retained := server.Topics.Messages("devices/d1/config")
+	require.Len(t, retained, 1)
+	assert.Equal(t, []byte(`{"command":"water"}`), retained[0].Payload)
+}
+
+// TestParsePassthrough checks the attributes a passthrough message may carry.
+func TestParsePassthrough(t *testing.T) {
+	prefixes := []string{"devices/", "commands/"}
+
+	testCases := []struct {
+		name       string
+		attributes map[string]string
+		want       passthroughPublish
+		wantErr    string
+	}{
+		{name: "defaults", attributes: map[string]string{AttrMQTTTopic: "devices/d1/cmd"}, want: passthroughPublish{topic: "devices/d1/cmd"}},
+		{name: "qos and retain", attributes: map[string]string{AttrMQTTTopic: "commands/all", AttrMQTTQoS: "2", AttrMQTTRetain: "1"}, want: passthroughPublish{topic: "commands/all", qos: 2, retain: true}},
+		{name: "missing topic", attributes: map[string]string{}, wantErr: "missing"},
+		{name: "wildcard", attributes: map[string]string{AttrMQTTTopic: "devices/+/cmd"}, wantErr: "wildcards"},
+		{name: "outside prefixes", attributes: map[string]string{AttrMQTTTopic: "other/d1"}, wantErr: "not allowed"},
+		{name: "sibling of a prefix", attributes: map[string]string{AttrMQTTTopic: "devicesX/d1"}, wantErr: "not allowed"},
+		{name: "bad qos", attributes: map[string]string{AttrMQTTTopic: "devices/d1", AttrMQTTQoS: "high"}, wantErr: AttrMQTTQoS},
+		{name: "bad retain", attributes: map[string]string{AttrMQTTTopic: "devices/d1", AttrMQTTRetain: "sometimes"}, wantErr: AttrMQTTRetain},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parsePassthrough(tc.attributes, prefixes)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	_, err := parsePassthrough(map[string]string{AttrMQTTTopic: "anything/at/all"}, nil)
+	assert.NoError(t, err, "no prefixes allow any topic")
+}
+
+// TestTopicAllowedMatchesWholeLevels verifies a prefix does not allow topics
+// that only share its leading characters.
+func TestTopicAllowedMatchesWholeLevels(t *testing.T) {
+	prefixes := []string{"devices/a"}
+
+	assert.True(t, topicAllowed("devices/a", prefixes))
+	assert.True(t, topicAllowed("devices/a/commands", prefixes))
+	assert.False(t, topicAllowed("devices/abc/commands", prefixes))
+	assert.False(t, topicAllowed("devices", prefixes))
+	assert.True(t, topicAllowed("devices/abc/commands", []string{"devices/"}), "a trailing / is ignored")
+}
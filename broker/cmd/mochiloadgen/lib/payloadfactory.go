@@ -8,20 +8,18 @@ import (
 	"github.com/illmade-knight/go-test/loadgen" // Assuming this is your loadgen package path
 )
 
-// NewPayloadGenerator is a factory function that returns a payload generator
-// based on a string identifier.
+// NewPayloadGenerator returns a payload generator from DefaultGenerators by
+// name. messages are passed as the replay generator's messages option.
 func NewPayloadGenerator(name string, messages [][]byte) (loadgen.PayloadGenerator, error) {
-	switch name {
-	case "gardenMonitor":
-		return NewGardenMonitorPayloadGenerator(), nil
-	case "replay":
-		if len(messages) == 0 {
-			return nil, fmt.Errorf("payload generator 'replay' requires non-empty 'messages' field")
+	var options json.RawMessage
+	if len(messages) > 0 {
+		encoded, err := json.Marshal(map[string][][]byte{"messages": messages})
+		if err != nil {
+			return nil, err
 		}
-		return loadgen.NewReplayPayloadGenerator(messages), nil
-	default:
-		return nil, fmt.Errorf("unknown payload generator: %s", name)
+		options = encoded
 	}
+	return DefaultGenerators.New(name, options)
 }
 
 // --- Concrete Payload Generator Implementations ---
@@ -69,6 +67,17 @@ func NewGardenMonitorPayloadGenerator() *GardenMonitorPayloadGenerator {
 	}
 }
 
+// simIDLength is how many trailing characters of the device ID go into the SIM field.
+const simIDLength = 4
+
+// ValidateDeviceID rejects IDs too short to supply the SIM suffix.
+func (g *GardenMonitorPayloadGenerator) ValidateDeviceID(id string) error {
+	if len(id) < simIDLength {
+		return fmt.Errorf("gardenMonitor device ID %q must be at least %d characters", id, simIDLength)
+	}
+	return nil
+}
+
 // GeneratePayload creates the next payload for a garden monitor device, updating its state.
 func (g *GardenMonitorPayloadGenerator) GeneratePayload(device *loadgen.Device) ([]byte, error) {
 	// Update device state for the next message
@@ -86,10 +95,14 @@ func (g *GardenMonitorPayloadGenerator) GeneratePayload(device *loadgen.Device)
 		g.state.SoilMoisture = 900
 	}
 
+	if err := g.ValidateDeviceID(device.ID); err != nil {
+		return nil, err
+	}
+
 	// Create the payload from the new state
 	payload := GardenMonitorPayload{
 		DE:           device.ID, // Use the device ID from the context
-		SIM:          fmt.Sprintf("SIM_LOAD_%s", device.ID[len(device.ID)-4:]),
+		SIM:          fmt.Sprintf("SIM_LOAD_%s", device.ID[len(device.ID)-simIDLength:]),
 		RSSI:         fmt.Sprintf("%ddBm", g.state.RSSI),
 		Version:      "2.0.0-unified",
 		Sequence:     g.state.Sequence,
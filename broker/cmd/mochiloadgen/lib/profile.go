@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/rs/zerolog"
+)
+
+// Rate profile types.
+const (
+	ProfileRamp  = "ramp"
+	ProfileStep  = "step"
+	ProfileSpike = "spike"
+	ProfileSoak  = "soak"
+)
+
+// profileTick is the longest a device waits before re-reading the profile, so
+// a ramp or spike takes effect within a tick whatever the current rate.
+const profileTick = 50 * time.Millisecond
+
+// RateProfile describes a per-device message rate that changes over the
+// course of a load test. It applies to every device in the request and
+// replaces their message_rate_hz.
+//
+//   - ramp:  linear from start_rate_hz to end_rate_hz over the test duration.
+//   - step:  each stage holds its rate_hz for its duration_seconds; the last
+//     stage's rate holds until the test ends.
+//   - spike: base_rate_hz, rising to spike_rate_hz for the last
+//     spike_seconds of every period_seconds.
+//   - soak:  a constant rate_hz, meant for long runs.
+type RateProfile struct {
+	Type string `json:"type"`
+
+	StartRateHz float64 `json:"start_rate_hz,omitempty"`
+	EndRateHz   float64 `json:"end_rate_hz,omitempty"`
+
+	Stages []ProfileStage `json:"stages,omitempty"`
+
+	BaseRateHz    float64 `json:"base_rate_hz,omitempty"`
+	SpikeRateHz   float64 `json:"spike_rate_hz,omitempty"`
+	PeriodSeconds float64 `json:"period_seconds,omitempty"`
+	SpikeSeconds  float64 `json:"spike_seconds,omitempty"`
+
+	RateHz float64 `json:"rate_hz,omitempty"`
+}
+
+// ProfileStage is one stage of a step profile.
+type ProfileStage struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	RateHz          float64 `json:"rate_hz"`
+}
+
+// Validate checks the profile has the fields its type needs.
+func (p *RateProfile) Validate() error {
+	switch p.Type {
+	case ProfileRamp:
+		if p.StartRateHz < 0 || p.EndRateHz < 0 || (p.StartRateHz == 0 && p.EndRateHz == 0) {
+			return fmt.Errorf("ramp profile needs non-negative start_rate_hz and end_rate_hz, not both zero")
+		}
+	case ProfileStep:
+		if len(p.Stages) == 0 {
+			return fmt.Errorf("step profile needs at least one stage")
+		}
+		for i, stage := range p.Stages {
+			if stage.DurationSeconds <= 0 || stage.RateHz < 0 {
+				return fmt.Errorf("step profile stage %d needs a positive duration_seconds and a non-negative rate_hz", i)
+			}
+		}
+	case ProfileSpike:
+		if p.BaseRateHz < 0 || p.SpikeRateHz <= 0 {
+			return fmt.Errorf("spike profile needs a non-negative base_rate_hz and a positive spike_rate_hz")
+		}
+		if p.PeriodSeconds <= 0 || p.SpikeSeconds <= 0 || p.SpikeSeconds > p.PeriodSeconds {
+			return fmt.Errorf("spike profile needs 0 < spike_seconds <= period_seconds")
+		}
+	case ProfileSoak:
+		if p.RateHz <= 0 {
+			return fmt.Errorf("soak profile needs a positive rate_hz")
+		}
+	default:
+		return fmt.Errorf("unknown rate profile type %q (supported: %s, %s, %s, %s)", p.Type, ProfileRamp, ProfileStep, ProfileSpike, ProfileSoak)
+	}
+	return nil
+}
+
+// StagesDuration is the total length of a step profile's stages, or zero for
+// other profile types. It is used when the request gives no duration.
+func (p *RateProfile) StagesDuration() time.Duration {
+	if p.Type != ProfileStep {
+		return 0
+	}
+	var total float64
+	for _, stage := range p.Stages {
+		total += stage.DurationSeconds
+	}
+	return time.Duration(total * float64(time.Second))
+}
+
+// PeakRate is the highest per-device rate in Hz the profile reaches.
+func (p *RateProfile) PeakRate() float64 {
+	peak := math.Max(p.RateHz, math.Max(math.Max(p.StartRateHz, p.EndRateHz), math.Max(p.BaseRateHz, p.SpikeRateHz)))
+	for _, stage := range p.Stages {
+		peak = math.Max(peak, stage.RateHz)
+	}
+	return peak
+}
+
+// RateAt returns the per-device rate in Hz at elapsed into a test lasting duration.
+func (p *RateProfile) RateAt(elapsed, duration time.Duration) float64 {
+	switch p.Type {
+	case ProfileRamp:
+		if duration <= 0 || elapsed >= duration {
+			return p.EndRateHz
+		}
+		progress := elapsed.Seconds() / duration.Seconds()
+		return p.StartRateHz + (p.EndRateHz-p.StartRateHz)*progress
+	case ProfileStep:
+		var end float64
+		for _, stage := range p.Stages {
+			end += stage.DurationSeconds
+			if elapsed.Seconds() < end {
+				return stage.RateHz
+			}
+		}
+		return p.Stages[len(p.Stages)-1].RateHz
+	case ProfileSpike:
+		if offset := math.Mod(elapsed.Seconds(), p.PeriodSeconds); offset >= p.PeriodSeconds-p.SpikeSeconds {
+			return p.SpikeRateHz
+		}
+		return p.BaseRateHz
+	case ProfileSoak:
+		return p.RateHz
+	default:
+		return 0
+	}
+}
+
+// ProfileRunner publishes for every device at the rate the profile gives for
+// the current point in the test, in place of loadgen's fixed-rate generator.
+type ProfileRunner struct {
+	client  loadgen.Client
+	devices []*loadgen.Device
+	profile *RateProfile
+	logger  zerolog.Logger
+}
+
+// NewProfileRunner creates a runner for devices following profile.
+func NewProfileRunner(client loadgen.Client, devices []*loadgen.Device, profile *RateProfile, logger zerolog.Logger) *ProfileRunner {
+	return &ProfileRunner{client: client, devices: devices, profile: profile, logger: logger}
+}
+
+// Run connects the client, drives every device until duration has passed or
+// ctx is cancelled, and returns the number of messages published.
+func (r *ProfileRunner) Run(ctx context.Context, duration time.Duration) (int, error) {
+	if err := r.client.Connect(); err != nil {
+		return 0, fmt.Errorf("failed to connect load test client: %w", err)
+	}
+	defer r.client.Disconnect()
+
+	runCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	start := time.Now()
+	var published atomic.Int64
+	var wg sync.WaitGroup
+	for _, device := range r.devices {
+		wg.Add(1)
+		go func(device *loadgen.Device) {
+			defer wg.Done()
+			r.runDevice(runCtx, device, start, duration, &published)
+		}(device)
+	}
+	wg.Wait()
+
+	r.logger.Info().Str("profile", r.profile.Type).Int64("published", published.Load()).Msg("Rate profile finished")
+	if err := ctx.Err(); err != nil {
+		return int(published.Load()), err
+	}
+	return int(published.Load()), nil
+}
+
+// runDevice publishes for one device at the profile's rate. Messages are owed
+// as the rate integrates over time, re-read at least every profileTick, so a
+// device at a low rate does not sleep through the start of a spike or ramp.
+func (r *ProfileRunner) runDevice(ctx context.Context, device *loadgen.Device, start time.Time, duration time.Duration, published *atomic.Int64) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	owed := 0.0
+	last := start
+	for {
+		now := time.Now()
+		rate := r.profile.RateAt(now.Sub(start), duration)
+		owed += rate * now.Sub(last).Seconds()
+		last = now
+
+		if owed < 1 {
+			wait := profileTick
+			if rate > 0 {
+				wait = min(wait, time.Duration((1-owed)/rate*float64(time.Second)))
+			}
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		owed--
+
+		ok, err := r.client.Publish(ctx, device)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn().Err(err).Str("device_id", device.ID).Msg("Profile publish failed")
+			continue
+		}
+		if ok {
+			published.Add(1)
+		}
+	}
+}
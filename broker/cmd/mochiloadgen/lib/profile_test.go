@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateProfileRateAt verifies the rate each profile type gives over a test.
+func TestRateProfileRateAt(t *testing.T) {
+	testCases := []struct {
+		name     string
+		profile  RateProfile
+		elapsed  time.Duration
+		duration time.Duration
+		expected float64
+	}{
+		{"ramp start", RateProfile{Type: ProfileRamp, StartRateHz: 1, EndRateHz: 11}, 0, 10 * time.Second, 1},
+		{"ramp midway", RateProfile{Type: ProfileRamp, StartRateHz: 1, EndRateHz: 11}, 5 * time.Second, 10 * time.Second, 6},
+		{"ramp down", RateProfile{Type: ProfileRamp, StartRateHz: 10, EndRateHz: 0}, 9 * time.Second, 10 * time.Second, 1},
+		{"ramp past the end", RateProfile{Type: ProfileRamp, StartRateHz: 1, EndRateHz: 11}, 12 * time.Second, 10 * time.Second, 11},
+		{"first step", RateProfile{Type: ProfileStep, Stages: []ProfileStage{{5, 1}, {5, 4}}}, 2 * time.Second, 0, 1},
+		{"second step", RateProfile{Type: ProfileStep, Stages: []ProfileStage{{5, 1}, {5, 4}}}, 5 * time.Second, 0, 4},
+		{"last step holds", RateProfile{Type: ProfileStep, Stages: []ProfileStage{{5, 1}, {5, 4}}}, time.Minute, 0, 4},
+		{"spike baseline", RateProfile{Type: ProfileSpike, BaseRateHz: 1, SpikeRateHz: 50, PeriodSeconds: 10, SpikeSeconds: 2}, 17 * time.Second, time.Minute, 1},
+		{"in a spike", RateProfile{Type: ProfileSpike, BaseRateHz: 1, SpikeRateHz: 50, PeriodSeconds: 10, SpikeSeconds: 2}, 19 * time.Second, time.Minute, 50},
+		{"soak", RateProfile{Type: ProfileSoak, RateHz: 3}, time.Hour, 2 * time.Hour, 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			rate := tc.profile.RateAt(tc.elapsed, tc.duration)
+
+			// --- Assert ---
+			assert.InDelta(t, tc.expected, rate, 0.001)
+		})
+	}
+}
+
+// TestRateProfileValidate verifies incomplete profiles are rejected.
+func TestRateProfileValidate(t *testing.T) {
+	// --- Arrange ---
+	invalid := []RateProfile{
+		{Type: "sawtooth"},
+		{Type: ProfileRamp},
+		{Type: ProfileStep},
+		{Type: ProfileStep, Stages: []ProfileStage{{0, 5}}},
+		{Type: ProfileSpike, BaseRateHz: 1, SpikeRateHz: 10, PeriodSeconds: 5, SpikeSeconds: 6},
+		{Type: ProfileSoak},
+	}
+	valid := RateProfile{Type: ProfileStep, Stages: []ProfileStage{{2, 0}, {3, 10}}}
+
+	// --- Act & Assert ---
+	for _, profile := range invalid {
+		assert.Error(t, profile.Validate(), "profile %+v should be invalid", profile)
+	}
+	require.NoError(t, valid.Validate())
+	assert.Equal(t, 5*time.Second, valid.StagesDuration())
+}
+
+// TestProfileRunnerFollowsProfile verifies a step profile publishes nothing
+// during a zero-rate stage and publishes for every device afterwards.
+func TestProfileRunnerFollowsProfile(t *testing.T) {
+	// --- Arrange ---
+	client := NewCountingClient(&stubClient{})
+	devices := []*loadgen.Device{{ID: "device-0001"}, {ID: "device-0002"}}
+	profile := &RateProfile{Type: ProfileStep, Stages: []ProfileStage{{0.3, 0}, {0.5, 100}}}
+	runner := NewProfileRunner(client, devices, profile, zerolog.Nop())
+
+	// --- Act ---
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		assert.Zero(t, client.Published(), "nothing should be published during the idle stage")
+	}()
+	count, err := runner.Run(ctx, profile.StagesDuration())
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, int64(count), client.Published())
+	assert.Greater(t, count, 20)
+	assert.Less(t, count, 110)
+}
+
+// TestProfileRunnerFollowsRateChanges verifies a device at a low rate picks
+// up a spike as it starts instead of waiting out its slow interval.
+func TestProfileRunnerFollowsRateChanges(t *testing.T) {
+	// --- Arrange ---
+	client := NewCountingClient(&stubClient{})
+	devices := []*loadgen.Device{{ID: "device-0001"}}
+	profile := &RateProfile{Type: ProfileStep, Stages: []ProfileStage{{0.2, 0.1}, {1, 20}}}
+	runner := NewProfileRunner(client, devices, profile, zerolog.Nop())
+
+	// --- Act ---
+	count, err := runner.Run(context.Background(), profile.StagesDuration())
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, count, 15, "the 20 Hz stage should not wait out the 10s interval of the first stage")
+	assert.LessOrEqual(t, count, 21)
+}
@@ -11,9 +11,11 @@ import (
 
 // PassthroughSubscriber manages a pull subscription to a Pub/Sub topic.
 type PassthroughSubscriber struct {
-	client *pubsub.Client
-	server *mqtt.Server
-	subID  string
+	client    *pubsub.Client
+	server    *mqtt.Server
+	subID     string
+	ownClient bool
+	prefixes  []string
 }
 
 // NewPassthroughSubscriber creates and configures a new Pub/Sub subscriber.
@@ -29,11 +31,26 @@ func NewPassthroughSubscriber(ctx context.Context, projectID, subID string, serv
 
 	slog.Info("Pub/Sub client created successfully", "project_id", projectID)
 
+	s := NewPassthroughSubscriberWithClient(client, subID, server)
+	s.ownClient = true
+	return s, nil
+}
+
+// NewPassthroughSubscriberWithClient creates a subscriber using an existing
+// Pub/Sub client, e.g. one connected to the emulator. The caller remains
+// responsible for closing the client.
+func NewPassthroughSubscriberWithClient(client *pubsub.Client, subID string, server *mqtt.Server) *PassthroughSubscriber {
 	return &PassthroughSubscriber{
 		client: client,
 		server: server,
 		subID:  subID,
-	}, nil
+	}
+}
+
+// SetTopicPrefixes restricts the MQTT topics messages may be published to, as
+// the push endpoint does.
+func (s *PassthroughSubscriber) SetTopicPrefixes(prefixes []string) {
+	s.prefixes = prefixes
 }
 
 // Start begins receiving messages from the subscription in a blocking loop.
@@ -46,10 +63,10 @@ func (s *PassthroughSubscriber) Start(ctx context.Context) {
 
 	// Receive blocks until the context is cancelled or an unrecoverable error occurs.
 	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		// The target MQTT topic must be in the message attributes.
-		topic, ok := msg.Attributes["mqttTopic"]
-		if !ok || topic == "" {
-			slog.Warn("Pub/Sub message missing 'mqttTopic' attribute, acknowledging and dropping", "message_id", msg.ID)
+		// The target MQTT topic and publish settings are in the message attributes.
+		pub, err := parsePassthrough(msg.Attributes, s.prefixes)
+		if err != nil {
+			slog.Warn("Pub/Sub message cannot be passed through, acknowledging and dropping", "message_id", msg.ID, "error", err)
 			msg.Ack() // Acknowledge the message so it's not redelivered.
 			return
 		}
@@ -60,13 +77,13 @@ func (s *PassthroughSubscriber) Start(ctx context.Context) {
 		}
 
 		// Publish the received payload directly to the in-memory Mochi server.
-		if err := s.server.Publish(topic, payload, false, 0); err != nil {
-			slog.Error("Failed to publish passthrough message to Mochi", "topic", topic, "error", err)
+		if err := s.server.Publish(pub.topic, payload, pub.retain, pub.qos); err != nil {
+			slog.Error("Failed to publish passthrough message to Mochi", "topic", pub.topic, "error", err)
 			msg.Nack() // Nack the message to signal that it should be redelivered.
 			return
 		}
 
-		slog.Debug("Pub/Sub message passed through to MQTT", "topic", topic, "size_bytes", len(payload))
+		slog.Debug("Pub/Sub message passed through to MQTT", "topic", pub.topic, "size_bytes", len(payload))
 		msg.Ack() // Acknowledge the message after successful processing.
 	})
 
@@ -77,9 +94,9 @@ func (s *PassthroughSubscriber) Start(ctx context.Context) {
 	slog.Info("Pub/Sub subscriber has stopped.")
 }
 
-// Close cleans up the Pub/Sub client resources.
+// Close cleans up the Pub/Sub client resources, if the subscriber created the client.
 func (s *PassthroughSubscriber) Close() error {
-	if s.client != nil {
+	if s.client != nil && s.ownClient {
 		return s.client.Close()
 	}
 	return nil
@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+)
+
+// RecordingSuffix is the file name suffix of a finished broker recording.
+const RecordingSuffix = ".ndjson.gz"
+
+// RecordedMessage is one line of a broker traffic recording, as written by
+// the broker's traffic recorder hook.
+type RecordedMessage struct {
+	Topic      string    `json:"topic"`
+	Payload    []byte    `json:"payload"`
+	QoS        byte      `json:"qos"`
+	Retain     bool      `json:"retain"`
+	ClientID   string    `json:"client_id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// maxCachedRecordings bounds how many recordings are kept in memory; the
+// least recently used one is dropped first.
+const maxCachedRecordings = 8
+
+// recordings caches loaded recordings, as the replay generator is created
+// once per device and a fleet would otherwise read the same files many times.
+var recordings = newRecordingCache(maxCachedRecordings)
+
+// SetRecordingsDir sets the directory that replay requests name recordings
+// in. Requests cannot reach files outside it, and until it is set they cannot
+// replay recordings at all.
+func SetRecordingsDir(dir string) {
+	recordings.setDir(dir)
+}
+
+// recordingCache holds recordings by path until the file or directory changes.
+type recordingCache struct {
+	mu      sync.Mutex
+	dir     string
+	max     int
+	entries map[string]recordingCacheEntry
+	order   []string // paths, least recently used first
+}
+
+// recordingCacheEntry is a loaded recording and the modification time it was loaded at.
+type recordingCacheEntry struct {
+	modTime  time.Time
+	messages []RecordedMessage
+}
+
+// newRecordingCache creates an empty cache of at most size recordings.
+func newRecordingCache(size int) *recordingCache {
+	return &recordingCache{max: size, entries: make(map[string]recordingCacheEntry)}
+}
+
+// setDir changes the recordings directory and forgets everything cached.
+func (c *recordingCache) setDir(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dir = dir
+	c.entries = make(map[string]recordingCacheEntry)
+	c.order = nil
+}
+
+// checkRecordingName rejects names that could leave the recordings directory.
+func checkRecordingName(name string) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("recording %q must be a path inside the recordings directory, without a leading / or ..", name)
+	}
+	return nil
+}
+
+// resolve returns the path of the named recording, following symlinks only
+// as far as they stay inside the recordings directory.
+func (c *recordingCache) resolve(name string) (string, error) {
+	if c.dir == "" {
+		return "", fmt.Errorf("recordings are not enabled on this server (recordings_dir or REPLAY_RECORDINGS_DIR)")
+	}
+	if err := checkRecordingName(name); err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(c.dir)
+	if err != nil {
+		return "", fmt.Errorf("recordings directory is not available: %w", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", fmt.Errorf("recording %q not found", name)
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("recording %q not found", name)
+	}
+	return path, nil
+}
+
+// load returns the named recording, reading it only if it is new or has changed.
+func (c *recordingCache) load(name string) ([]RecordedMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("recording %q not found", name)
+	}
+
+	if entry, ok := c.entries[path]; ok && entry.modTime.Equal(info.ModTime()) {
+		c.touch(path)
+		return entry.messages, nil
+	}
+	messages, err := LoadRecordings(path)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[path] = recordingCacheEntry{modTime: info.ModTime(), messages: messages}
+	c.touch(path)
+	for len(c.order) > c.max {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	return messages, nil
+}
+
+// touch marks path as the most recently used.
+func (c *recordingCache) touch(path string) {
+	c.order = slices.DeleteFunc(c.order, func(p string) bool { return p == path })
+	c.order = append(c.order, path)
+}
+
+// ReadRecording reads the messages of one recording. Gzipped and plain
+// NDJSON are both accepted.
+func ReadRecording(r io.Reader) ([]RecordedMessage, error) {
+	br := bufio.NewReader(r)
+	var in io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		in = gz
+	}
+
+	var messages []RecordedMessage
+	dec := json.NewDecoder(in)
+	for {
+		var msg RecordedMessage
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording after %d messages: %w", len(messages), err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// LoadRecordings reads a recording file, or every finished recording in a
+// directory in name order, which is the order they were recorded in.
+func LoadRecordings(path string) ([]RecordedMessage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	paths := []string{path}
+	if info.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(path, "*"+RecordingSuffix))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+	}
+
+	var messages []RecordedMessage
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recording: %w", err)
+		}
+		fileMessages, err := ReadRecording(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		messages = append(messages, fileMessages...)
+	}
+	return messages, nil
+}
+
+// FilterRecording keeps the messages whose topic matches topicFilter and
+// whose client is clientID. An empty filter or client ID keeps everything.
+func FilterRecording(messages []RecordedMessage, topicFilter, clientID string) []RecordedMessage {
+	var kept []RecordedMessage
+	for _, msg := range messages {
+		if clientID != "" && msg.ClientID != clientID {
+			continue
+		}
+		if topicFilter != "" {
+			if _, ok := auth.MatchTopic(topicFilter, msg.Topic); !ok {
+				continue
+			}
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// RecordedPayloads returns the payloads of messages, ready for the replay generator.
+func RecordedPayloads(messages []RecordedMessage) [][]byte {
+	payloads := make([][]byte, len(messages))
+	for i, msg := range messages {
+		payloads[i] = msg.Payload
+	}
+	return payloads
+}
@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRecording writes messages as a gzipped NDJSON recording, the format the
+// broker's traffic recorder produces.
+func writeRecording(t *testing.T, path string, messages []RecordedMessage) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	for _, msg := range messages {
+		require.NoError(t, enc.Encode(msg))
+	}
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+}
+
+// useRecordingsDir points replay requests at dir for the rest of the test.
+func useRecordingsDir(t *testing.T, dir string) {
+	t.Helper()
+	SetRecordingsDir(dir)
+	t.Cleanup(func() { SetRecordingsDir("") })
+}
+
+// TestLoadRecordingsReadsDirectoryInOrder verifies a directory of recordings
+// is read oldest file first and that partial files are skipped.
+func TestLoadRecordingsReadsDirectoryInOrder(t *testing.T) {
+	// --- Arrange ---
+	dir := t.TempDir()
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	writeRecording(t, filepath.Join(dir, "traffic-20250301T120100.000000000Z.ndjson.gz"), []RecordedMessage{
+		{Topic: "devices/dev-1/data", Payload: []byte(`{"n": 3}`), ClientID: "dev-1", ReceivedAt: start.Add(time.Minute)},
+	})
+	writeRecording(t, filepath.Join(dir, "traffic-20250301T120000.000000000Z.ndjson.gz"), []RecordedMessage{
+		{Topic: "devices/dev-1/data", Payload: []byte(`{"n": 1}`), QoS: 1, ClientID: "dev-1", ReceivedAt: start},
+		{Topic: "devices/dev-2/status", Payload: []byte(`{"n": 2}`), Retain: true, ClientID: "dev-2", ReceivedAt: start.Add(time.Second)},
+	})
+	writeRecording(t, filepath.Join(dir, "traffic-20250301T120200.000000000Z.ndjson.gz.part"), []RecordedMessage{
+		{Topic: "devices/dev-1/data", Payload: []byte(`{"n": 4}`)},
+	})
+
+	// --- Act ---
+	messages, err := LoadRecordings(dir)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, [][]byte{[]byte(`{"n": 1}`), []byte(`{"n": 2}`), []byte(`{"n": 3}`)}, RecordedPayloads(messages))
+	assert.Equal(t, byte(1), messages[0].QoS)
+	assert.True(t, messages[1].Retain)
+	assert.True(t, messages[0].ReceivedAt.Equal(start))
+
+	assert.Len(t, FilterRecording(messages, "devices/+/data", ""), 2)
+	assert.Len(t, FilterRecording(messages, "", "dev-2"), 1)
+	assert.Empty(t, FilterRecording(messages, "devices/+/data", "dev-2"))
+}
+
+// TestReadRecordingAcceptsPlainNDJSON verifies an uncompressed recording can
+// be read and that a corrupt line is reported.
+func TestReadRecordingAcceptsPlainNDJSON(t *testing.T) {
+	// --- Act ---
+	messages, err := ReadRecording(strings.NewReader(`{"topic": "a/b", "payload": "e30="}` + "\n" + `{"topic": "a/c", "payload": "e30="}` + "\n"))
+	_, badErr := ReadRecording(strings.NewReader(`{"topic": "a/b"}` + "\n" + `{"topic": `))
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "{}", string(messages[1].Payload))
+	assert.ErrorContains(t, badErr, "after 1 messages")
+}
+
+// TestReplayGeneratorPlaysRecording verifies the replay generator accepts a
+// recording in place of messages.
+func TestReplayGeneratorPlaysRecording(t *testing.T) {
+	// --- Arrange ---
+	dir := t.TempDir()
+	useRecordingsDir(t, dir)
+	path := "traffic-20250301T120000.000000000Z.ndjson.gz"
+	writeRecording(t, filepath.Join(dir, path), []RecordedMessage{
+		{Topic: "devices/dev-1/data", Payload: []byte(`{"n": 1}`), ClientID: "dev-1"},
+		{Topic: "devices/dev-2/data", Payload: []byte(`{"n": 2}`), ClientID: "dev-2"},
+		{Topic: "devices/dev-1/data", Payload: []byte(`{"n": 3}`), ClientID: "dev-1"},
+	})
+	options, err := json.Marshal(map[string]string{"recording": path, "client_id": "dev-1"})
+	require.NoError(t, err)
+
+	// --- Act ---
+	generator, err := DefaultGenerators.New("replay", options)
+	_, emptyErr := DefaultGenerators.New("replay", json.RawMessage(`{"recording": "`+path+`", "client_id": "dev-9"}`))
+	_, bothErr := DefaultGenerators.New("replay", json.RawMessage(`{"recording": "`+path+`", "messages": ["e30="]}`))
+
+	// --- Assert ---
+	require.NoError(t, err)
+	device := &loadgen.Device{ID: "dev-1"}
+	first, err := generator.GeneratePayload(device)
+	require.NoError(t, err)
+	second, err := generator.GeneratePayload(device)
+	require.NoError(t, err)
+	assert.Equal(t, `{"n": 1}`, string(first))
+	assert.Equal(t, `{"n": 3}`, string(second))
+	assert.ErrorContains(t, emptyErr, "no messages to replay")
+	assert.ErrorContains(t, bothErr, "not both")
+}
+
+// TestRecordingCacheStaysInsideRecordingsDir verifies recordings can only be
+// named inside the recordings directory, and only once one is configured.
+func TestRecordingCacheStaysInsideRecordingsDir(t *testing.T) {
+	// --- Arrange ---
+	root := t.TempDir()
+	dir := filepath.Join(root, "recordings")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "day-1"), 0o755))
+	writeRecording(t, filepath.Join(dir, "day-1", "traffic.ndjson.gz"), []RecordedMessage{{Topic: "a/b", Payload: []byte("{}")}})
+	outside := filepath.Join(root, "secrets.ndjson")
+	require.NoError(t, os.WriteFile(outside, []byte(`{"topic": "a/b", "payload": "e30="}`), 0o600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape.ndjson")))
+
+	testCases := []struct {
+		name    string
+		dir     string
+		path    string
+		wantErr string
+	}{
+		{name: "file in a subdirectory", dir: dir, path: "day-1/traffic.ndjson.gz"},
+		{name: "the whole directory", dir: dir, path: "."},
+		{name: "absolute path", dir: dir, path: outside, wantErr: "inside the recordings directory"},
+		{name: "parent directory", dir: dir, path: "../secrets.ndjson", wantErr: "inside the recordings directory"},
+		{name: "symlink out of the directory", dir: dir, path: "escape.ndjson", wantErr: "not found"},
+		{name: "missing file", dir: dir, path: "day-2/traffic.ndjson.gz", wantErr: "not found"},
+		{name: "no recordings directory", path: "day-1/traffic.ndjson.gz", wantErr: "not enabled"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := newRecordingCache(maxCachedRecordings)
+			cache.setDir(tc.dir)
+
+			// --- Act ---
+			_, err := cache.load(tc.path)
+
+			// --- Assert ---
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				assert.NotContains(t, err.Error(), dir, "errors should not reveal the recordings directory")
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestRecordingCacheEvictsLeastRecentlyUsed verifies the cache holds no more
+// than its size and drops the recording used longest ago.
+func TestRecordingCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// --- Arrange ---
+	dir := t.TempDir()
+	for _, name := range []string{"a.ndjson.gz", "b.ndjson.gz", "c.ndjson.gz"} {
+		writeRecording(t, filepath.Join(dir, name), []RecordedMessage{{Topic: "a/b", Payload: []byte("{}")}})
+	}
+	cache := newRecordingCache(2)
+	cache.setDir(dir)
+
+	// --- Act ---
+	for _, name := range []string{"a.ndjson.gz", "b.ndjson.gz", "a.ndjson.gz", "c.ndjson.gz"} {
+		_, err := cache.load(name)
+		require.NoError(t, err)
+	}
+
+	// --- Assert ---
+	assert.Len(t, cache.entries, 2)
+	var cached []string
+	for _, path := range cache.order {
+		cached = append(cached, filepath.Base(path))
+	}
+	assert.Equal(t, []string{"a.ndjson.gz", "c.ndjson.gz"}, cached)
+}
@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+)
+
+// templatePlaceholder matches {{name}} or {{name:args}} in a template string.
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([a-z_]+)(?::([^}]*))?\s*\}\}`)
+
+// TemplatePayloadGenerator fills a JSON template for each message. A string
+// value that is exactly one placeholder is replaced by a typed value (numbers
+// stay numbers); placeholders inside longer strings are substituted as text.
+//
+//   - {{device_id}}: the device ID.
+//   - {{seq}}: the message sequence number for the device, from 1.
+//   - {{timestamp}}: the send time in RFC 3339; {{timestamp_ms}} in Unix milliseconds.
+//   - {{walk:min:max:step}}: a random walk within [min, max], moving at most step per message.
+//   - {{choice:a|b|c}}: one of the listed values, chosen at random.
+type TemplatePayloadGenerator struct {
+	root templateNode
+	seq  int
+	rng  *rand.Rand
+}
+
+// templateState is what nodes can read while rendering one message.
+type templateState struct {
+	device *loadgen.Device
+	seq    int
+	now    time.Time
+	rng    *rand.Rand
+}
+
+// templateNode renders part of the template.
+type templateNode interface {
+	render(state *templateState) any
+}
+
+// NewTemplatePayloadGenerator compiles template, rejecting unknown or malformed placeholders.
+func NewTemplatePayloadGenerator(template json.RawMessage) (*TemplatePayloadGenerator, error) {
+	dec := json.NewDecoder(bytes.NewReader(template))
+	dec.UseNumber()
+	var parsed any
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("invalid payload template: %w", err)
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	root, err := compileTemplate(parsed, rng)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplatePayloadGenerator{root: root, rng: rng}, nil
+}
+
+// GeneratePayload renders the next message for device.
+func (g *TemplatePayloadGenerator) GeneratePayload(device *loadgen.Device) ([]byte, error) {
+	g.seq++
+	state := &templateState{device: device, seq: g.seq, now: time.Now().UTC(), rng: g.rng}
+	return json.Marshal(g.root.render(state))
+}
+
+// compileTemplate turns a decoded JSON value into nodes.
+func compileTemplate(v any, rng *rand.Rand) (templateNode, error) {
+	switch value := v.(type) {
+	case map[string]any:
+		node := &objectNode{fields: make(map[string]templateNode, len(value))}
+		for key, field := range value {
+			compiled, err := compileTemplate(field, rng)
+			if err != nil {
+				return nil, err
+			}
+			node.fields[key] = compiled
+		}
+		return node, nil
+	case []any:
+		node := &arrayNode{}
+		for _, item := range value {
+			compiled, err := compileTemplate(item, rng)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, compiled)
+		}
+		return node, nil
+	case string:
+		return compileString(value, rng)
+	default:
+		return literalNode{value: value}, nil
+	}
+}
+
+// compileString compiles a string value, which may hold placeholders.
+func compileString(s string, rng *rand.Rand) (templateNode, error) {
+	matches := templatePlaceholder.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return literalNode{value: s}, nil
+	}
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		return compilePlaceholder(s[matches[0][2]:matches[0][3]], submatch(s, matches[0], 2), rng)
+	}
+
+	node := &textNode{}
+	last := 0
+	for _, m := range matches {
+		node.parts = append(node.parts, literalNode{value: s[last:m[0]]})
+		placeholder, err := compilePlaceholder(s[m[2]:m[3]], submatch(s, m, 2), rng)
+		if err != nil {
+			return nil, err
+		}
+		node.parts = append(node.parts, placeholder)
+		last = m[1]
+	}
+	node.parts = append(node.parts, literalNode{value: s[last:]})
+	return node, nil
+}
+
+// submatch returns group n of a regexp match, or "" if it did not take part.
+func submatch(s string, match []int, n int) string {
+	if match[2*n] < 0 {
+		return ""
+	}
+	return s[match[2*n]:match[2*n+1]]
+}
+
+// compilePlaceholder compiles a single placeholder.
+func compilePlaceholder(name, args string, rng *rand.Rand) (templateNode, error) {
+	switch name {
+	case "device_id":
+		return deviceIDNode{}, nil
+	case "seq":
+		return seqNode{}, nil
+	case "timestamp":
+		return timestampNode{}, nil
+	case "timestamp_ms":
+		return timestampNode{millis: true}, nil
+	case "walk":
+		return newWalkNode(args, rng)
+	case "choice":
+		choices := strings.Split(args, "|")
+		if args == "" || len(choices) == 0 {
+			return nil, fmt.Errorf("template placeholder {{choice:...}} needs values separated by |")
+		}
+		return choiceNode{choices: choices}, nil
+	default:
+		return nil, fmt.Errorf("unknown template placeholder {{%s}}", name)
+	}
+}
+
+// literalNode renders a fixed value.
+type literalNode struct{ value any }
+
+func (n literalNode) render(*templateState) any { return n.value }
+
+// objectNode renders a JSON object.
+type objectNode struct{ fields map[string]templateNode }
+
+func (n *objectNode) render(state *templateState) any {
+	out := make(map[string]any, len(n.fields))
+	for key, field := range n.fields {
+		out[key] = field.render(state)
+	}
+	return out
+}
+
+// arrayNode renders a JSON array.
+type arrayNode struct{ items []templateNode }
+
+func (n *arrayNode) render(state *templateState) any {
+	out := make([]any, 0, len(n.items))
+	for _, item := range n.items {
+		out = append(out, item.render(state))
+	}
+	return out
+}
+
+// textNode renders a string with placeholders substituted as text.
+type textNode struct{ parts []templateNode }
+
+func (n *textNode) render(state *templateState) any {
+	var b strings.Builder
+	for _, part := range n.parts {
+		_, _ = fmt.Fprint(&b, part.render(state))
+	}
+	return b.String()
+}
+
+// deviceIDNode renders the device ID.
+type deviceIDNode struct{}
+
+func (deviceIDNode) render(state *templateState) any { return state.device.ID }
+
+// seqNode renders the message sequence number.
+type seqNode struct{}
+
+func (seqNode) render(state *templateState) any { return state.seq }
+
+// timestampNode renders the send time.
+type timestampNode struct{ millis bool }
+
+func (n timestampNode) render(state *templateState) any {
+	if n.millis {
+		return state.now.UnixMilli()
+	}
+	return state.now.Format(time.RFC3339Nano)
+}
+
+// choiceNode renders one of a fixed set of values.
+type choiceNode struct{ choices []string }
+
+func (n choiceNode) render(state *templateState) any {
+	return n.choices[state.rng.Intn(len(n.choices))]
+}
+
+// walkNode renders a bounded random walk. Its value is per generator, and so per device.
+type walkNode struct {
+	min, max, step float64
+	integer        bool
+	value          float64
+}
+
+// newWalkNode parses "min:max:step" and starts the walk at a random point in range.
+func newWalkNode(args string, rng *rand.Rand) (*walkNode, error) {
+	parts := strings.Split(args, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("template placeholder {{walk:%s}} must be {{walk:min:max:step}}", args)
+	}
+	var bounds [3]float64
+	integer := true
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("template placeholder {{walk:%s}}: %w", args, err)
+		}
+		bounds[i] = v
+		integer = integer && v == math.Trunc(v)
+	}
+	if bounds[0] > bounds[1] || bounds[2] < 0 {
+		return nil, fmt.Errorf("template placeholder {{walk:%s}} needs min <= max and a non-negative step", args)
+	}
+	node := &walkNode{min: bounds[0], max: bounds[1], step: bounds[2], integer: integer}
+	node.value = node.min + rng.Float64()*(node.max-node.min)
+	return node, nil
+}
+
+func (n *walkNode) render(state *templateState) any {
+	n.value += (state.rng.Float64()*2 - 1) * n.step
+	n.value = math.Max(n.min, math.Min(n.max, n.value))
+	if n.integer {
+		return int64(math.Round(n.value))
+	}
+	return math.Round(n.value*100) / 100
+}
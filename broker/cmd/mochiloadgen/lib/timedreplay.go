@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/rs/zerolog"
+)
+
+// recordedDeviceID names the device for recorded messages without a client ID.
+const recordedDeviceID = "recorded"
+
+// ReplayRequest replays a broker traffic recording with its original timing:
+// each client in the recording becomes a device, and every message is sent at
+// its recorded offset from the first one divided by Speed (1 is real time, 10
+// ten times faster). AsFastAsPossible sends in recorded order without waiting.
+// Messages go to the topics they were recorded on unless Reroute sends them
+// through the request's topic pattern instead.
+type ReplayRequest struct {
+	Recording        string  `json:"recording"`
+	TopicFilter      string  `json:"topic_filter,omitempty"`
+	ClientID         string  `json:"client_id,omitempty"`
+	Speed            float64 `json:"speed,omitempty"`
+	AsFastAsPossible bool    `json:"as_fast_as_possible,omitempty"`
+	Reroute          bool    `json:"reroute,omitempty"`
+}
+
+// Validate checks the replay names a recording inside the recordings
+// directory and a usable speed.
+func (r *ReplayRequest) Validate() error {
+	if r.Recording == "" {
+		return fmt.Errorf("replay needs a recording")
+	}
+	if err := checkRecordingName(r.Recording); err != nil {
+		return err
+	}
+	if r.Speed < 0 {
+		return fmt.Errorf("replay speed must not be negative")
+	}
+	if r.AsFastAsPossible && r.Speed != 0 {
+		return fmt.Errorf("set only one of replay speed and as_fast_as_possible")
+	}
+	return nil
+}
+
+// speed returns the speed factor, 0 meaning as fast as possible.
+func (r *ReplayRequest) speed() float64 {
+	switch {
+	case r.AsFastAsPossible:
+		return 0
+	case r.Speed == 0:
+		return 1
+	default:
+		return r.Speed
+	}
+}
+
+// timedSend is one scheduled message: device's next payload, at an offset
+// from the start of the replay.
+type timedSend struct {
+	at     time.Duration
+	device *loadgen.Device
+}
+
+// TimedReplay sends recorded messages at their original offsets, scaled by a
+// speed factor, keeping the timing both within and across devices.
+type TimedReplay struct {
+	devices  []*loadgen.Device
+	topics   map[string][]string
+	schedule []timedSend
+	speed    float64
+}
+
+// NewTimedReplay schedules messages by their receive time. A speed of 0 sends
+// them in order as fast as possible.
+func NewTimedReplay(messages []RecordedMessage, speed float64) (*TimedReplay, error) {
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("nothing to replay")
+	}
+	if speed < 0 {
+		return nil, fmt.Errorf("replay speed must not be negative")
+	}
+
+	sorted := append([]RecordedMessage(nil), messages...)
+	sort.SliceStable(sorted, func(i, k int) bool { return sorted[i].ReceivedAt.Before(sorted[k].ReceivedAt) })
+	first, last := sorted[0].ReceivedAt, sorted[len(sorted)-1].ReceivedAt
+
+	// Each device replays its own payloads in time order, so its generator
+	// yields the right payload whenever the schedule calls on it.
+	payloads := make(map[string][][]byte)
+	topics := make(map[string][]string)
+	var order []string
+	for _, msg := range sorted {
+		id := msg.ClientID
+		if id == "" {
+			id = recordedDeviceID
+		}
+		if _, ok := payloads[id]; !ok {
+			order = append(order, id)
+		}
+		payloads[id] = append(payloads[id], msg.Payload)
+		topics[id] = append(topics[id], msg.Topic)
+	}
+
+	r := &TimedReplay{speed: speed, topics: topics, schedule: make([]timedSend, 0, len(sorted))}
+	devices := make(map[string]*loadgen.Device, len(order))
+	span := last.Sub(first).Seconds()
+	for _, id := range order {
+		device := &loadgen.Device{ID: id, PayloadGenerator: loadgen.NewReplayPayloadGenerator(payloads[id])}
+		if span > 0 {
+			device.MessageRate = float64(len(payloads[id])) / span
+		}
+		devices[id] = device
+		r.devices = append(r.devices, device)
+	}
+	for _, msg := range sorted {
+		id := msg.ClientID
+		if id == "" {
+			id = recordedDeviceID
+		}
+		var at time.Duration
+		if speed > 0 {
+			at = time.Duration(float64(msg.ReceivedAt.Sub(first)) / speed)
+		}
+		r.schedule = append(r.schedule, timedSend{at: at, device: devices[id]})
+	}
+	return r, nil
+}
+
+// Devices returns one device per recorded client.
+func (r *TimedReplay) Devices() []*loadgen.Device {
+	return r.devices
+}
+
+// Topics returns the recorded topic of each device's messages, in the order
+// they are sent, for TopicRouter.SetRecordedTopics.
+func (r *TimedReplay) Topics() map[string][]string {
+	return r.topics
+}
+
+// Messages returns how many messages the replay sends.
+func (r *TimedReplay) Messages() int {
+	return len(r.schedule)
+}
+
+// Duration is how long the replay takes at its speed; zero when it runs as
+// fast as possible.
+func (r *TimedReplay) Duration() time.Duration {
+	return r.schedule[len(r.schedule)-1].at
+}
+
+// RateHz is the replay's average rate in messages per second at its speed;
+// unbounded when it runs as fast as possible.
+func (r *TimedReplay) RateHz() float64 {
+	if len(r.schedule) < 2 {
+		return 0
+	}
+	if r.Duration() <= 0 {
+		return math.Inf(1)
+	}
+	return float64(len(r.schedule)) / r.Duration().Seconds()
+}
+
+// Run connects client and sends every scheduled message, stopping early if
+// ctx is cancelled or, when limit is positive, once limit has passed. A send
+// that falls behind schedule goes out immediately, so bursts stay bursts.
+func (r *TimedReplay) Run(ctx context.Context, client loadgen.Client, limit time.Duration, logger zerolog.Logger) (int, error) {
+	if err := client.Connect(); err != nil {
+		return 0, fmt.Errorf("failed to connect load test client: %w", err)
+	}
+	defer client.Disconnect()
+
+	runCtx := ctx
+	if limit > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+	published := 0
+	for _, send := range r.schedule {
+		if wait := send.at - time.Since(start); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-runCtx.Done():
+				return published, ctx.Err()
+			case <-timer.C:
+			}
+		} else if runCtx.Err() != nil {
+			return published, ctx.Err()
+		}
+
+		ok, err := client.Publish(runCtx, send.device)
+		if err != nil {
+			if runCtx.Err() != nil {
+				return published, ctx.Err()
+			}
+			logger.Warn().Err(err).Str("device_id", send.device.ID).Msg("Replay publish failed")
+			continue
+		}
+		if ok {
+			published++
+		}
+	}
+
+	logger.Info().Int("published", published).Float64("speed", r.speed).Dur("lag", time.Since(start)-r.Duration()).Msg("Timed replay finished")
+	return published, nil
+}
@@ -0,0 +1,240 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timedSendRecord is a payload a timingClient published and when.
+type timedSendRecord struct {
+	deviceID string
+	payload  string
+	at       time.Duration
+}
+
+// timingClient generates and records every payload with its time since Connect.
+type timingClient struct {
+	mu    sync.Mutex
+	start time.Time
+	sends []timedSendRecord
+}
+
+func (c *timingClient) Connect() error { c.start = time.Now(); return nil }
+func (c *timingClient) Disconnect()    {}
+func (c *timingClient) Publish(_ context.Context, device *loadgen.Device) (bool, error) {
+	payload, err := device.PayloadGenerator.GeneratePayload(device)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sends = append(c.sends, timedSendRecord{deviceID: device.ID, payload: string(payload), at: time.Since(c.start)})
+	return true, nil
+}
+
+// recordedBurst is two clients' traffic: a burst of three messages, a gap,
+// then one more, recorded out of order.
+func recordedBurst() []RecordedMessage {
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []RecordedMessage{
+		{Topic: "devices/dev-2/alarm", ClientID: "dev-2", Payload: []byte("d"), ReceivedAt: start.Add(800 * time.Millisecond)},
+		{Topic: "devices/dev-1/data", ClientID: "dev-1", Payload: []byte("a"), ReceivedAt: start},
+		{Topic: "devices/dev-2/data", ClientID: "dev-2", Payload: []byte("b"), ReceivedAt: start.Add(10 * time.Millisecond)},
+		{Topic: "devices/dev-1/data", ClientID: "dev-1", Payload: []byte("c"), ReceivedAt: start.Add(20 * time.Millisecond)},
+	}
+}
+
+// TestTimedReplayKeepsOriginalTiming verifies messages go out in recorded
+// order at their recorded offsets divided by the speed.
+func TestTimedReplayKeepsOriginalTiming(t *testing.T) {
+	// --- Arrange ---
+	replay, err := NewTimedReplay(recordedBurst(), 2)
+	require.NoError(t, err)
+	client := &timingClient{}
+
+	// --- Act ---
+	published, err := replay.Run(context.Background(), client, 0, zerolog.Nop())
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, 4, published)
+	assert.Equal(t, 400*time.Millisecond, replay.Duration())
+	require.Len(t, replay.Devices(), 2)
+	assert.Equal(t, "dev-1", replay.Devices()[0].ID)
+
+	require.Len(t, client.sends, 4)
+	var order []string
+	for _, send := range client.sends {
+		order = append(order, send.deviceID+":"+send.payload)
+	}
+	assert.Equal(t, []string{"dev-1:a", "dev-2:b", "dev-1:c", "dev-2:d"}, order)
+	assert.Less(t, client.sends[2].at, 150*time.Millisecond, "the burst should stay a burst")
+	assert.GreaterOrEqual(t, client.sends[3].at, 400*time.Millisecond, "the gap should be kept at half length")
+}
+
+// TestTimedReplayAsFastAsPossible verifies a zero speed keeps the order but
+// not the gaps.
+func TestTimedReplayAsFastAsPossible(t *testing.T) {
+	// --- Arrange ---
+	replay, err := NewTimedReplay(recordedBurst(), 0)
+	require.NoError(t, err)
+	client := &timingClient{}
+
+	// --- Act ---
+	published, err := replay.Run(context.Background(), client, 0, zerolog.Nop())
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, 4, published)
+	assert.Zero(t, replay.Duration())
+	assert.Equal(t, "d", client.sends[3].payload)
+	assert.Less(t, client.sends[3].at, 200*time.Millisecond)
+}
+
+// TestTimedReplayStopsAtLimit verifies a replay is cut off at its limit.
+func TestTimedReplayStopsAtLimit(t *testing.T) {
+	// --- Arrange ---
+	replay, err := NewTimedReplay(recordedBurst(), 1)
+	require.NoError(t, err)
+	client := &timingClient{}
+
+	// --- Act ---
+	published, err := replay.Run(context.Background(), client, 200*time.Millisecond, zerolog.Nop())
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.Equal(t, 3, published)
+}
+
+// TestReplayRequestValidate verifies recording names and speeds are checked
+// and speeds default to real time.
+func TestReplayRequestValidate(t *testing.T) {
+	assert.Error(t, (&ReplayRequest{}).Validate())
+	assert.Error(t, (&ReplayRequest{Recording: "r", Speed: -1}).Validate())
+	assert.Error(t, (&ReplayRequest{Recording: "r", Speed: 2, AsFastAsPossible: true}).Validate())
+	assert.Error(t, (&ReplayRequest{Recording: "/recordings"}).Validate())
+	assert.Error(t, (&ReplayRequest{Recording: "../r"}).Validate())
+
+	assert.Equal(t, 1.0, (&ReplayRequest{Recording: "r"}).speed())
+	assert.Equal(t, 10.0, (&ReplayRequest{Recording: "r", Speed: 10}).speed())
+	assert.Equal(t, 0.0, (&ReplayRequest{Recording: "r", AsFastAsPossible: true}).speed())
+}
+
+// TestHandleLoadTestReplayStaysInsideRecordingsDir verifies a replay request
+// cannot name a recording outside the recordings directory.
+func TestHandleLoadTestReplayStaysInsideRecordingsDir(t *testing.T) {
+	// --- Arrange ---
+	root := t.TempDir()
+	dir := filepath.Join(root, "recordings")
+	outside := filepath.Join(root, "private", "traffic.ndjson.gz")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Dir(outside), 0o755))
+	writeRecording(t, filepath.Join(dir, "traffic.ndjson.gz"), recordedBurst())
+	writeRecording(t, outside, recordedBurst())
+	useRecordingsDir(t, dir)
+	server, _ := newInlineServer(t, "devices/+/data")
+	handler := NewHandler(server)
+
+	for _, recording := range []string{outside, "../private/traffic.ndjson.gz"} {
+		t.Run(recording, func(t *testing.T) {
+			body := fmt.Sprintf(`{"replay": {"recording": %q, "as_fast_as_possible": true}}`, recording)
+
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			handler.HandleLoadTest(rec, httptest.NewRequest(http.MethodPost, "/load-test", strings.NewReader(body)))
+
+			// --- Assert ---
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Contains(t, rec.Body.String(), "inside the recordings directory")
+		})
+	}
+	assert.Empty(t, handler.jobs.List(), "no job should have started")
+}
+
+// TestHandleLoadTestReplayTopics verifies a replay publishes on the recorded
+// topics unless it is rerouted through the topic pattern.
+func TestHandleLoadTestReplayTopics(t *testing.T) {
+	// --- Arrange ---
+	dir := t.TempDir()
+	writeRecording(t, filepath.Join(dir, "burst.ndjson.gz"), recordedBurst())
+	useRecordingsDir(t, dir)
+
+	testCases := []struct {
+		name       string
+		body       string
+		wantTopics []string
+	}{
+		{
+			name:       "recorded topics",
+			body:       `{"replay": {"recording": "burst.ndjson.gz", "as_fast_as_possible": true}}`,
+			wantTopics: []string{"devices/dev-1/data", "devices/dev-2/data", "devices/dev-1/data", "devices/dev-2/alarm"},
+		},
+		{
+			name:       "rerouted",
+			body:       `{"topic_pattern": "replayed/{device_id}", "replay": {"recording": "burst.ndjson.gz", "as_fast_as_possible": true, "reroute": true}}`,
+			wantTopics: []string{"replayed/dev-1", "replayed/dev-2", "replayed/dev-1", "replayed/dev-2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, received := newInlineServer(t, "#")
+			handler := NewHandler(server)
+
+			// --- Act ---
+			rec := httptest.NewRecorder()
+			handler.HandleLoadTest(rec, httptest.NewRequest(http.MethodPost, "/load-test", strings.NewReader(tc.body)))
+
+			// --- Assert ---
+			require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+			var topics []string
+			for range tc.wantTopics {
+				select {
+				case pk := <-received:
+					topics = append(topics, pk.TopicName)
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for replayed messages")
+				}
+			}
+			assert.Equal(t, tc.wantTopics, topics)
+		})
+	}
+}
+
+// TestHandleLoadTestReplayNeedsRerouteForTopicPattern verifies a topic pattern
+// is only taken with reroute, so it is never silently ignored.
+func TestHandleLoadTestReplayNeedsRerouteForTopicPattern(t *testing.T) {
+	// --- Arrange ---
+	dir := t.TempDir()
+	writeRecording(t, filepath.Join(dir, "burst.ndjson.gz"), recordedBurst())
+	useRecordingsDir(t, dir)
+	server, _ := newInlineServer(t, "#")
+	handler := NewHandler(server)
+
+	for _, body := range []string{
+		`{"topic_pattern": "devices/+/data", "replay": {"recording": "burst.ndjson.gz"}}`,
+		`{"replay": {"recording": "burst.ndjson.gz", "reroute": true}}`,
+	} {
+		// --- Act ---
+		rec := httptest.NewRecorder()
+		handler.HandleLoadTest(rec, httptest.NewRequest(http.MethodPost, "/load-test", strings.NewReader(body)))
+
+		// --- Assert ---
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		assert.Contains(t, rec.Body.String(), "reroute", body)
+	}
+	assert.Empty(t, handler.jobs.List(), "no job should have started")
+}
@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+)
+
+// payloadFieldPrefix marks a topic placeholder filled from the generated payload.
+const payloadFieldPrefix = "payload."
+
+// placeholderPattern matches a topic placeholder such as {device_id}.
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// TopicTemplate builds a message's topic from placeholders such as
+// {fleet}/{device_id}/{stream}. Values come from the device ID ({device_id}),
+// its fleet name ({fleet}), its metadata ({any_key}) or a top-level field of
+// the generated payload ({payload.field}). A pattern without placeholders
+// keeps the original behaviour: its first "+" is replaced by the device ID.
+type TopicTemplate struct {
+	pattern       string
+	parts         []topicPart
+	payloadFields bool
+}
+
+// topicPart is literal text or, when key is set, a placeholder.
+type topicPart struct {
+	literal string
+	key     string
+}
+
+// ParseTopicTemplate compiles a topic pattern.
+func ParseTopicTemplate(pattern string) (*TopicTemplate, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("topic pattern must not be empty")
+	}
+	if !strings.ContainsAny(pattern, "{}") {
+		pattern = strings.Replace(pattern, "+", "{device_id}", 1)
+	}
+
+	t := &TopicTemplate{pattern: pattern}
+	rest := pattern
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, topicPart{literal: rest})
+			break
+		}
+		closing := strings.IndexByte(rest[open:], '}')
+		if closing < 0 {
+			return nil, fmt.Errorf("topic pattern %q has an unclosed placeholder", pattern)
+		}
+		key := strings.TrimSpace(rest[open+1 : open+closing])
+		if key == "" || strings.ContainsAny(key, "{/") || key == payloadFieldPrefix {
+			return nil, fmt.Errorf("topic pattern %q has an invalid placeholder {%s}", pattern, key)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, topicPart{literal: rest[:open]})
+		}
+		t.parts = append(t.parts, topicPart{key: key})
+		t.payloadFields = t.payloadFields || strings.HasPrefix(key, payloadFieldPrefix)
+		rest = rest[open+closing+1:]
+	}
+
+	for _, part := range t.parts {
+		if strings.ContainsAny(part.literal, "+#}") {
+			return nil, fmt.Errorf("topic pattern %q must not contain wildcards or stray braces", pattern)
+		}
+	}
+	return t, nil
+}
+
+// Render fills the placeholders using lookup. Values must be a single,
+// non-empty topic level.
+func (t *TopicTemplate) Render(lookup func(key string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.key == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+		value, ok := lookup(part.key)
+		if !ok {
+			return "", fmt.Errorf("no value for topic placeholder {%s}", part.key)
+		}
+		if value == "" || strings.ContainsAny(value, "/+#") {
+			return "", fmt.Errorf("value %q for topic placeholder {%s} must be a single topic level", value, part.key)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// DeviceSettings are the per-device values used when routing its messages.
+type DeviceSettings struct {
+	Fleet    string
+	Metadata map[string]string
+	QoS      *byte
+	Retain   bool
+}
+
+// TopicRouter decides the topic, QoS and retain flag of each message and,
+// when a subscription filter is set, checks the topic matches it.
+type TopicRouter struct {
+	template *TopicTemplate
+	qos      byte
+	filter   string
+	settings map[string]DeviceSettings
+	recorded map[string]*recordedTopics
+}
+
+// recordedTopics are the topics one device's recorded messages were published
+// on, handed out in order as its messages are routed.
+type recordedTopics struct {
+	mu     sync.Mutex
+	topics []string
+	next   int
+}
+
+// pop returns the topic of the device's next message.
+func (t *recordedTopics) pop() (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next >= len(t.topics) {
+		return "", false
+	}
+	topic := t.topics[t.next]
+	t.next++
+	return topic, true
+}
+
+// NewTopicRouter creates a router. settings may be nil, and filter empty to
+// skip the subscription check.
+func NewTopicRouter(template *TopicTemplate, qos byte, filter string, settings map[string]DeviceSettings) *TopicRouter {
+	return &TopicRouter{template: template, qos: qos, filter: filter, settings: settings}
+}
+
+// SetRecordedTopics makes the router publish each device's messages on the
+// topics they were recorded on, in recorded order, instead of rendering the
+// template. topics maps a device ID to the topic of each of its messages.
+func (r *TopicRouter) SetRecordedTopics(topics map[string][]string) {
+	r.recorded = make(map[string]*recordedTopics, len(topics))
+	for id, deviceTopics := range topics {
+		r.recorded[id] = &recordedTopics{topics: deviceTopics}
+	}
+}
+
+// Route returns where and how to publish payload for device.
+func (r *TopicRouter) Route(device *loadgen.Device, payload []byte) (string, byte, bool, error) {
+	if r.recorded != nil {
+		return r.routeRecorded(device)
+	}
+	settings := r.settings[device.ID]
+	var fields map[string]any
+	if r.template.payloadFields {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return "", 0, false, fmt.Errorf("topic for device %s needs a JSON object payload: %w", device.ID, err)
+		}
+	}
+
+	topic, err := r.template.Render(func(key string) (string, bool) {
+		return topicValue(key, device.ID, settings, fields)
+	})
+	if err != nil {
+		return "", 0, false, fmt.Errorf("device %s: %w", device.ID, err)
+	}
+	if !r.matches(topic) {
+		return "", 0, false, fmt.Errorf("topic %s does not match the subscription filter %s", topic, r.filter)
+	}
+
+	qos := r.qos
+	if settings.QoS != nil {
+		qos = *settings.QoS
+	}
+	return topic, qos, settings.Retain, nil
+}
+
+// routeRecorded returns the recorded topic of device's next message.
+func (r *TopicRouter) routeRecorded(device *loadgen.Device) (string, byte, bool, error) {
+	topics, ok := r.recorded[device.ID]
+	if !ok {
+		return "", 0, false, fmt.Errorf("device %s has no recorded topics", device.ID)
+	}
+	topic, ok := topics.pop()
+	if !ok {
+		return "", 0, false, fmt.Errorf("device %s has no recorded topics left", device.ID)
+	}
+	if !r.matches(topic) {
+		return "", 0, false, fmt.Errorf("topic %s does not match the subscription filter %s", topic, r.filter)
+	}
+	return topic, r.qos, false, nil
+}
+
+// Validate routes a sample message for every device before the test starts.
+// Payload placeholders are filled with a sample value, as the real ones are
+// only known once messages are generated. Recorded topics are all checked.
+func (r *TopicRouter) Validate(devices []*loadgen.Device) error {
+	if r.qos > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2")
+	}
+	if r.recorded != nil {
+		return r.validateRecorded(devices)
+	}
+	for _, device := range devices {
+		settings := r.settings[device.ID]
+		if settings.QoS != nil && *settings.QoS > 2 {
+			return fmt.Errorf("device %s: qos must be 0, 1 or 2", device.ID)
+		}
+		topic, err := r.template.Render(func(key string) (string, bool) {
+			if strings.HasPrefix(key, payloadFieldPrefix) {
+				return "sample", true
+			}
+			return topicValue(key, device.ID, settings, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("device %s: %w", device.ID, err)
+		}
+		if !r.matches(topic) {
+			return fmt.Errorf("device %s: topic %s does not match the subscription filter %s", device.ID, topic, r.filter)
+		}
+	}
+	return nil
+}
+
+// validateRecorded checks every device has recorded topics and that they all
+// match the subscription filter.
+func (r *TopicRouter) validateRecorded(devices []*loadgen.Device) error {
+	for _, device := range devices {
+		topics, ok := r.recorded[device.ID]
+		if !ok {
+			return fmt.Errorf("device %s has no recorded topics", device.ID)
+		}
+		for _, topic := range topics.topics {
+			if !r.matches(topic) {
+				return fmt.Errorf("device %s: recorded topic %s does not match the subscription filter %s", device.ID, topic, r.filter)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether topic matches the subscription filter, if there is one.
+func (r *TopicRouter) matches(topic string) bool {
+	if r.filter == "" {
+		return true
+	}
+	_, ok := auth.MatchTopic(r.filter, topic)
+	return ok
+}
+
+// topicValue looks up a placeholder value for a device.
+func topicValue(key, deviceID string, settings DeviceSettings, fields map[string]any) (string, bool) {
+	switch {
+	case key == "device_id":
+		return deviceID, true
+	case key == "fleet":
+		return settings.Fleet, settings.Fleet != ""
+	case strings.HasPrefix(key, payloadFieldPrefix):
+		value, ok := fields[strings.TrimPrefix(key, payloadFieldPrefix)]
+		if !ok || value == nil {
+			return "", false
+		}
+		return fmt.Sprint(value), true
+	default:
+		value, ok := settings.Metadata[key]
+		return value, ok
+	}
+}
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyRouter routes every message to pattern at qos, as a plain
+// single-"+" topic pattern always has.
+func legacyRouter(t *testing.T, pattern string, qos byte) *TopicRouter {
+	t.Helper()
+	template, err := ParseTopicTemplate(pattern)
+	require.NoError(t, err)
+	return NewTopicRouter(template, qos, "", nil)
+}
+
+// TestTopicRouterRendersTemplates verifies each kind of placeholder, and that a
+// pattern without placeholders keeps the single "+" substitution.
+func TestTopicRouterRendersTemplates(t *testing.T) {
+	settings := map[string]DeviceSettings{
+		"garden-1": {Fleet: "gardens", Metadata: map[string]string{"site": "north"}},
+	}
+	device := &loadgen.Device{ID: "garden-1"}
+	payload := []byte(`{"stream": "telemetry", "channel": 3}`)
+
+	testCases := []struct {
+		name    string
+		pattern string
+		want    string
+	}{
+		{name: "legacy plus", pattern: "devices/+/data", want: "devices/garden-1/data"},
+		{name: "device and fleet", pattern: "{fleet}/{device_id}/data", want: "gardens/garden-1/data"},
+		{name: "metadata", pattern: "sites/{site}/{device_id}", want: "sites/north/garden-1"},
+		{name: "payload fields", pattern: "{fleet}/{device_id}/{payload.stream}/{payload.channel}", want: "gardens/garden-1/telemetry/3"},
+		{name: "placeholder inside a level", pattern: "devices/dev-{device_id}", want: "devices/dev-garden-1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			template, err := ParseTopicTemplate(tc.pattern)
+			require.NoError(t, err)
+			router := NewTopicRouter(template, 0, "", settings)
+
+			// --- Act ---
+			topic, _, _, err := router.Route(device, payload)
+
+			// --- Assert ---
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, topic)
+		})
+	}
+}
+
+// TestParseTopicTemplateRejectsBadPatterns verifies malformed patterns are
+// reported before a load test starts.
+func TestParseTopicTemplateRejectsBadPatterns(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pattern string
+	}{
+		{name: "empty", pattern: ""},
+		{name: "unclosed placeholder", pattern: "{fleet/{device_id}"},
+		{name: "stray brace", pattern: "devices/{device_id}}/data"},
+		{name: "empty placeholder", pattern: "devices/{}/data"},
+		{name: "wildcard beside placeholders", pattern: "{fleet}/+/data"},
+		{name: "multi-level wildcard", pattern: "devices/#"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Act ---
+			_, err := ParseTopicTemplate(tc.pattern)
+
+			// --- Assert ---
+			assert.Error(t, err)
+		})
+	}
+}
+
+// TestTopicRouterValidate verifies topics are checked against the subscription
+// filter and that missing placeholder values are reported per device.
+func TestTopicRouterValidate(t *testing.T) {
+	devices := []*loadgen.Device{{ID: "garden-1"}, {ID: "meter-1"}}
+	settings := map[string]DeviceSettings{
+		"garden-1": {Fleet: "gardens"},
+		"meter-1":  {Fleet: "meters"},
+	}
+
+	testCases := []struct {
+		name    string
+		pattern string
+		filter  string
+		wantErr string
+	}{
+		{name: "matches filter", pattern: "{fleet}/{device_id}/{payload.stream}", filter: "+/+/+"},
+		{name: "no filter", pattern: "{fleet}/{device_id}"},
+		{name: "outside filter", pattern: "{fleet}/{device_id}", filter: "gardens/+", wantErr: "does not match the subscription filter gardens/+"},
+		{name: "missing metadata", pattern: "{site}/{device_id}", wantErr: "no value for topic placeholder {site}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// --- Arrange ---
+			template, err := ParseTopicTemplate(tc.pattern)
+			require.NoError(t, err)
+			router := NewTopicRouter(template, 1, tc.filter, settings)
+
+			// --- Act ---
+			err = router.Validate(devices)
+
+			// --- Assert ---
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+// TestInProcessClientUsesPerDeviceSettings verifies fleets built from a
+// request publish with their own topics and retain flags.
+func TestInProcessClientUsesPerDeviceSettings(t *testing.T) {
+	// --- Arrange ---
+	server, received := newInlineServer(t, "#")
+	qos := byte(1)
+	req := &LoadTestRequest{
+		TopicPattern: "{fleet}/{device_id}/{payload.stream}",
+		Devices: []DeviceRequest{{
+			ID: "alarm-1", MessageRateHz: 1, PayloadGenerator: "replay",
+			Messages: [][]byte{[]byte(`{"stream": "alarms"}`)}, Fleet: "alarms", QoS: &qos, Retain: true,
+		}},
+		Fleets: []FleetRequest{{
+			Name: "gardens", Count: 1, IDPattern: "garden-{d}", RateHz: 1, PayloadGenerator: "replay",
+			GeneratorOptions: []byte(`{"messages": ["eyJzdHJlYW0iOiAidGVsZW1ldHJ5In0="]}`),
+		}},
+	}
+	devices, settings, err := BuildDevices(req, rand.New(rand.NewSource(1)), &FaultCounters{})
+	require.NoError(t, err)
+	template, err := ParseTopicTemplate(req.TopicPattern)
+	require.NoError(t, err)
+	router := NewTopicRouter(template, 0, "+/+/+", settings)
+	require.NoError(t, router.Validate(devices))
+	client := NewInProcessClientWithRouter(server, router)
+
+	// --- Act ---
+	for _, device := range devices {
+		ok, err := client.Publish(context.Background(), device)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// --- Assert ---
+	topics := map[string]bool{}
+	for range devices {
+		select {
+		case pk := <-received:
+			topics[pk.TopicName] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for messages")
+		}
+	}
+	assert.True(t, topics["alarms/alarm-1/alarms"])
+	assert.True(t, topics["gardens/garden-1/telemetry"])
+	assert.Len(t, server.Topics.Messages("alarms/#"), 1, "the alarm device publishes retained")
+	assert.Empty(t, server.Topics.Messages("gardens/#"), "the fleet does not retain")
+}
+
+// TestTopicRouterRecordedTopics verifies recorded topics are handed out in
+// order per device and checked against the subscription filter.
+func TestTopicRouterRecordedTopics(t *testing.T) {
+	// --- Arrange ---
+	device := &loadgen.Device{ID: "dev-1"}
+	router := NewTopicRouter(nil, 1, "devices/#", nil)
+	router.SetRecordedTopics(map[string][]string{"dev-1": {"devices/dev-1/data", "devices/dev-1/alarm"}})
+
+	// --- Act ---
+	first, qos, _, err1 := router.Route(device, nil)
+	second, _, _, err2 := router.Route(device, nil)
+	_, _, _, errExhausted := router.Route(device, nil)
+	_, _, _, errUnknown := router.Route(&loadgen.Device{ID: "dev-2"}, nil)
+
+	// --- Assert ---
+	require.NoError(t, err1)
+	require.NoError(t, err2)
+	assert.Equal(t, "devices/dev-1/data", first)
+	assert.Equal(t, "devices/dev-1/alarm", second)
+	assert.Equal(t, byte(1), qos)
+	assert.Error(t, errExhausted)
+	assert.Error(t, errUnknown)
+
+	strict := NewTopicRouter(nil, 0, "devices/+/data", nil)
+	strict.SetRecordedTopics(map[string][]string{"dev-1": {"devices/dev-1/data", "devices/dev-1/alarm"}})
+	assert.ErrorContains(t, strict.Validate([]*loadgen.Device{device}), "devices/dev-1/alarm")
+}
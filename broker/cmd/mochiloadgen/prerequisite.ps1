@@ -20,6 +20,7 @@ $userEmail = $(gcloud config get-value account)
 
 $arRepo = "cloud-deploy"
 $secretName = "SERVICE_PASS"
+$controlTokenSecretName = "LOADGEN_CONTROL_TOKEN"
 $serviceAccountName = "mochi-vm-sa"
 $vpcConnectorName = "test-vpc-connector"
 $cloudRouterName = "test-nat-router"
@@ -50,6 +51,18 @@ if (-not $secret) {
     Remove-Item "temp_secret.txt"
 } else { Write-Host "Secret '$secretName' already exists." }
 
+# The bearer token callers of /load-test must send; deploy.ps1 points the server at it.
+$controlToken = gcloud secrets describe $controlTokenSecretName --project=$projectId --format="value(name)" --quiet -ErrorAction SilentlyContinue
+if (-not $controlToken) {
+    Write-Host "Creating secret '$controlTokenSecretName' with a random control token..."
+    $tokenBytes = New-Object byte[] 32
+    [System.Security.Cryptography.RandomNumberGenerator]::Create().GetBytes($tokenBytes)
+    Set-Content -Path "temp_token.txt" -Value ([Convert]::ToBase64String($tokenBytes)) -NoNewline
+    gcloud secrets create $controlTokenSecretName --project=$projectId --replication-policy="automatic"
+    gcloud secrets versions add $controlTokenSecretName --project=$projectId --data-file="temp_token.txt"
+    Remove-Item "temp_token.txt"
+} else { Write-Host "Secret '$controlTokenSecretName' already exists." }
+
 # --- 3. Create and Configure Service Account ---
 Write-Host "### Setting up required Service Account '$($serviceAccountName)'... ###" -ForegroundColor Yellow
 $sa_email = "$($serviceAccountName)@$($projectId).iam.gserviceaccount.com"
@@ -16,6 +16,7 @@ USER_EMAIL=$(gcloud config get-value account)
 
 AR_REPO="cloud-deploy"
 SECRET_NAME="SERVICE_PASS"
+CONTROL_TOKEN_SECRET_NAME="LOADGEN_CONTROL_TOKEN"
 SA_NAME="mochi-vm-sa"
 VPC_CONNECTOR_NAME="test-vpc-connector"
 
@@ -57,6 +58,17 @@ else
     echo "Secret '$SECRET_NAME' already exists."
 fi
 
+# The bearer token callers of /load-test must send; the deploy script points the server at it.
+if ! gcloud secrets describe "$CONTROL_TOKEN_SECRET_NAME" --project="$PROJECT_ID" --quiet > /dev/null 2>&1; then
+    echo "Creating secret '$CONTROL_TOKEN_SECRET_NAME' with a random control token..."
+    openssl rand -base64 32 | tr -d '\n' > temp_token.txt
+    gcloud secrets create "$CONTROL_TOKEN_SECRET_NAME" --project="$PROJECT_ID" --replication-policy="automatic"
+    gcloud secrets versions add "$CONTROL_TOKEN_SECRET_NAME" --project="$PROJECT_ID" --data-file="temp_token.txt"
+    rm temp_token.txt
+else
+    echo "Secret '$CONTROL_TOKEN_SECRET_NAME' already exists."
+fi
+
 # --- 3. Create and Configure Service Account ---
 echo "### Setting up required Service Account '$SA_NAME'... ###"
 SA_EMAIL="${SA_NAME}@${PROJECT_ID}.iam.gserviceaccount.com"
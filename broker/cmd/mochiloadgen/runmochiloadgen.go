@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // --- ADDED: Function to get secret from Secret Manager ---
@@ -40,58 +41,45 @@ func getSecret(ctx context.Context, secretName string) (string, error) {
 // --- END ADDED ---
 
 func main() {
+	// Load the configuration: an optional YAML file plus env overrides.
+	configPath := os.Getenv("LOADGEN_CONFIG")
+	cfg, err := loadLoadgenConfig(configPath)
+	if err != nil {
+		slog.Error("Invalid loadgen configuration", "error", err)
+		os.Exit(1)
+	}
+
 	// Setup structured logging.
-	logLevel := os.Getenv("LOG_LEVEL")
 	level := new(slog.LevelVar)
-	switch logLevel {
-	case "info":
-		level.Set(slog.LevelInfo)
-	default:
-		level.Set(slog.LevelDebug)
-	}
+	level.Set(cfg.slogLevel())
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 	slog.SetDefault(logger)
 
 	ctx, stop := context.WithCancel(context.Background())
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// --- EDITED: Fetch Password from Secret Manager ---
-	clientUser := os.Getenv("MQTT_USERNAME")
-	secretName := os.Getenv("MQTT_PASS_SECRET_NAME") // We now get the secret name
-	if clientUser == "" || secretName == "" {
-		slog.Error("MQTT_USERNAME and MQTT_PASS_SECRET_NAME must be set")
-		os.Exit(1)
-	}
-
-	clientPass, err := getSecret(ctx, secretName)
+	clientPass, err := cfg.resolvePassword(ctx)
 	if err != nil {
-		slog.Error("Failed to fetch MQTT password from Secret Manager", "error", err)
+		slog.Error("Failed to fetch MQTT password", "error", err)
 		os.Exit(1)
 	}
-	// --- END EDITED ---
 
 	server := mqtt.New(&mqtt.Options{
 		Logger:       logger,
 		InlineClient: true,
 	})
 
-	// --- EDITED: This block now uses the fetched credentials ---
-	authRules := auth.AuthRules{
-		{Username: auth.RString(clientUser), Password: auth.RString(clientPass), Allow: true},
-	}
-	if err := server.AddHook(new(auth.AllowHook), &auth.Options{
-		Ledger: &auth.Ledger{Auth: authRules},
-	}); err != nil {
+	ledger, err := addAuthHook(server, cfg.Username, clientPass, cfg.aclRules())
+	if err != nil {
 		slog.Error("Failed to configure Mochi auth hook", "error", err)
 		os.Exit(1)
 	}
-	// --- END EDITED ---
 
 	tcpListener := listeners.NewTCP(listeners.Config{
 		ID:      "tcp-listener",
-		Address: ":1883",
+		Address: ":" + cfg.MQTTPort,
 	})
 	if err := server.AddListener(tcpListener); err != nil {
 		slog.Error("Failed to add MQTT TCP listener", "error", err)
@@ -99,21 +87,65 @@ func main() {
 	}
 
 	go func() {
-		slog.Info("Starting in-memory Mochi MQTT Broker with TCP listener on :1883")
+		slog.Info("Starting in-memory Mochi MQTT Broker with TCP listener", "port", cfg.MQTTPort)
 		if err := server.Serve(); err != nil {
 			slog.Error("Mochi server failed", "error", err)
 		}
 	}()
 
-	// Pub/Sub passthrough section removed for brevity...
-
-	httpPort := os.Getenv("PORT")
-	if httpPort == "" {
-		httpPort = "8080"
+	// --- Pub/Sub passthrough ---
+	// The pull subscriber runs until ctx is cancelled at shutdown.
+	var subscriber *lib.PassthroughSubscriber
+	subscriberDone := make(chan struct{})
+	if cfg.Passthrough.pull() {
+		subscriber, err = lib.NewPassthroughSubscriber(ctx, cfg.Passthrough.ProjectID, cfg.Passthrough.SubscriptionID, server)
+		if err != nil {
+			slog.Error("Failed to create Pub/Sub passthrough subscriber", "error", err)
+			os.Exit(1)
+		}
+		subscriber.SetTopicPrefixes(cfg.Passthrough.TopicPrefixes)
+		go func() {
+			defer close(subscriberDone)
+			subscriber.Start(ctx)
+		}()
+	} else {
+		close(subscriberDone)
 	}
+
+	httpPort := cfg.HTTPPort
 	handler := lib.NewHandler(server)
+	handler.SetSecretResolver(getSecret, cfg.ClientPasswordSecrets)
+	handler.SetTopicFilter(cfg.IngestionTopic)
+	handler.SetLimits(cfg.Limits.requestLimits())
+	handler.SetMaxBodyBytes(cfg.Limits.MaxRequestBytes)
+	lib.SetRecordingsDir(cfg.RecordingsDir)
+
+	// The control endpoints start traffic, so they sit behind the configured authentication.
+	controlAuth, tokenAuth, err := newControlAuth(ctx, cfg.ControlAuth)
+	if err != nil {
+		slog.Error("Failed to configure control endpoint authentication", "error", err)
+		os.Exit(1)
+	}
+	if controlAuth == nil {
+		slog.Warn("Control endpoints are not authenticated; anyone who can reach the HTTP port can start load tests")
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/load-test", handler.HandleLoadTest)
+	mux.Handle("/load-test", lib.RequireAuth(controlAuth, http.HandlerFunc(handler.HandleLoadTest)))
+	mux.Handle("/load-test/", lib.RequireAuth(controlAuth, http.HandlerFunc(handler.HandleLoadTestJob)))
+	mux.Handle("/generators", lib.RequireAuth(controlAuth, lib.DefaultGenerators))
+	if cfg.Passthrough.push() {
+		pushAuth, err := cfg.Passthrough.pushAuthenticator()
+		if err != nil {
+			slog.Error("Failed to configure push passthrough authentication", "error", err)
+			os.Exit(1)
+		}
+		if pushAuth == nil {
+			slog.Warn("Push passthrough requests are not authenticated; anyone who can reach the HTTP port can publish to MQTT")
+		}
+		handler.SetPassthroughPolicy(pushAuth, cfg.Passthrough.TopicPrefixes)
+		slog.Info("Registering Pub/Sub push passthrough endpoint", "path", cfg.Passthrough.PushPath, "topic_prefixes", cfg.Passthrough.TopicPrefixes)
+		mux.HandleFunc(cfg.Passthrough.PushPath, handler.HandlePassthrough)
+	}
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
@@ -128,31 +160,126 @@ func main() {
 		}
 	}()
 
-	<-sigs
+	// SIGHUP re-reads the config and the password secret without dropping connections.
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig(ctx, configPath, ledger, tokenAuth, level)
+	}
 	slog.Info("Shutdown signal received, gracefully shutting down...")
+	shutdown(cfg.ShutdownTimeout, handler, stop, subscriber, subscriberDone, httpServer, server)
+}
+
+// shutdown stops the load generator in order: no new load tests, running load
+// tests drained (and cancelled at the deadline), the passthrough subscriber,
+// the HTTP server and finally the broker. Anything cut short is logged.
+func shutdown(timeout time.Duration, handler *lib.Handler, stop context.CancelFunc, subscriber *lib.PassthroughSubscriber,
+	subscriberDone <-chan struct{}, httpServer *http.Server, server *mqtt.Server) {
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), timeout)
+	defer cancelDrain()
+	slog.Info("Draining running load tests", "timeout", timeout)
+	for _, job := range handler.Shutdown(drainCtx) {
+		slog.Warn("Load test cut short by shutdown", "job", job.ID, "devices", job.Devices,
+			"elapsed_seconds", job.ElapsedSeconds, "duration_seconds", job.DurationSeconds, "published", job.Published)
+	}
 
 	stop()
-	// Shutdown servers...
+	<-subscriberDone
+	if subscriber != nil {
+		if err := subscriber.Close(); err != nil {
+			slog.Error("Failed to close Pub/Sub passthrough subscriber", "error", err)
+		}
+	}
+
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelHTTP()
+	if err := httpServer.Shutdown(httpCtx); err != nil {
+		slog.Error("HTTP server did not shut down cleanly, closing open connections", "error", err)
+		_ = httpServer.Close()
+	}
+
+	if err := server.Close(); err != nil {
+		slog.Error("Failed to close Mochi server", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
 
-// addAuthHook configures the server with basic authentication rules from env vars.
-func addAuthHook(server *mqtt.Server) error {
-	// These credentials will now be used by the external ingestion service.
-	clientUser := os.Getenv("MQTT_USERNAME") // Using a generic name
-	clientPass := os.Getenv("MQTT_PASSWORD") // Using a generic name
+// addAuthHook configures the server's credential ledger and topic ACLs. The
+// returned ledger is shared with the hook so it can be updated on reload.
+func addAuthHook(server *mqtt.Server, clientUser, clientPass string, aclRules []aclRule) (*auth.Ledger, error) {
+	ledger := &auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: auth.RString(clientUser), Password: auth.RString(clientPass), Allow: true},
+		},
+		ACL: buildACL(aclRules),
+	}
 
-	if clientUser == "" || clientPass == "" {
-		slog.Warn("MQTT_USERNAME or MQTT_PASSWORD not set. Auth hook will be permissive.")
-		return server.AddHook(new(auth.AllowHook), nil)
+	if err := server.AddHook(new(auth.Hook), &auth.Options{Ledger: ledger}); err != nil {
+		return nil, err
 	}
+	return ledger, nil
+}
 
-	authRules := auth.AuthRules{
-		{Username: auth.RString(clientUser), Password: auth.RString(clientPass), Allow: true},
+// reloadConfig re-reads the configuration, fetches the current password and
+// swaps the ledger rules in place. Connected clients are not affected; a bad
+// config is logged and the current rules are kept. A bearer control token is
+// re-read too; changing the control auth mode needs a restart.
+func reloadConfig(ctx context.Context, configPath string, ledger *auth.Ledger, tokenAuth *lib.TokenAuth, level *slog.LevelVar) {
+	slog.Info("SIGHUP received, reloading configuration")
+
+	cfg, err := loadLoadgenConfig(configPath)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	clientPass, err := cfg.resolvePassword(ctx)
+	if err != nil {
+		slog.Error("Config reload failed to fetch the MQTT password, keeping the current configuration", "error", err)
+		return
 	}
 
-	return server.AddHook(new(auth.AllowHook), &auth.Options{
-		Ledger: &auth.Ledger{
-			Auth: authRules,
+	ledger.Update(&auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: auth.RString(cfg.Username), Password: auth.RString(clientPass), Allow: true},
 		},
+		ACL: buildACL(cfg.aclRules()),
 	})
+	if tokenAuth != nil && cfg.ControlAuth.Mode == controlAuthBearer {
+		token, err := cfg.ControlAuth.resolveToken(ctx)
+		if err != nil {
+			slog.Error("Config reload failed to fetch the control token, keeping the current token", "error", err)
+		} else {
+			tokenAuth.Update(token)
+		}
+	}
+	level.Set(cfg.slogLevel())
+	slog.Info("Configuration reloaded", "username", cfg.Username)
+}
+
+// newControlAuth creates the authenticator for the control endpoints, or nil
+// when they are open. A bearer token authenticator is also returned on its own
+// so a reload can rotate the token.
+func newControlAuth(ctx context.Context, cfg controlAuthConfig) (lib.Authenticator, *lib.TokenAuth, error) {
+	switch cfg.Mode {
+	case controlAuthBearer:
+		token, err := cfg.resolveToken(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch control token: %w", err)
+		}
+		tokenAuth := lib.NewTokenAuth(token)
+		return tokenAuth, tokenAuth, nil
+	case controlAuthOIDC:
+		verifier, err := lib.NewOIDCVerifier(lib.OIDCOptions{
+			Audience:      cfg.Audience,
+			AllowedEmails: cfg.AllowedEmails,
+			CertsURL:      cfg.CertsURL,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return verifier, nil, nil
+	default:
+		return nil, nil, nil
+	}
 }
@@ -27,6 +27,7 @@ import (
 	"github.com/illmade-knight/go-cloud-manager/pkg/servicemanager"
 	"github.com/illmade-knight/go-dataflow-services/pkg/ingestion"
 	"github.com/illmade-knight/go-test/emulators"
+	"github.com/illmade-knight/go-test/loadgen"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/api/iterator"
@@ -116,7 +117,19 @@ func TestReplayToSimpleBigqueryFlowE2E(t *testing.T) {
 	deviceMessagesToReplay, err := replay.ReadMessagesFromGCS(t, totalTestContext, logger, gcsClient, sourceGCSBucketName)
 	require.NoError(t, err)
 
-	replayDevices, totalMessages := replay.CreateReplayDevices(t, logger, deviceMessagesToReplay, replayToBigqueryMessagesFor)
+	// REPLAY_SPEED switches to a timed replay that keeps the archived timing,
+	// sped up by the given factor (0 for as fast as possible).
+	var replayDevices []*loadgen.Device
+	var timedReplay *replay.TimedReplay
+	var totalMessages int
+	if speed := os.Getenv("REPLAY_SPEED"); speed != "" {
+		factor, err := strconv.ParseFloat(speed, 64)
+		require.NoError(t, err, "REPLAY_SPEED must be a number")
+		require.GreaterOrEqual(t, factor, 0.0, "REPLAY_SPEED must not be negative")
+		timedReplay, totalMessages = replay.CreateTimedReplayDevices(t, logger, deviceMessagesToReplay, replay.TimingPayload, factor)
+	} else {
+		replayDevices, totalMessages = replay.CreateReplayDevices(t, logger, deviceMessagesToReplay, replayToBigqueryMessagesFor)
+	}
 	expectedReplayCount = totalMessages
 	require.Greater(t, expectedReplayCount, 0, "No messages found in GCS bucket %s to replay.", sourceGCSBucketName)
 
@@ -167,7 +180,11 @@ func TestReplayToSimpleBigqueryFlowE2E(t *testing.T) {
 	// 6. Replay messages to MQTT emulator.
 	replayStart := time.Now()
 	logger.Info().Msg("Starting MQTT replay of GCS messages...")
-	replayedCount, err = replay.ReplayGCSMessagesToMQTT(t, totalTestContext, logger, mqttConn.EmulatorAddress, replayDevices, replayToBigqueryMessagesFor)
+	if timedReplay != nil {
+		replayedCount, err = replay.ReplayTimedMessagesToMQTT(t, totalTestContext, logger, mqttConn.EmulatorAddress, timedReplay)
+	} else {
+		replayedCount, err = replay.ReplayGCSMessagesToMQTT(t, totalTestContext, logger, mqttConn.EmulatorAddress, replayDevices, replayToBigqueryMessagesFor)
+	}
 	require.NoError(t, err)
 	timings["ReplayLoadGeneration"] = time.Since(replayStart).String()
 	logger.Info().Int("replayed_count", replayedCount).Msg("Messages replayed to MQTT emulator.")
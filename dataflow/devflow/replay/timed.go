@@ -0,0 +1,236 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/illmade-knight/go-test/loadgen"
+	"github.com/rs/zerolog"
+)
+
+// AsFastAsPossible is the replay speed that sends messages in their original
+// order without waiting between them.
+const AsFastAsPossible = 0
+
+// TimingSource selects which recorded time a timed replay follows. The other
+// one is used for messages that lack it.
+type TimingSource string
+
+const (
+	// TimingPayload follows the device's own timestamp in the original payload.
+	TimingPayload TimingSource = "payload"
+	// TimingArchived follows the time the message was archived.
+	TimingArchived TimingSource = "archived_at"
+)
+
+// timedSend is one scheduled message: the device's next payload, at an
+// offset from the start of the replay.
+type timedSend struct {
+	at     time.Duration
+	device *loadgen.Device
+}
+
+// TimedReplay sends archived messages at their original offsets, scaled by a
+// speed factor, keeping the timing both within and across devices.
+type TimedReplay struct {
+	devices  []*loadgen.Device
+	schedule []timedSend
+	speed    float64
+}
+
+// timedPayload is an archived payload and the time it is replayed by.
+type timedPayload struct {
+	deviceID string
+	at       time.Time
+	payload  []byte
+}
+
+// CreateTimedReplayDevices takes messages grouped by device ID and schedules
+// them by their recorded time, read from each raw archived message. speed 1
+// replays in real time, 10 ten times faster and AsFastAsPossible without
+// waiting. A negative speed fails the test. Messages with no usable time are
+// skipped. It returns the replay and the number of messages it will send.
+func CreateTimedReplayDevices(
+	t *testing.T,
+	logger zerolog.Logger,
+	deviceMessages map[string][][]byte,
+	source TimingSource,
+	speed float64,
+) (*TimedReplay, int) {
+	t.Helper()
+	if err := validateSpeed(speed); err != nil {
+		t.Fatal(err)
+	}
+	replayLogger := logger.With().Str("component", "TimedReplayDeviceCreator").Logger()
+
+	var timed []timedPayload
+	for deviceID, payloads := range deviceMessages {
+		for _, payload := range payloads {
+			at, err := recordedTime(payload, source)
+			if err != nil {
+				replayLogger.Warn().Err(err).Str("device_id", deviceID).Msg("Message has no usable timestamp, skipping.")
+				continue
+			}
+			timed = append(timed, timedPayload{deviceID: deviceID, at: at, payload: payload})
+		}
+	}
+	if len(timed) == 0 {
+		replayLogger.Warn().Msg("No timestamped messages provided to create replay devices.")
+		return &TimedReplay{speed: speed}, 0
+	}
+
+	replay := newTimedReplay(timed, speed)
+	replayLogger.Info().Int("num_devices", len(replay.devices)).Int("total_messages", len(replay.schedule)).
+		Dur("replay_duration", replay.Duration()).Float64("speed", speed).Msg("Created timed replay devices.")
+	return replay, len(replay.schedule)
+}
+
+// recordedTime reads the time a raw archived message is replayed by.
+func recordedTime(raw []byte, source TimingSource) (time.Time, error) {
+	var payload rawFilePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return time.Time{}, err
+	}
+	first, second := payload.OriginalPubsubPayload.Timestamp, payload.ArchivedAt
+	if source == TimingArchived {
+		first, second = second, first
+	}
+	if !first.IsZero() {
+		return first, nil
+	}
+	if !second.IsZero() {
+		return second, nil
+	}
+	return time.Time{}, fmt.Errorf("neither timestamp nor archived_at is set")
+}
+
+// validateSpeed rejects speeds that cannot scale a schedule. Without it a
+// negative speed would quietly replay as fast as possible.
+func validateSpeed(speed float64) error {
+	if !(speed >= 0) {
+		return fmt.Errorf("replay speed must be zero or positive, got %v", speed)
+	}
+	return nil
+}
+
+// newTimedReplay builds one device per device ID, each replaying its own
+// payloads in time order, and the schedule that drives them.
+func newTimedReplay(timed []timedPayload, speed float64) *TimedReplay {
+	sort.SliceStable(timed, func(i, k int) bool { return timed[i].at.Before(timed[k].at) })
+	first, last := timed[0].at, timed[len(timed)-1].at
+
+	payloads := make(map[string][][]byte)
+	var order []string
+	for _, msg := range timed {
+		if _, ok := payloads[msg.deviceID]; !ok {
+			order = append(order, msg.deviceID)
+		}
+		payloads[msg.deviceID] = append(payloads[msg.deviceID], msg.payload)
+	}
+
+	replay := &TimedReplay{speed: speed, schedule: make([]timedSend, 0, len(timed))}
+	devices := make(map[string]*loadgen.Device, len(order))
+	span := last.Sub(first).Seconds()
+	for _, deviceID := range order {
+		device := &loadgen.Device{ID: deviceID, PayloadGenerator: loadgen.NewReplayPayloadGenerator(payloads[deviceID])}
+		if span > 0 {
+			device.MessageRate = float64(len(payloads[deviceID])) / span
+		}
+		devices[deviceID] = device
+		replay.devices = append(replay.devices, device)
+	}
+	for _, msg := range timed {
+		var at time.Duration
+		if speed > 0 {
+			at = time.Duration(float64(msg.at.Sub(first)) / speed)
+		}
+		replay.schedule = append(replay.schedule, timedSend{at: at, device: devices[msg.deviceID]})
+	}
+	return replay
+}
+
+// Devices returns one device per replayed device ID.
+func (r *TimedReplay) Devices() []*loadgen.Device {
+	return r.devices
+}
+
+// Duration is how long the replay takes at its speed; zero when it runs as
+// fast as possible.
+func (r *TimedReplay) Duration() time.Duration {
+	if len(r.schedule) == 0 {
+		return 0
+	}
+	return r.schedule[len(r.schedule)-1].at
+}
+
+// Run connects client and sends every scheduled message until done or ctx is
+// cancelled. A send that falls behind schedule goes out immediately, so
+// bursts stay bursts.
+func (r *TimedReplay) Run(ctx context.Context, client loadgen.Client, logger zerolog.Logger) (int, error) {
+	if err := client.Connect(); err != nil {
+		return 0, fmt.Errorf("failed to connect replay client: %w", err)
+	}
+	defer client.Disconnect()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	start := time.Now()
+	published := 0
+	for _, send := range r.schedule {
+		if wait := send.at - time.Since(start); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return published, ctx.Err()
+			case <-timer.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			return published, err
+		}
+
+		ok, err := client.Publish(ctx, send.device)
+		if err != nil {
+			if ctx.Err() != nil {
+				return published, ctx.Err()
+			}
+			logger.Warn().Err(err).Str("device_id", send.device.ID).Msg("Replay publish failed.")
+			continue
+		}
+		if ok {
+			published++
+		}
+	}
+	return published, nil
+}
+
+// ReplayTimedMessagesToMQTT publishes a timed replay to the MQTT emulator.
+func ReplayTimedMessagesToMQTT(
+	t *testing.T,
+	ctx context.Context,
+	logger zerolog.Logger,
+	mqttEmulatorAddress string,
+	replay *TimedReplay,
+) (int, error) {
+	t.Helper()
+	replayLogger := logger.With().Str("component", "TimedMQTTReplayer").Logger()
+
+	if len(replay.schedule) == 0 {
+		replayLogger.Warn().Msg("No timed replay messages provided. Skipping MQTT replay.")
+		return 0, nil
+	}
+
+	loadgenClient := loadgen.NewMqttClient(mqttEmulatorAddress, "devices/+/data", 1, replayLogger)
+	replayLogger.Info().Int("total_messages", len(replay.schedule)).Dur("duration", replay.Duration()).Float64("speed", replay.speed).Msg("Starting timed MQTT replay...")
+	publishedCount, err := replay.Run(ctx, loadgenClient, replayLogger)
+	if err != nil {
+		return publishedCount, fmt.Errorf("timed replay stopped early: %w", err)
+	}
+	replayLogger.Info().Int("replayed_count", publishedCount).Msg("Timed MQTT replay finished.")
+	return publishedCount, nil
+}
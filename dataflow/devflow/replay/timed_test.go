@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archivedMessage builds a raw archived message as ReadMessagesFromGCS returns it.
+func archivedMessage(deviceID string, timestamp, archivedAt time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"id": "m", "original_pubsub_payload": {"device_id": %q, "timestamp": %q, "value": 1}, "archived_at": %q}`,
+		deviceID, timestamp.Format(time.RFC3339Nano), archivedAt.Format(time.RFC3339Nano)))
+}
+
+// TestCreateTimedReplayDevicesSchedulesByRecordedTime verifies messages are
+// scheduled across devices by their timestamp, scaled by the speed.
+func TestCreateTimedReplayDevicesSchedulesByRecordedTime(t *testing.T) {
+	// --- Arrange ---
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	archived := start.Add(time.Hour)
+	deviceMessages := map[string][][]byte{
+		"dev-1": {archivedMessage("dev-1", start.Add(30*time.Second), archived), archivedMessage("dev-1", start, archived)},
+		"dev-2": {archivedMessage("dev-2", start.Add(10*time.Second), archived), []byte(`{"id": "broken"}`)},
+	}
+
+	// --- Act ---
+	replay, total := CreateTimedReplayDevices(t, zerolog.Nop(), deviceMessages, TimingPayload, 10)
+
+	// --- Assert ---
+	require.Equal(t, 3, total, "the message without a time is skipped")
+	assert.Equal(t, 3*time.Second, replay.Duration())
+	var schedule []string
+	for _, send := range replay.schedule {
+		schedule = append(schedule, fmt.Sprintf("%s@%s", send.device.ID, send.at))
+	}
+	assert.Equal(t, []string{"dev-1@0s", "dev-2@1s", "dev-1@3s"}, schedule)
+	assert.Len(t, replay.Devices(), 2)
+}
+
+// TestValidateSpeed verifies only zero and positive speeds are accepted.
+func TestValidateSpeed(t *testing.T) {
+	testCases := []struct {
+		name    string
+		speed   float64
+		wantErr bool
+	}{
+		{name: "as fast as possible", speed: AsFastAsPossible},
+		{name: "real time", speed: 1},
+		{name: "slowed down", speed: 0.5},
+		{name: "negative", speed: -1, wantErr: true},
+		{name: "not a number", speed: math.NaN(), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateSpeed(tc.speed)
+
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestRecordedTimeFallsBack verifies the other timestamp is used when the
+// chosen one is missing.
+func TestRecordedTimeFallsBack(t *testing.T) {
+	// --- Arrange ---
+	archived := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	raw := []byte(`{"original_pubsub_payload": {"device_id": "dev-1"}, "archived_at": "2025-03-01T12:00:00Z"}`)
+
+	// --- Act ---
+	fromPayload, err := recordedTime(raw, TimingPayload)
+
+	// --- Assert ---
+	require.NoError(t, err)
+	assert.True(t, fromPayload.Equal(archived))
+}